@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"koolnova2mqtt/kn"
+	"koolnova2mqtt/modbus"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiHandler serves the state of the modules as JSON and accepts changes
+// through the same methods used by the MQTT /set topics:
+//
+//	GET /modules
+//	GET /modules/{name}
+//	GET /modules/{name}/zones
+//	GET, PUT, PATCH /modules/{name}/zones/{n}
+//	GET, PUT, PATCH /modules/{name}/sys
+type apiHandler struct {
+	bridges func() []*kn.Bridge // returns the running bridges
+}
+
+// sysUpdate is the body of a sys PUT or PATCH
+type sysUpdate struct {
+	HoldMode *string `json:"holdMode"`
+}
+
+// moduleStatus is the state of a whole module
+type moduleStatus struct {
+	Name    string          `json:"name"`
+	MinTemp float32         `json:"minTemp"`
+	MaxTemp float32         `json:"maxTemp"`
+	Zones   []kn.ZoneStatus `json:"zones"`
+	Sys     *kn.SysStatus   `json:"sys"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+var errNotFound = errors.New("Not found")
+var errMethodNotAllowed = errors.New("Method not allowed")
+var errBadRequest = errors.New("Bad request")
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result, err := h.serve(r)
+	if err != nil {
+		writeJSON(w, errorStatus(err), &apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (h *apiHandler) serve(r *http.Request) (interface{}, error) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "modules" {
+		return nil, errNotFound
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			return nil, errMethodNotAllowed
+		}
+		var modules []*moduleStatus
+		for _, b := range h.bridges() {
+			modules = append(modules, getModuleStatus(b))
+		}
+		return modules, nil
+	}
+
+	b := h.getBridge(parts[1])
+	if b == nil {
+		return nil, fmt.Errorf("%w: unknown module %q", errNotFound, parts[1])
+	}
+	switch {
+	case len(parts) == 2:
+		if r.Method != http.MethodGet {
+			return nil, errMethodNotAllowed
+		}
+		return getModuleStatus(b), nil
+	case len(parts) == 3 && parts[2] == "zones":
+		if r.Method != http.MethodGet {
+			return nil, errMethodNotAllowed
+		}
+		return b.ZoneStatus(), nil
+	case len(parts) == 4 && parts[2] == "zones":
+		zoneNum, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid zone %q", errNotFound, parts[3])
+		}
+		return serveZone(b, zoneNum, r)
+	case len(parts) == 3 && parts[2] == "sys":
+		return serveSys(b, r)
+	}
+	return nil, errNotFound
+}
+
+func (h *apiHandler) getBridge(name string) *kn.Bridge {
+	for _, b := range h.bridges() {
+		if b.ModuleName == name {
+			return b
+		}
+	}
+	return nil
+}
+
+func getModuleStatus(b *kn.Bridge) *moduleStatus {
+	status := &moduleStatus{
+		Name:    b.ModuleName,
+		MinTemp: b.MinTemp,
+		MaxTemp: b.MaxTemp,
+		Zones:   b.ZoneStatus(),
+	}
+	status.Sys, _ = b.SysStatus()
+	return status
+}
+
+func serveZone(b *kn.Bridge, zoneNum int, r *http.Request) (interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPatch:
+		var settings kn.ZoneSettings
+		if err := decodeBody(r, &settings); err != nil {
+			return nil, err
+		}
+		if err := b.SetZone(zoneNum, &settings); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errMethodNotAllowed
+	}
+	return b.GetZoneStatus(zoneNum)
+}
+
+func serveSys(b *kn.Bridge, r *http.Request) (interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPatch:
+		var update sysUpdate
+		if err := decodeBody(r, &update); err != nil {
+			return nil, err
+		}
+		if update.HoldMode != nil {
+			if err := b.SetHoldMode(*update.HoldMode); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errMethodNotAllowed
+	}
+	return b.SysStatus()
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %s", errBadRequest, err)
+	}
+	return nil
+}
+
+// errorStatus returns the HTTP status code that corresponds to an error
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotFound), errors.Is(err, kn.ErrUnknownZone):
+		return http.StatusNotFound
+	case errors.Is(err, errMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, errBadRequest),
+		errors.Is(err, kn.ErrInvalidTemperature),
+		errors.Is(err, kn.ErrInvalidFanMode),
+		errors.Is(err, kn.ErrInvalidHvacMode),
+		errors.Is(err, kn.ErrInvalidHoldMode):
+		return http.StatusBadRequest
+	case errors.Is(err, kn.ErrNotStarted):
+		return http.StatusServiceUnavailable
+	case errors.As(err, new(*modbus.SupersededError)):
+		// a later request for the same register was sent instead
+		return http.StatusConflict
+	}
+	// the module could not be read or written
+	return http.StatusBadGateway
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing HTTP response: %s\n", err)
+	}
+}
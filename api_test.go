@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"koolnova2mqtt/kn"
+	"koolnova2mqtt/modbus"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+type nopMqttClient struct{}
+
+func (nopMqttClient) Publish(topic string, qos byte, retained bool, payload string) error {
+	return nil
+}
+
+func (nopMqttClient) Subscribe(topic string, callback func(message string)) error {
+	return nil
+}
+
+func TestAPI(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	modbusClient := modbus.NewMock()
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:  "first",
+		SlaveID:     49,
+		TopicPrefix: "koolnova2mqtt",
+		MinTemp:     15,
+		MaxTemp:     35,
+		Mqtt:        nopMqttClient{},
+		Modbus:      modbusClient,
+	})
+	handler := &apiHandler{bridges: func() []*kn.Bridge {
+		return []*kn.Bridge{b}
+	}}
+
+	request := func(method, path, body string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var result map[string]interface{}
+		t.Ok(json.Unmarshal(rec.Body.Bytes(), &result))
+		return rec.Code, result
+	}
+
+	code, result := request(http.MethodGet, "/modules/first/sys", "")
+	t.Equals(http.StatusServiceUnavailable, code)
+	t.Equals(kn.ErrNotStarted.Error(), result["error"])
+
+	t.Ok(b.Start())
+
+	code, result = request(http.MethodGet, "/modules/first/zones/1", "")
+	t.Equals(http.StatusOK, code)
+	t.Equals(20.5, result["targetTemp"])
+
+	code, result = request(http.MethodPatch, "/modules/first/zones/1", `{"targetTemp": 23, "fanMode": "low"}`)
+	t.Equals(http.StatusOK, code)
+	t.Equals(23.0, result["targetTemp"])
+	t.Equals("low", result["fanMode"])
+	t.Equals(uint16(46), modbusClient.State[49][2])
+
+	code, result = request(http.MethodPut, "/modules/first/zones/1", `{"fanMode": "turbo"}`)
+	t.Equals(http.StatusBadRequest, code)
+	t.Equals(`Unknown fan mode "turbo"`, result["error"])
+
+	code, _ = request(http.MethodPatch, "/modules/first/zones/1", `{"targetTemp": 50}`)
+	t.Equals(http.StatusBadRequest, code)
+	t.Equals(uint16(46), modbusClient.State[49][2])
+
+	code, _ = request(http.MethodPatch, "/modules/first/zones/1", `{"temp": 20}`)
+	t.Equals(http.StatusBadRequest, code)
+
+	code, _ = request(http.MethodGet, "/modules/first/zones/16", "")
+	t.Equals(http.StatusNotFound, code)
+
+	code, _ = request(http.MethodGet, "/modules/second/zones/1", "")
+	t.Equals(http.StatusNotFound, code)
+
+	code, result = request(http.MethodPatch, "/modules/first/sys", `{"holdMode": "fan"}`)
+	t.Equals(http.StatusOK, code)
+	t.Equals("fan", result["holdMode"])
+
+	code, _ = request(http.MethodDelete, "/modules/first/sys", "")
+	t.Equals(http.StatusMethodNotAllowed, code)
+}
@@ -14,10 +14,15 @@ import (
 	"time"
 )
 
+// ENV_PREFIX is the prefix of environment variables that can replace
+// command line flags, e.g. KOOLNOVA2MQTT_HASS_PREFIX for --hassPrefix
+const ENV_PREFIX = "KOOLNOVA2MQTT_"
+
 type Config struct {
-	MqttClient           *mqtt.Client
-	slaves               map[byte]string
-	BridgeTemplateConfig *kn.Config
+	MqttClient *mqtt.FanOut     // Publishes to the main broker and any additional ones
+	Buses      []*modbus.Modbus // One modbus client per bus
+	Bridges    []*kn.Config     // One bridge configuration per slave
+	HTTPListen string           // Address of the HTTP server, disabled if empty
 }
 
 func generateNodeName(slaveID string, port string) string {
@@ -27,88 +32,385 @@ func generateNodeName(slaveID string, port string) string {
 	}
 	hostname, _ := os.Hostname()
 
+	if i := strings.Index(port, "://"); i >= 0 {
+		port = port[i+3:]
+	}
 	port = strings.Replace(port, "/dev/", "", -1)
 	port = reg.ReplaceAllString(port, "")
 	return strings.ToLower(fmt.Sprintf("%s_%s_%s", hostname, port, slaveID))
 
 }
 
-func parseModbusSlaveInfo(slaveIDs, slaveNames string, modbusPort string) map[byte]string {
+// generateBridgeID returns the Home Assistant identifier of this koolnova2mqtt instance
+func generateBridgeID() string {
+	reg := regexp.MustCompile("[^a-zA-Z0-9]+")
+	hostname, _ := os.Hostname()
+	return strings.ToLower("koolnova2mqtt_" + reg.ReplaceAllString(hostname, ""))
+}
+
+// splitList splits a comma-separated list, ignoring empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseModbusSlaveInfo(slaveIDs, slaveNames string) ([]*SlaveConfig, error) {
 	slaveIDStrList := strings.Split(slaveIDs, ",")
 	var slaveNameList []string
 
-	if slaveNames == "" {
-		for _, slaveIDStr := range slaveIDStrList {
-			slaveNameList = append(slaveNameList, generateNodeName(slaveIDStr, modbusPort))
-		}
-	} else {
+	if slaveNames != "" {
 		slaveNameList = strings.Split(slaveNames, ",")
 		if len(slaveIDStrList) != len(slaveNameList) {
-			log.Fatalf("modbusSlaveIDs and modbusSlaveNames lists must have the same length")
+			return nil, &ConfigError{Key: "modbusSlaveNames", Message: "modbusSlaveIDs and modbusSlaveNames lists must have the same length"}
 		}
 	}
 
-	slaves := make(map[byte]string)
+	var slaves []*SlaveConfig
 	for i, slaveIDStr := range slaveIDStrList {
-		slaveID, err := strconv.Atoi(slaveIDStr)
+		slaveID, err := strconv.Atoi(strings.TrimSpace(slaveIDStr))
 		if err != nil {
-			log.Fatalf("Error parsing slaveID list")
+			return nil, &ConfigError{Key: "modbusSlaveIDs", Message: fmt.Sprintf("invalid slave ID %q", slaveIDStr)}
 		}
-		slaves[byte(slaveID)] = slaveNameList[i]
+		slave := &SlaveConfig{ID: slaveID}
+		if slaveNameList != nil {
+			slave.Name = slaveNameList[i]
+		}
+		slaves = append(slaves, slave)
 	}
-	return slaves
+	return slaves, nil
 }
 
-func ParseCommandLine() *Config {
+// envName returns the environment variable that can replace a flag. Words start at
+// capital letters, and a run of capitals is a single word, even with a lowercase letter
+// inside, so modbusSlaveIDs becomes KOOLNOVA2MQTT_MODBUS_SLAVE_IDS and mqttQoS becomes
+// KOOLNOVA2MQTT_MQTT_QOS.
+func envName(flagName string) string {
+	var name strings.Builder
+	runes := []rune(flagName)
+	isUpper := func(i int) bool {
+		return i >= 0 && runes[i] >= 'A' && runes[i] <= 'Z'
+	}
+	for i, r := range runes {
+		// a capital after a single lowercase letter that follows a capital, as in QoS, continues the word
+		if i > 0 && isUpper(i) && !isUpper(i-1) && !isUpper(i-2) {
+			name.WriteByte('_')
+		}
+		name.WriteRune(r)
+	}
+	return ENV_PREFIX + strings.ToUpper(name.String())
+}
+
+// parseConfig reads the configuration from the command line, the environment
+// and the configuration file, in decreasing order of precedence
+func parseConfig(args []string, getenv func(string) string) (*FileConfig, error) {
 	hostname, _ := os.Hostname()
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	configFile := flags.String("config", "", "Path to a YAML configuration file. Flags and environment variables override its values")
+	server := flags.String("server", "tcp://127.0.0.1:1883", "The full url of the MQTT server to connect to ex: tcp://127.0.0.1:1883")
+	clientid := flags.String("clientid", hostname+strconv.Itoa(time.Now().Second()), "A clientid for the connection")
+	username := flags.String("username", "", "A username to authenticate to the MQTT server")
+	password := flags.String("password", "", "Password to match username")
+	caCert := flags.String("caCert", "", "PEM file with the CA certificates that sign the MQTT server certificate. Defaults to the system CAs")
+	clientCert := flags.String("clientCert", "", "PEM file with a client certificate, to authenticate to the MQTT server with mutual TLS")
+	clientKey := flags.String("clientKey", "", "PEM file with the private key of clientCert")
+	tlsServerName := flags.String("tlsServerName", "", "Name expected in the MQTT server certificate. Defaults to the host of server")
+	tlsInsecure := flags.Bool("tlsInsecure", false, "Do not verify the MQTT server certificate. Insecure, for testing only")
+	mqttVersion := flags.Int("mqttVersion", mqtt.VERSION_311, "MQTT protocol version: 3 (MQTT 3.1.1) or 5 (MQTT 5, with persistent sessions, user properties and responses to set commands)")
+	sessionExpiry := flags.Duration("mqttSessionExpiry", mqtt.DEFAULT_SESSION_EXPIRY, "How long the MQTT 5 broker keeps the session, with its subscriptions, after the connection is lost")
+	outboxSize := flags.Int("mqttOutboxSize", 0, "Maximum number of messages kept while disconnected from MQTT, published in order on reconnection. Only the latest message of every topic is kept. Disabled if zero")
+	outboxFile := flags.String("mqttOutboxFile", "", "File where the MQTT outbox is saved, so it survives restarts")
+	outboxHistory := flags.String("mqttOutboxHistory", "", "Comma-separated list of topic filters, such as koolnova2mqtt/+/+/currentTemp, that keep every message in the outbox instead of only the latest one")
+	qos := flags.String("mqttQoS", "", "QoS of the topic classes, as a comma-separated list such as commands=1. Classes are discovery, state, telemetry, commands (also the QoS of the subscriptions to set topics) and availability. Defaults to 0")
+	retain := flags.String("mqttRetain", "", "Retain flag of the topic classes, as a comma-separated list such as telemetry=false. Defaults to true, except for commands")
+	prefix := flags.String("prefix", "koolnova2mqtt", "MQTT topic root where to publish/read topics")
+	hassPrefix := flags.String("hassPrefix", "homeassistant", "Home assistant discovery prefix")
+	homiePrefix := flags.String("homiePrefix", kn.DEFAULT_HOMIE_PREFIX, "Homie base topic, where the homie output publishes the modules as devices")
+	minTemp := flags.Float64("minTemp", kn.DEFAULT_MIN_TEMP, "Minimum target temperature offered to Home Assistant")
+	maxTemp := flags.Float64("maxTemp", kn.DEFAULT_MAX_TEMP, "Maximum target temperature offered to Home Assistant")
+	pollInterval := flags.Duration("pollInterval", kn.DEFAULT_POLL_INTERVAL, "How often to poll the zones of the modbus slaves for changes")
+	sysPollInterval := flags.Duration("sysPollInterval", 0, "How often to poll the system registers of the modbus slaves. Defaults to pollInterval")
+	fastPollInterval := flags.Duration("fastPollInterval", 0, "Poll interval after a change is detected or requested, such as 500ms. Disabled if zero")
+	fastPollDuration := flags.Duration("fastPollDuration", kn.DEFAULT_FAST_POLL_DURATION, "How long to poll at fastPollInterval after a change")
+	httpListen := flags.String("httpListen", "", "Address where to serve the HTTP API and Prometheus metrics, such as :9100. Disabled if empty")
+	output := flags.String("output", kn.OUTPUT_TOPICS, "How to publish the state of the modules, as a comma-separated list of: topics (one topic per attribute, with Home Assistant discovery), json (one JSON document per module) or homie (Homie 4.0 devices). both, for topics and json, is deprecated")
+	offlineAfter := flags.Int("offlineAfter", kn.DEFAULT_MAX_FAILURES, "Number of consecutive failed polls after which a module is reported offline")
+	modbusPort := flags.String("modbusPort", "/dev/ttyUSB0", "Serial port where modbus hardware is connected, or a URL such as rtu:///dev/ttyUSB0, tcp://host:502 or rtuovertcp://host:4196")
+	modbusPortBaudRate := flags.Int("modbusRate", 9600, "Modbus port data rate")
+	modbusDataBits := flags.Int("modbusDataBits", 8, "Modbus port data bits")
+	modbusPortParity := flags.String("modbusParity", "E", "N - None, E - Even, O - Odd (default E) (The use of no parity requires 2 stop bits.)")
+	modbusStopBits := flags.Int("modbusStopBits", 1, "Modbus port stop bits")
+	modbusThrottle := flags.Duration("modbusThrottle", modbus.DEFAULT_THROTTLE, "Pause after every modbus operation, so slow devices can keep up")
+	modbusQueueLength := flags.Int("modbusQueueLength", modbus.DEFAULT_QUEUE_LENGTH, "Maximum number of pending modbus writes per bus. Further writes are dropped")
+	modbusSlaveList := flags.String("modbusSlaveIDs", "49", "Comma-separated list of modbus slave IDs to manage")
+	modbusSlaveNames := flags.String("modbusSlaveNames", "", "Comma-separated list of modbus slave names. Defaults to 'slave#'")
+
+	flags.Parse(args)
 
-	server := flag.String("server", "tcp://127.0.0.1:1883", "The full url of the MQTT server to connect to ex: tcp://127.0.0.1:1883")
-	clientid := flag.String("clientid", hostname+strconv.Itoa(time.Now().Second()), "A clientid for the connection")
-	username := flag.String("username", "", "A username to authenticate to the MQTT server")
-	password := flag.String("password", "", "Password to match username")
-	prefix := flag.String("prefix", "koolnova2mqtt", "MQTT topic root where to publish/read topics")
-	hassPrefix := flag.String("hassPrefix", "homeassistant", "Home assistant discovery prefix")
-	modbusPort := flag.String("modbusPort", "/dev/ttyUSB0", "Serial port where modbus hardware is connected")
-	modbusPortBaudRate := flag.Int("modbusRate", 9600, "Modbus port data rate")
-	modbusDataBits := flag.Int("modbusDataBits", 8, "Modbus port data bits")
-	modbusPortParity := flag.String("modbusParity", "E", "N - None, E - Even, O - Odd (default E) (The use of no parity requires 2 stop bits.)")
-	modbusStopBits := flag.Int("modbusStopBits", 1, "Modbus port stop bits")
-	modbusSlaveList := flag.String("modbusSlaveIDs", "49", "Comma-separated list of modbus slave IDs to manage")
-	modbusSlaveNames := flag.String("modbusSlaveNames", "", "Comma-separated list of modbus slave names. Defaults to 'slave#'")
-
-	flag.Parse()
-
-	slaves := parseModbusSlaveInfo(*modbusSlaveList, *modbusSlaveNames, *modbusPort)
-
-	mb, err := modbus.New(&modbus.Config{
-		Port:     *modbusPort,
-		BaudRate: *modbusPortBaudRate,
-		DataBits: *modbusDataBits,
-		Parity:   *modbusPortParity,
-		StopBits: *modbusStopBits,
-		Timeout:  200 * time.Millisecond,
+	// environment variables replace flags that were not given explicitly
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
 	})
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		if value := getenv(envName(f.Name)); value != "" {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = &ConfigError{Key: envName(f.Name), Message: setErr.Error()}
+			}
+			set[f.Name] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	config := &FileConfig{}
+	if *configFile != "" {
+		config, err = loadConfigFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// flag values are used if given explicitly or if the file does not have a value
+	overrideString := func(name string, value *string, flagValue string) {
+		if set[name] || *value == "" {
+			*value = flagValue
+		}
+	}
+	overrideInt := func(name string, value *int, flagValue int) {
+		if set[name] || *value == 0 {
+			*value = flagValue
+		}
+	}
+	overrideTemp := func(name string, value *float32, flagValue float64) {
+		if set[name] || *value == 0 {
+			*value = float32(flagValue)
+		}
+	}
+	overrideDuration := func(name string, value *time.Duration, flagValue time.Duration) {
+		if set[name] || *value == 0 {
+			*value = flagValue
+		}
+	}
+	overrideBool := func(name string, value *bool, flagValue bool) {
+		if set[name] {
+			*value = flagValue
+		}
+	}
+	overrideString("server", &config.Server, *server)
+	overrideString("clientid", &config.ClientID, *clientid)
+	overrideString("username", &config.Username, *username)
+	overrideString("password", &config.Password, *password)
+	overrideString("caCert", &config.CACert, *caCert)
+	overrideString("clientCert", &config.ClientCert, *clientCert)
+	overrideString("clientKey", &config.ClientKey, *clientKey)
+	overrideString("tlsServerName", &config.TLSServerName, *tlsServerName)
+	overrideBool("tlsInsecure", &config.TLSInsecure, *tlsInsecure)
+	overrideInt("mqttVersion", &config.MqttVersion, *mqttVersion)
+	overrideDuration("mqttSessionExpiry", &config.SessionExpiry, *sessionExpiry)
+	overrideInt("mqttOutboxSize", &config.OutboxSize, *outboxSize)
+	overrideString("mqttOutboxFile", &config.OutboxFile, *outboxFile)
+	overrideString("mqttOutboxHistory", &config.OutboxHistory, *outboxHistory)
+	overrideString("mqttQoS", &config.QoS, *qos)
+	overrideString("mqttRetain", &config.Retain, *retain)
+	overrideString("prefix", &config.Prefix, *prefix)
+	overrideString("hassPrefix", &config.HassPrefix, *hassPrefix)
+	overrideString("homiePrefix", &config.HomiePrefix, *homiePrefix)
+	overrideTemp("minTemp", &config.MinTemp, *minTemp)
+	overrideTemp("maxTemp", &config.MaxTemp, *maxTemp)
+	overrideDuration("pollInterval", &config.PollInterval, *pollInterval)
+	overrideDuration("sysPollInterval", &config.SysPollInterval, *sysPollInterval)
+	overrideDuration("fastPollInterval", &config.FastPollInterval, *fastPollInterval)
+	overrideDuration("fastPollDuration", &config.FastPollDuration, *fastPollDuration)
+	overrideInt("offlineAfter", &config.OfflineAfter, *offlineAfter)
+	overrideString("output", &config.Output, *output)
+	overrideString("httpListen", &config.HTTPListen, *httpListen)
+
+	// additional brokers use the top level values they do not override
+	for _, broker := range config.Brokers {
+		if broker == nil {
+			continue
+		}
+		if broker.ClientID == "" {
+			broker.ClientID = config.ClientID
+		}
+		if broker.MqttVersion == 0 {
+			broker.MqttVersion = config.MqttVersion
+		}
+		if broker.SessionExpiry == 0 {
+			broker.SessionExpiry = config.SessionExpiry
+		}
+		if broker.Prefix == "" {
+			broker.Prefix = config.Prefix
+		}
+		if broker.HassPrefix == "" {
+			broker.HassPrefix = config.HassPrefix
+		}
+		if broker.HomiePrefix == "" {
+			broker.HomiePrefix = config.HomiePrefix
+		}
+	}
+
+	busFlags := []string{"modbusPort", "modbusRate", "modbusDataBits", "modbusParity", "modbusStopBits", "modbusThrottle", "modbusQueueLength", "modbusSlaveIDs", "modbusSlaveNames"}
+	if len(config.Buses) == 0 {
+		config.Buses = []*BusConfig{{}}
+		set["modbusSlaveIDs"] = true
+	} else if len(config.Buses) > 1 {
+		for _, name := range busFlags {
+			if set[name] {
+				return nil, &ConfigError{Key: name, Message: "cannot be used when the configuration file defines several buses"}
+			}
+		}
+	}
+
+	for _, bus := range config.Buses {
+		overrideString("modbusPort", &bus.Port, *modbusPort)
+		overrideInt("modbusRate", &bus.BaudRate, *modbusPortBaudRate)
+		overrideInt("modbusDataBits", &bus.DataBits, *modbusDataBits)
+		overrideString("modbusParity", &bus.Parity, *modbusPortParity)
+		overrideInt("modbusStopBits", &bus.StopBits, *modbusStopBits)
+		overrideDuration("modbusThrottle", &bus.Throttle, *modbusThrottle)
+		overrideInt("modbusQueueLength", &bus.QueueLength, *modbusQueueLength)
+		if bus.Timeout == 0 {
+			bus.Timeout = DEFAULT_MODBUS_TIMEOUT
+		}
+		if set["modbusSlaveIDs"] || set["modbusSlaveNames"] {
+			bus.Slaves, err = parseModbusSlaveInfo(*modbusSlaveList, *modbusSlaveNames)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, slave := range bus.Slaves {
+			if slave.Name == "" {
+				slave.Name = generateNodeName(strconv.Itoa(slave.ID), bus.Port)
+			}
+		}
+	}
+
+	return config, config.validate()
+}
+
+func ParseCommandLine() *Config {
+	fileConfig, err := parseConfig(os.Args[1:], os.Getenv)
 	if err != nil {
-		log.Fatalf("Error initializing modbus: %s", err)
+		log.Fatalf("Invalid configuration: %s", err)
 	}
-	defer mb.Close()
 
-	mqttClient := mqtt.New(&mqtt.Config{
-		Server:   *server,
-		ClientID: *clientid,
-		Username: *username,
-		Password: *password,
+	// koolnova2mqtt's own availability, published as last will if the process dies,
+	// with the policy of the availability class
+	statusTopic := fileConfig.Prefix + "/status"
+	policies, _ := parsePolicies(fileConfig.QoS, fileConfig.Retain)
+	availability := policies[kn.CLASS_AVAILABILITY]
+	mqttClient, err := mqtt.New(&mqtt.Config{
+		Server:         fileConfig.Server,
+		ClientID:       fileConfig.ClientID,
+		Username:       fileConfig.Username,
+		Password:       fileConfig.Password,
+		StatusTopic:    statusTopic,
+		StatusQoS:      availability.QoS,
+		StatusRetained: availability.Retained,
+		CACert:         fileConfig.CACert,
+		ClientCert:     fileConfig.ClientCert,
+		ClientKey:      fileConfig.ClientKey,
+		ServerName:     fileConfig.TLSServerName,
+		Insecure:       fileConfig.TLSInsecure,
+		Version:        fileConfig.MqttVersion,
+		SessionExpiry:  fileConfig.SessionExpiry,
+		OutboxSize:     fileConfig.OutboxSize,
+		OutboxFile:     fileConfig.OutboxFile,
+		OutboxHistory:  splitList(fileConfig.OutboxHistory),
 	})
+	if err != nil {
+		log.Fatalf("Error initializing MQTT: %s", err)
+	}
+
+	// the main broker carries every topic, additional brokers a copy of some topic classes
+	brokers := []*mqtt.Broker{{Client: mqttClient}}
+	for _, brokerConfig := range fileConfig.Brokers {
+		broker := &mqtt.Broker{
+			Prefixes: fileConfig.prefixes(brokerConfig),
+			Classes:  splitList(brokerConfig.Classes),
+			Embedded: []string{kn.CLASS_DISCOVERY},
+		}
+		broker.ReadOnly = !broker.Carries(kn.CLASS_COMMANDS)
+		var brokerStatusTopic string
+		if broker.Carries(kn.CLASS_AVAILABILITY) {
+			brokerStatusTopic = broker.Topic(statusTopic)
+		}
+		var history []string
+		for _, filter := range splitList(fileConfig.OutboxHistory) {
+			history = append(history, broker.Topic(filter))
+		}
+		broker.Client, err = mqtt.New(&mqtt.Config{
+			Server:         brokerConfig.Server,
+			ClientID:       brokerConfig.ClientID,
+			Username:       brokerConfig.Username,
+			Password:       brokerConfig.Password,
+			StatusTopic:    brokerStatusTopic,
+			StatusQoS:      availability.QoS,
+			StatusRetained: availability.Retained,
+			CACert:         brokerConfig.CACert,
+			ClientCert:     brokerConfig.ClientCert,
+			ClientKey:      brokerConfig.ClientKey,
+			ServerName:     brokerConfig.TLSServerName,
+			Insecure:       brokerConfig.TLSInsecure,
+			Version:        brokerConfig.MqttVersion,
+			SessionExpiry:  brokerConfig.SessionExpiry,
+			OutboxSize:     brokerConfig.OutboxSize,
+			OutboxFile:     brokerConfig.OutboxFile,
+			OutboxHistory:  history,
+		})
+		if err != nil {
+			log.Fatalf("Error initializing MQTT %s: %s", brokerConfig.Server, err)
+		}
+		brokers = append(brokers, broker)
+	}
 
-	return &Config{
-		slaves:     slaves,
-		MqttClient: mqttClient,
-		BridgeTemplateConfig: &kn.Config{
-			Mqtt:        mqttClient,
-			Modbus:      mb,
-			TopicPrefix: *prefix,
-			HassPrefix:  *hassPrefix,
-		},
+	config := &Config{
+		MqttClient: mqtt.NewFanOut(brokers...),
+		HTTPListen: fileConfig.HTTPListen,
+	}
+	bridgeID := generateBridgeID()
+
+	for _, bus := range fileConfig.Buses {
+		mb, err := modbus.New(&modbus.Config{
+			Endpoint: bus.Port,
+			BaudRate: bus.BaudRate,
+			DataBits: bus.DataBits,
+			Parity:   bus.Parity,
+			StopBits: bus.StopBits,
+			Timeout:  bus.Timeout,
+			Throttle: bus.Throttle,
+		})
+		if err != nil {
+			log.Fatalf("Error initializing modbus %s: %s", bus.Port, err)
+		}
+		config.Buses = append(config.Buses, mb)
+		// all slaves of the bus share its queue, so writes go first and bursts are merged
+		queue := modbus.NewQueue(&modbus.QueueConfig{
+			Device:    mb,
+			MaxLength: bus.QueueLength,
+			Stats:     &mb.Stats,
+		})
+		for _, slave := range bus.Slaves {
+			bridgeConfig := fileConfig.bridgeConfig(slave, config.MqttClient, queue)
+			bridgeConfig.BridgeID = bridgeID
+			bridgeConfig.Version = version
+			bridgeConfig.StatusTopic = statusTopic
+			bridgeConfig.Stats = kn.NewStats()
+			config.Bridges = append(config.Bridges, bridgeConfig)
+		}
 	}
 
+	return config
 }
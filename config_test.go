@@ -0,0 +1,201 @@
+package main
+
+import (
+	"koolnova2mqtt/kn"
+	"koolnova2mqtt/mqtt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestEnvName(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	// every flag can be replaced by an environment variable
+	var names []string
+	_, err := parseConfig(nil, func(name string) string {
+		names = append(names, name)
+		return ""
+	})
+	t.Ok(err)
+	expected := map[string]string{
+		"config":            "KOOLNOVA2MQTT_CONFIG",
+		"server":            "KOOLNOVA2MQTT_SERVER",
+		"clientid":          "KOOLNOVA2MQTT_CLIENTID",
+		"username":          "KOOLNOVA2MQTT_USERNAME",
+		"password":          "KOOLNOVA2MQTT_PASSWORD",
+		"caCert":            "KOOLNOVA2MQTT_CA_CERT",
+		"clientCert":        "KOOLNOVA2MQTT_CLIENT_CERT",
+		"clientKey":         "KOOLNOVA2MQTT_CLIENT_KEY",
+		"tlsServerName":     "KOOLNOVA2MQTT_TLS_SERVER_NAME",
+		"tlsInsecure":       "KOOLNOVA2MQTT_TLS_INSECURE",
+		"mqttVersion":       "KOOLNOVA2MQTT_MQTT_VERSION",
+		"mqttSessionExpiry": "KOOLNOVA2MQTT_MQTT_SESSION_EXPIRY",
+		"mqttOutboxSize":    "KOOLNOVA2MQTT_MQTT_OUTBOX_SIZE",
+		"mqttOutboxFile":    "KOOLNOVA2MQTT_MQTT_OUTBOX_FILE",
+		"mqttOutboxHistory": "KOOLNOVA2MQTT_MQTT_OUTBOX_HISTORY",
+		"mqttQoS":           "KOOLNOVA2MQTT_MQTT_QOS",
+		"mqttRetain":        "KOOLNOVA2MQTT_MQTT_RETAIN",
+		"prefix":            "KOOLNOVA2MQTT_PREFIX",
+		"hassPrefix":        "KOOLNOVA2MQTT_HASS_PREFIX",
+		"homiePrefix":       "KOOLNOVA2MQTT_HOMIE_PREFIX",
+		"minTemp":           "KOOLNOVA2MQTT_MIN_TEMP",
+		"maxTemp":           "KOOLNOVA2MQTT_MAX_TEMP",
+		"pollInterval":      "KOOLNOVA2MQTT_POLL_INTERVAL",
+		"sysPollInterval":   "KOOLNOVA2MQTT_SYS_POLL_INTERVAL",
+		"fastPollInterval":  "KOOLNOVA2MQTT_FAST_POLL_INTERVAL",
+		"fastPollDuration":  "KOOLNOVA2MQTT_FAST_POLL_DURATION",
+		"httpListen":        "KOOLNOVA2MQTT_HTTP_LISTEN",
+		"output":            "KOOLNOVA2MQTT_OUTPUT",
+		"offlineAfter":      "KOOLNOVA2MQTT_OFFLINE_AFTER",
+		"modbusPort":        "KOOLNOVA2MQTT_MODBUS_PORT",
+		"modbusRate":        "KOOLNOVA2MQTT_MODBUS_RATE",
+		"modbusDataBits":    "KOOLNOVA2MQTT_MODBUS_DATA_BITS",
+		"modbusParity":      "KOOLNOVA2MQTT_MODBUS_PARITY",
+		"modbusStopBits":    "KOOLNOVA2MQTT_MODBUS_STOP_BITS",
+		"modbusThrottle":    "KOOLNOVA2MQTT_MODBUS_THROTTLE",
+		"modbusQueueLength": "KOOLNOVA2MQTT_MODBUS_QUEUE_LENGTH",
+		"modbusSlaveIDs":    "KOOLNOVA2MQTT_MODBUS_SLAVE_IDS",
+		"modbusSlaveNames":  "KOOLNOVA2MQTT_MODBUS_SLAVE_NAMES",
+	}
+	t.Equals(len(expected), len(names))
+	for flagName, name := range expected {
+		t.Equals(name, envName(flagName))
+	}
+	sort.Strings(names)
+	var values []string
+	for _, name := range expected {
+		values = append(values, name)
+	}
+	sort.Strings(values)
+	t.Equals(values, names)
+}
+
+func TestConfigFile(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	env := map[string]string{}
+	getenv := func(name string) string {
+		return env[name]
+	}
+	file := filepath.Join(t.TestdataDir, "koolnova.yaml")
+
+	config, err := parseConfig([]string{"--config", file, "--hassPrefix", "ha"}, getenv)
+	t.Ok(err)
+	t.EqualsFile("config.json", config)
+
+	// slaves override the polling and output settings of the top level
+	bridge := config.bridgeConfig(config.Buses[0].Slaves[1], nil, nil)
+	t.Equals(10*time.Second, bridge.PollInterval)
+	t.Equals(time.Minute, bridge.SysPollInterval)
+	t.Equals(500*time.Millisecond, bridge.FastPollInterval)
+	t.Equals("topics,json,homie", bridge.Output)
+	t.Equals(kn.DEFAULT_HOMIE_PREFIX, bridge.HomiePrefix)
+	t.Equals(kn.OUTPUT_TOPICS, config.bridgeConfig(config.Buses[0].Slaves[0], nil, nil).Output)
+	t.Equals(kn.Policy{QoS: 1, Retained: false}, bridge.Policies[kn.CLASS_COMMANDS])
+	t.Equals(kn.Policy{QoS: 0, Retained: false}, bridge.Policies[kn.CLASS_TELEMETRY])
+	t.Equals(kn.DefaultPolicies[kn.CLASS_STATE], bridge.Policies[kn.CLASS_STATE])
+
+	// additional brokers replace the prefixes and use the top level values they do not override
+	broker := &mqtt.Broker{Prefixes: config.prefixes(config.Brokers[0])}
+	t.Equals("koolnova", config.Brokers[0].ClientID)
+	t.Equals(mqtt.VERSION_5, config.Brokers[0].MqttVersion)
+	t.Equals("site1/koolnova/firstFloor/zone1/currentTemp", broker.Topic("home/firstFloor/zone1/currentTemp"))
+	t.Equals("ha/climate/firstFloor/zone1/config", broker.Topic("ha/climate/firstFloor/zone1/config"))
+	t.Equals("site1/koolnova/upstairs/secondFloor/zone1/currentTemp", broker.Topic("home/upstairs/secondFloor/zone1/currentTemp"))
+
+	// slaves can only have a prefix of their own under the prefix that brokers replace
+	config.Buses[0].Slaves[1].Prefix = "upstairs"
+	t.Equals(&ConfigError{Key: "buses[0].slaves[1].prefix", Message: `must be under "home", which brokers[0] replaces with "site1/koolnova"`}, config.validate())
+	config.Buses[0].Slaves[1].Prefix = "home/upstairs"
+
+	// prefixes that are the same at the top level must be replaced by the same prefix
+	homiePrefix := config.Brokers[0].HomiePrefix
+	config.HomiePrefix = config.HassPrefix
+	config.Brokers[0].HomiePrefix = "site1/homie"
+	t.Equals(&ConfigError{Key: "brokers[0].homiePrefix", Message: `must be "ha", which replaces the same top level prefix "ha"`}, config.validate())
+	config.Brokers[0].HomiePrefix = config.HassPrefix
+	t.Ok(config.validate())
+	config.HomiePrefix = homiePrefix
+	config.Brokers[0].HomiePrefix = homiePrefix
+	config.Brokers[0].Classes = "telemetry,sensors"
+	t.Equals(&ConfigError{Key: "brokers[0].classes", Message: `unknown class "sensors", must be among discovery, state, telemetry, commands, availability`}, config.validate())
+	config.Brokers[0].Classes = ""
+	config.Brokers[0].Server = ""
+	t.Equals(&ConfigError{Key: "brokers[0].server", Message: "is required"}, config.validate())
+
+	config.Brokers[0].Server = "ssl://cloud.example.com:8883"
+
+	// a slug may not take the default topic of another zone
+	zones := config.Buses[0].Slaves[0].Zones
+	zones[2].Slug = "zone1"
+	t.Equals(&ConfigError{Key: "buses[0].slaves[0].zones.2.slug", Message: `slug "zone1" is the default topic of zone 1`}, config.validate())
+	zones[2].Slug = "zone2"
+	t.Ok(config.validate())
+
+	// with the homie output, slugs must also differ once converted to Homie node IDs
+	config.Buses[0].Slaves[1].Zones = map[int]*ZoneFileConfig{1: {Slug: "zone_1"}, 2: {Slug: "zone-1"}}
+	t.Equals(&ConfigError{Key: "buses[0].slaves[1].zones.2.slug", Message: `slug "zone-1" clashes with another Homie node as "zone-1"`}, config.validate())
+	config.Buses[0].Slaves[1].Zones = map[int]*ZoneFileConfig{3: {Slug: "ac1"}}
+	t.Equals(&ConfigError{Key: "buses[0].slaves[1].zones.3.slug", Message: `slug "ac1" clashes with another Homie node as "ac1"`}, config.validate())
+	config.Buses[0].Slaves[1].Zones = map[int]*ZoneFileConfig{3: {Slug: "Zone1"}}
+	t.Equals(&ConfigError{Key: "buses[0].slaves[1].zones.3.slug", Message: `slug "Zone1" clashes with another Homie node as "zone1"`}, config.validate())
+	config.Buses[0].Slaves[0].Zones[1].Slug = "ac1"
+	config.Buses[0].Slaves[1].Zones = nil
+	t.Ok(config.validate())
+
+	// environment variables override the file, flags override both
+	env["KOOLNOVA2MQTT_SERVER"] = "tcp://broker:1883"
+	env["KOOLNOVA2MQTT_MAX_TEMP"] = "32"
+	config, err = parseConfig([]string{"--config", file, "--maxTemp", "31"}, getenv)
+	t.Ok(err)
+	t.Equals("tcp://broker:1883", config.Server)
+	t.Equals(float32(31), config.MaxTemp)
+	t.Equals(float32(16), config.MinTemp)
+	t.Equals(2*time.Second, config.PollInterval)
+
+	_, err = parseConfig([]string{"--config", file, "--modbusPort", "/dev/ttyUSB1"}, getenv)
+	t.Equals(&ConfigError{Key: "modbusPort", Message: "cannot be used when the configuration file defines several buses"}, err)
+
+	_, err = parseConfig([]string{"--config", file, "--clientCert", "client.pem"}, getenv)
+	t.Equals(&ConfigError{Key: "clientKey", Message: "is required with clientCert"}, err)
+
+	_, err = parseConfig([]string{"--config", file, "--mqttVersion", "4"}, getenv)
+	t.Equals(&ConfigError{Key: "mqttVersion", Message: "unsupported MQTT version 4, must be 3 or 5"}, err)
+
+	_, err = parseConfig([]string{"--config", file, "--mqttOutboxSize", "-1"}, getenv)
+	t.Equals(&ConfigError{Key: "mqttOutboxSize", Message: "must not be negative"}, err)
+	t.Equals([]string{"a/+/temp", "b/#"}, splitList("a/+/temp, b/#,"))
+
+	_, err = parseConfig([]string{"--config", file, "--mqttQoS", "commands=3"}, getenv)
+	t.Equals(&ConfigError{Key: "mqttQoS", Message: `invalid QoS "3", must be 0, 1 or 2`}, err)
+	_, err = parseConfig([]string{"--config", file, "--mqttRetain", "sensors=false"}, getenv)
+	t.Equals(&ConfigError{Key: "mqttRetain", Message: `invalid policy "sensors=false", expected class=value with a class among discovery, state, telemetry, commands, availability`}, err)
+
+	_, err = parseConfig([]string{"--config", file, "--output", "topics,xml"}, getenv)
+	t.Equals(&ConfigError{Key: "output", Message: `unknown output "xml"`}, err)
+
+	_, err = parseConfig([]string{"--config", filepath.Join(t.TestdataDir, "invalid.yaml")}, getenv)
+	t.Equals(&ConfigError{Key: "buses[0].slaves[0].zones.17", Message: "zone number out of range 1-16"}, err)
+
+	_, err = parseConfig([]string{"--config", filepath.Join(t.TestdataDir, "unknown-key.yaml")}, getenv)
+	t.MustFail(err, "expected unknown keys to fail")
+	t.Assert(strings.Contains(err.Error(), "field slave not found"), "unexpected error %s", err)
+
+	// without a configuration file, flags describe a single bus
+	config, err = parseConfig([]string{"--modbusSlaveIDs", "49,50", "--modbusSlaveNames", "a,b"}, getenv)
+	t.Ok(err)
+	t.Equals(1, len(config.Buses))
+	t.Equals("/dev/ttyUSB0", config.Buses[0].Port)
+	t.Equals(50, config.Buses[0].Slaves[1].ID)
+	t.Equals("b", config.Buses[0].Slaves[1].Name)
+
+	_, err = parseConfig([]string{"--modbusSlaveIDs", "49,x"}, getenv)
+	t.Equals(&ConfigError{Key: "modbusSlaveIDs", Message: `invalid slave ID "x"`}, err)
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"fmt"
+	"koolnova2mqtt/kn"
+	"koolnova2mqtt/modbus"
+	"koolnova2mqtt/mqtt"
+	"koolnova2mqtt/watcher"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const DEFAULT_MODBUS_TIMEOUT = 200 * time.Millisecond
+
+// FileConfig is the structure of the YAML configuration file. Keys are named
+// after the equivalent command line flags.
+type FileConfig struct {
+	Server           string          `yaml:"server"`
+	ClientID         string          `yaml:"clientid"`
+	Username         string          `yaml:"username"`
+	Password         string          `yaml:"password"`
+	CACert           string          `yaml:"caCert"`
+	ClientCert       string          `yaml:"clientCert"`
+	ClientKey        string          `yaml:"clientKey"`
+	TLSServerName    string          `yaml:"tlsServerName"`
+	TLSInsecure      bool            `yaml:"tlsInsecure"`
+	MqttVersion      int             `yaml:"mqttVersion"`
+	SessionExpiry    time.Duration   `yaml:"mqttSessionExpiry"`
+	OutboxSize       int             `yaml:"mqttOutboxSize"`
+	OutboxFile       string          `yaml:"mqttOutboxFile"`
+	OutboxHistory    string          `yaml:"mqttOutboxHistory"`
+	QoS              string          `yaml:"mqttQoS"`
+	Retain           string          `yaml:"mqttRetain"`
+	Prefix           string          `yaml:"prefix"`
+	HassPrefix       string          `yaml:"hassPrefix"`
+	HomiePrefix      string          `yaml:"homiePrefix"`
+	MinTemp          float32         `yaml:"minTemp"`
+	MaxTemp          float32         `yaml:"maxTemp"`
+	PollInterval     time.Duration   `yaml:"pollInterval"`
+	SysPollInterval  time.Duration   `yaml:"sysPollInterval"`
+	FastPollInterval time.Duration   `yaml:"fastPollInterval"`
+	FastPollDuration time.Duration   `yaml:"fastPollDuration"`
+	OfflineAfter     int             `yaml:"offlineAfter"`
+	Output           string          `yaml:"output"`
+	HTTPListen       string          `yaml:"httpListen"`
+	Brokers          []*BrokerConfig `yaml:"brokers"`
+	Buses            []*BusConfig    `yaml:"buses"`
+}
+
+// BrokerConfig describes an additional MQTT broker, which receives a copy of the messages
+// of some topic classes, with its own prefixes. Empty client ID, MQTT version, session
+// expiry and prefixes are taken from the top level of the configuration.
+type BrokerConfig struct {
+	Server        string        `yaml:"server"`
+	ClientID      string        `yaml:"clientid"`
+	Username      string        `yaml:"username"`
+	Password      string        `yaml:"password"`
+	CACert        string        `yaml:"caCert"`
+	ClientCert    string        `yaml:"clientCert"`
+	ClientKey     string        `yaml:"clientKey"`
+	TLSServerName string        `yaml:"tlsServerName"`
+	TLSInsecure   bool          `yaml:"tlsInsecure"`
+	MqttVersion   int           `yaml:"mqttVersion"`
+	SessionExpiry time.Duration `yaml:"mqttSessionExpiry"`
+	OutboxSize    int           `yaml:"mqttOutboxSize"`
+	OutboxFile    string        `yaml:"mqttOutboxFile"`
+	Prefix        string        `yaml:"prefix"`
+	HassPrefix    string        `yaml:"hassPrefix"`
+	HomiePrefix   string        `yaml:"homiePrefix"`
+	Classes       string        `yaml:"classes"` // comma-separated topic classes published to the broker. All if empty
+}
+
+// BusConfig describes a modbus bus and the slaves connected to it
+type BusConfig struct {
+	Port        string         `yaml:"port"`
+	BaudRate    int            `yaml:"rate"`
+	DataBits    int            `yaml:"dataBits"`
+	Parity      string         `yaml:"parity"`
+	StopBits    int            `yaml:"stopBits"`
+	Timeout     time.Duration  `yaml:"timeout"`
+	Throttle    time.Duration  `yaml:"throttle"`
+	QueueLength int            `yaml:"queueLength"`
+	Slaves      []*SlaveConfig `yaml:"slaves"`
+}
+
+// SlaveConfig describes a Koolnova module. Empty values are taken from
+// the top level of the configuration
+type SlaveConfig struct {
+	ID               int                     `yaml:"id"`
+	Name             string                  `yaml:"name"`
+	Prefix           string                  `yaml:"prefix"`
+	MinTemp          float32                 `yaml:"minTemp"`
+	MaxTemp          float32                 `yaml:"maxTemp"`
+	PollInterval     time.Duration           `yaml:"pollInterval"`
+	SysPollInterval  time.Duration           `yaml:"sysPollInterval"`
+	FastPollInterval time.Duration           `yaml:"fastPollInterval"`
+	FastPollDuration time.Duration           `yaml:"fastPollDuration"`
+	Output           string                  `yaml:"output"`
+	Zones            map[int]*ZoneFileConfig `yaml:"zones"`
+}
+
+// ZoneFileConfig describes a zone of a module
+type ZoneFileConfig struct {
+	Name string `yaml:"name"`
+	Area string `yaml:"area"`
+	Slug string `yaml:"slug"`
+}
+
+var slugRegexp = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// ConfigError reports the configuration key that has an invalid value
+type ConfigError struct {
+	Key     string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Message)
+}
+
+// loadConfigFile reads and decodes a configuration file. Unknown keys are rejected.
+func loadConfigFile(path string) (*FileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &FileConfig{}
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	err = decoder.Decode(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// reservedSlugs are the topics of a module that zones cannot use
+var reservedSlugs = map[string]bool{"sys": true, "state": true, "status": true, "availability": true}
+
+// validateOutput checks a comma-separated list of output modes
+func validateOutput(key, output string) error {
+	for _, o := range strings.Split(output, ",") {
+		switch strings.TrimSpace(o) {
+		case kn.OUTPUT_TOPICS, kn.OUTPUT_JSON, kn.OUTPUT_HOMIE:
+		case kn.OUTPUT_BOTH:
+			log.Printf("%s: output %q is deprecated, use %q instead\n", key, kn.OUTPUT_BOTH, kn.OUTPUT_TOPICS+","+kn.OUTPUT_JSON)
+		default:
+			return &ConfigError{Key: key, Message: fmt.Sprintf("unknown output %q", o)}
+		}
+	}
+	return nil
+}
+
+// parsePolicies parses the QoS and retain flags of topic classes, given as comma-separated
+// lists such as "commands=1,state=0" and "telemetry=false". Other classes use the defaults.
+func parsePolicies(qos, retain string) (map[string]kn.Policy, error) {
+	policies := make(map[string]kn.Policy)
+	for class, policy := range kn.DefaultPolicies {
+		policies[class] = policy
+	}
+	parse := func(key, list string, set func(policy *kn.Policy, value string) error) error {
+		for _, item := range splitList(list) {
+			parts := strings.SplitN(item, "=", 2)
+			class := strings.TrimSpace(parts[0])
+			policy, ok := policies[class]
+			if !ok || len(parts) != 2 {
+				return &ConfigError{Key: key, Message: fmt.Sprintf("invalid policy %q, expected class=value with a class among %s", item, strings.Join(kn.Classes, ", "))}
+			}
+			if err := set(&policy, strings.TrimSpace(parts[1])); err != nil {
+				return &ConfigError{Key: key, Message: err.Error()}
+			}
+			policies[class] = policy
+		}
+		return nil
+	}
+	err := parse("mqttQoS", qos, func(policy *kn.Policy, value string) error {
+		q, err := strconv.Atoi(value)
+		if err != nil || q < 0 || q > 2 {
+			return fmt.Errorf("invalid QoS %q, must be 0, 1 or 2", value)
+		}
+		policy.QoS = byte(q)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = parse("mqttRetain", retain, func(policy *kn.Policy, value string) error {
+		r, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid retain flag %q, must be true or false", value)
+		}
+		policy.Retained = r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// validate checks the configuration after defaults have been applied
+func (c *FileConfig) validate() error {
+	if c.MinTemp >= c.MaxTemp {
+		return &ConfigError{Key: "maxTemp", Message: "must be greater than minTemp"}
+	}
+	if c.PollInterval <= 0 {
+		return &ConfigError{Key: "pollInterval", Message: "must be positive"}
+	}
+	for key, interval := range map[string]time.Duration{
+		"sysPollInterval":  c.SysPollInterval,
+		"fastPollInterval": c.FastPollInterval,
+		"fastPollDuration": c.FastPollDuration,
+	} {
+		if interval < 0 {
+			return &ConfigError{Key: key, Message: "must be positive"}
+		}
+	}
+	if c.ClientCert != "" && c.ClientKey == "" {
+		return &ConfigError{Key: "clientKey", Message: "is required with clientCert"}
+	}
+	if c.ClientKey != "" && c.ClientCert == "" {
+		return &ConfigError{Key: "clientCert", Message: "is required with clientKey"}
+	}
+	if c.MqttVersion != mqtt.VERSION_311 && c.MqttVersion != mqtt.VERSION_5 {
+		return &ConfigError{Key: "mqttVersion", Message: fmt.Sprintf("unsupported MQTT version %d, must be 3 or 5", c.MqttVersion)}
+	}
+	if c.SessionExpiry <= 0 {
+		return &ConfigError{Key: "mqttSessionExpiry", Message: "must be positive"}
+	}
+	if c.OutboxSize < 0 {
+		return &ConfigError{Key: "mqttOutboxSize", Message: "must not be negative"}
+	}
+	if _, err := parsePolicies(c.QoS, c.Retain); err != nil {
+		return err
+	}
+	outboxFiles := map[string]bool{c.OutboxFile: true}
+	for i, broker := range c.Brokers {
+		key := fmt.Sprintf("brokers[%d]", i)
+		if broker == nil {
+			return &ConfigError{Key: key, Message: "empty broker"}
+		}
+		if broker.Server == "" {
+			return &ConfigError{Key: key + ".server", Message: "is required"}
+		}
+		if broker.ClientCert != "" && broker.ClientKey == "" {
+			return &ConfigError{Key: key + ".clientKey", Message: "is required with clientCert"}
+		}
+		if broker.ClientKey != "" && broker.ClientCert == "" {
+			return &ConfigError{Key: key + ".clientCert", Message: "is required with clientKey"}
+		}
+		if broker.MqttVersion != mqtt.VERSION_311 && broker.MqttVersion != mqtt.VERSION_5 {
+			return &ConfigError{Key: key + ".mqttVersion", Message: fmt.Sprintf("unsupported MQTT version %d, must be 3 or 5", broker.MqttVersion)}
+		}
+		if broker.SessionExpiry <= 0 {
+			return &ConfigError{Key: key + ".mqttSessionExpiry", Message: "must be positive"}
+		}
+		if broker.OutboxSize < 0 {
+			return &ConfigError{Key: key + ".mqttOutboxSize", Message: "must not be negative"}
+		}
+		if broker.OutboxFile != "" {
+			if outboxFiles[broker.OutboxFile] {
+				return &ConfigError{Key: key + ".mqttOutboxFile", Message: fmt.Sprintf("outbox file %s is already in use", broker.OutboxFile)}
+			}
+			outboxFiles[broker.OutboxFile] = true
+		}
+		for _, class := range splitList(broker.Classes) {
+			if _, ok := kn.DefaultPolicies[class]; !ok {
+				return &ConfigError{Key: key + ".classes", Message: fmt.Sprintf("unknown class %q, must be among %s", class, strings.Join(kn.Classes, ", "))}
+			}
+		}
+		// top level prefixes that are the same must be replaced by the same prefix
+		replacements := make(map[string]string)
+		for _, p := range []struct{ key, prefix, replacement string }{
+			{"prefix", c.Prefix, broker.Prefix},
+			{"hassPrefix", c.HassPrefix, broker.HassPrefix},
+			{"homiePrefix", c.HomiePrefix, broker.HomiePrefix},
+		} {
+			if other, ok := replacements[p.prefix]; ok && other != p.replacement {
+				return &ConfigError{Key: key + "." + p.key, Message: fmt.Sprintf("must be %q, which replaces the same top level prefix %q", other, p.prefix)}
+			}
+			replacements[p.prefix] = p.replacement
+		}
+	}
+	if c.OfflineAfter <= 0 {
+		return &ConfigError{Key: "offlineAfter", Message: "must be positive"}
+	}
+	if err := validateOutput("output", c.Output); err != nil {
+		return err
+	}
+	if len(c.Buses) == 0 {
+		return &ConfigError{Key: "buses", Message: "at least one bus is required"}
+	}
+
+	modules := make(map[string]string)
+	for i, bus := range c.Buses {
+		key := fmt.Sprintf("buses[%d]", i)
+		if bus == nil {
+			return &ConfigError{Key: key, Message: "empty bus"}
+		}
+		if _, err := modbus.ParseEndpoint(bus.Port); err != nil {
+			return &ConfigError{Key: key + ".port", Message: err.Error()}
+		}
+		switch bus.Parity {
+		case "N", "E", "O":
+		default:
+			return &ConfigError{Key: key + ".parity", Message: fmt.Sprintf("unknown parity %q", bus.Parity)}
+		}
+		if bus.Timeout <= 0 {
+			return &ConfigError{Key: key + ".timeout", Message: "must be positive"}
+		}
+		if bus.Throttle < 0 {
+			return &ConfigError{Key: key + ".throttle", Message: "must be positive"}
+		}
+		if bus.QueueLength <= 0 {
+			return &ConfigError{Key: key + ".queueLength", Message: "must be positive"}
+		}
+		if len(bus.Slaves) == 0 {
+			return &ConfigError{Key: key + ".slaves", Message: "at least one slave is required"}
+		}
+
+		ids := make(map[int]bool)
+		for j, slave := range bus.Slaves {
+			key := fmt.Sprintf("%s.slaves[%d]", key, j)
+			if slave == nil {
+				return &ConfigError{Key: key, Message: "empty slave"}
+			}
+			if slave.ID < 1 || slave.ID > 247 {
+				return &ConfigError{Key: key + ".id", Message: fmt.Sprintf("slave ID %d out of range 1-247", slave.ID)}
+			}
+			if ids[slave.ID] {
+				return &ConfigError{Key: key + ".id", Message: fmt.Sprintf("duplicate slave ID %d", slave.ID)}
+			}
+			ids[slave.ID] = true
+
+			prefix := c.Prefix
+			if slave.Prefix != "" {
+				prefix = slave.Prefix
+				if err := c.validateSlavePrefix(slave.Prefix); err != nil {
+					return &ConfigError{Key: key + ".prefix", Message: err.Error()}
+				}
+			}
+			module := prefix + "/" + slave.Name
+			if other, ok := modules[module]; ok {
+				return &ConfigError{Key: key + ".name", Message: fmt.Sprintf("name %q already used by %s", slave.Name, other)}
+			}
+			modules[module] = key
+
+			minTemp, maxTemp := c.MinTemp, c.MaxTemp
+			if slave.MinTemp != 0 {
+				minTemp = slave.MinTemp
+			}
+			if slave.MaxTemp != 0 {
+				maxTemp = slave.MaxTemp
+			}
+			if minTemp >= maxTemp {
+				return &ConfigError{Key: key + ".maxTemp", Message: "must be greater than minTemp"}
+			}
+			for name, interval := range map[string]time.Duration{
+				"pollInterval":     slave.PollInterval,
+				"sysPollInterval":  slave.SysPollInterval,
+				"fastPollInterval": slave.FastPollInterval,
+				"fastPollDuration": slave.FastPollDuration,
+			} {
+				if interval < 0 {
+					return &ConfigError{Key: key + "." + name, Message: "must be positive"}
+				}
+			}
+			if slave.Output != "" {
+				if err := validateOutput(key+".output", slave.Output); err != nil {
+					return err
+				}
+			}
+			slugs := make(map[string]bool)
+			for n, zone := range slave.Zones {
+				key := fmt.Sprintf("%s.zones.%d", key, n)
+				if n < 1 || n > kn.NUM_ZONES {
+					return &ConfigError{Key: key, Message: fmt.Sprintf("zone number out of range 1-%d", kn.NUM_ZONES)}
+				}
+				if zone == nil || zone.Slug == "" {
+					continue
+				}
+				if !slugRegexp.MatchString(zone.Slug) {
+					return &ConfigError{Key: key + ".slug", Message: "may only contain letters, digits, '-' and '_'"}
+				}
+				if reservedSlugs[zone.Slug] || slugs[zone.Slug] {
+					return &ConfigError{Key: key + ".slug", Message: fmt.Sprintf("slug %q is already in use", zone.Slug)}
+				}
+				// zone<N> is the default topic of zone N, which may not be configured here
+				for m := 1; m <= kn.NUM_ZONES; m++ {
+					if m != n && zone.Slug == fmt.Sprintf("zone%d", m) {
+						return &ConfigError{Key: key + ".slug", Message: fmt.Sprintf("slug %q is the default topic of zone %d", zone.Slug, m)}
+					}
+				}
+				slugs[zone.Slug] = true
+			}
+			output := c.Output
+			if slave.Output != "" {
+				output = slave.Output
+			}
+			if hasOutput(output, kn.OUTPUT_HOMIE) {
+				if err := validateHomieNodes(key, slave.Zones); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hasOutput returns whether a comma-separated list of output modes includes output
+func hasOutput(list, output string) bool {
+	for _, o := range strings.Split(list, ",") {
+		if strings.TrimSpace(o) == output {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHomieNodes checks that the zones of a module get Homie node IDs of their own.
+// Node IDs only keep lowercase letters, digits and hyphens, so different slugs such as
+// "zone_1" and "zone-1" may clash with each other or with the nodes that are not zones.
+func validateHomieNodes(key string, zones map[int]*ZoneFileConfig) error {
+	nodes := make(map[string]bool)
+	for _, id := range kn.HomieSystemNodes() {
+		nodes[id] = true
+	}
+	var slugs []int
+	for n := 1; n <= kn.NUM_ZONES; n++ {
+		if zone := zones[n]; zone != nil && zone.Slug != "" {
+			slugs = append(slugs, n)
+		} else {
+			nodes[kn.HomieID(fmt.Sprintf("zone%d", n))] = true
+		}
+	}
+	for _, n := range slugs {
+		slug := zones[n].Slug
+		id := kn.HomieID(slug)
+		if id == "" {
+			return &ConfigError{Key: fmt.Sprintf("%s.zones.%d.slug", key, n), Message: fmt.Sprintf("slug %q needs a letter or digit to be a Homie node ID", slug)}
+		}
+		if nodes[id] {
+			return &ConfigError{Key: fmt.Sprintf("%s.zones.%d.slug", key, n), Message: fmt.Sprintf("slug %q clashes with another Homie node as %q", slug, id)}
+		}
+		nodes[id] = true
+	}
+	return nil
+}
+
+// validateSlavePrefix checks that the additional brokers can replace the prefix of a slave.
+// A broker only replaces the top level prefix, so slaves with a prefix of their own must
+// publish under it when a broker replaces it.
+func (c *FileConfig) validateSlavePrefix(prefix string) error {
+	if prefix == c.Prefix || strings.HasPrefix(prefix, c.Prefix+"/") {
+		return nil
+	}
+	for i, broker := range c.Brokers {
+		if broker.Prefix != c.Prefix {
+			return fmt.Errorf("must be under %q, which brokers[%d] replaces with %q", c.Prefix, i, broker.Prefix)
+		}
+	}
+	return nil
+}
+
+// prefixes returns the topic prefixes that an additional broker replaces
+func (c *FileConfig) prefixes(broker *BrokerConfig) map[string]string {
+	return map[string]string{
+		c.Prefix:      broker.Prefix,
+		c.HassPrefix:  broker.HassPrefix,
+		c.HomiePrefix: broker.HomiePrefix,
+	}
+}
+
+// bridgeConfig builds the configuration of the bridge for a slave, falling
+// back to the top level values for settings the slave does not override
+func (c *FileConfig) bridgeConfig(slave *SlaveConfig, mqttClient kn.MqttClient, mb watcher.Modbus) *kn.Config {
+	config := &kn.Config{
+		ModuleName:       slave.Name,
+		SlaveID:          byte(slave.ID),
+		TopicPrefix:      c.Prefix,
+		HassPrefix:       c.HassPrefix,
+		HomiePrefix:      c.HomiePrefix,
+		MinTemp:          c.MinTemp,
+		MaxTemp:          c.MaxTemp,
+		PollInterval:     c.PollInterval,
+		SysPollInterval:  c.SysPollInterval,
+		FastPollInterval: c.FastPollInterval,
+		FastPollDuration: c.FastPollDuration,
+		MaxFailures:      c.OfflineAfter,
+		Output:           c.Output,
+		Zones:            make(map[int]kn.ZoneInfo),
+		Mqtt:             mqttClient,
+		Modbus:           mb,
+	}
+	if slave.Prefix != "" {
+		config.TopicPrefix = slave.Prefix
+	}
+	if slave.MinTemp != 0 {
+		config.MinTemp = slave.MinTemp
+	}
+	if slave.MaxTemp != 0 {
+		config.MaxTemp = slave.MaxTemp
+	}
+	if slave.PollInterval != 0 {
+		config.PollInterval = slave.PollInterval
+	}
+	if slave.SysPollInterval != 0 {
+		config.SysPollInterval = slave.SysPollInterval
+	}
+	if slave.FastPollInterval != 0 {
+		config.FastPollInterval = slave.FastPollInterval
+	}
+	if slave.FastPollDuration != 0 {
+		config.FastPollDuration = slave.FastPollDuration
+	}
+	if slave.Output != "" {
+		config.Output = slave.Output
+	}
+	// validated by validate
+	config.Policies, _ = parsePolicies(c.QoS, c.Retain)
+	for n, zone := range slave.Zones {
+		if zone != nil {
+			config.Zones[n] = kn.ZoneInfo{
+				Name: zone.Name,
+				Area: zone.Area,
+				Slug: zone.Slug,
+			}
+		}
+	}
+	return config
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// webFiles contains the dashboard, a static page that reads and changes the
+// state of the modules through the HTTP API
+//
+//go:embed web
+var webFiles embed.FS
+
+// dashboardHandler serves the dashboard
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"koolnova2mqtt/kn"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// EVENT_BUFFER is the number of changes queued for each client. Changes are
+// dropped for clients that fall further behind.
+const EVENT_BUFFER = 256
+
+// changeStream forwards the changes of all bridges to HTTP clients as
+// Server-Sent Events, one JSON kn.Change per event
+type changeStream struct {
+	clients map[chan *event]bool
+	lock    sync.Mutex
+}
+
+func newChangeStream() *changeStream {
+	return &changeStream{
+		clients: make(map[chan *event]bool),
+	}
+}
+
+// event is an encoded change
+type event struct {
+	module string
+	data   []byte
+}
+
+// publish sends a change to all connected clients without blocking
+func (s *changeStream) publish(change *kn.Change) {
+	data, err := json.Marshal(change)
+	if err != nil {
+		log.Printf("Error encoding change: %s\n", err)
+		return
+	}
+	e := &event{module: change.Module, data: data}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for client := range s.clients {
+		select {
+		case client <- e:
+		default:
+		}
+	}
+}
+
+func (s *changeStream) subscribe() chan *event {
+	client := make(chan *event, EVENT_BUFFER)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.clients[client] = true
+	return client
+}
+
+func (s *changeStream) unsubscribe(client chan *event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.clients, client)
+}
+
+func (s *changeStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	module := r.URL.Query().Get("module")
+
+	client := s.subscribe()
+	defer s.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-client:
+			if module != "" && e.module != module {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: change\ndata: %s\n\n", e.data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"koolnova2mqtt/kn"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestChangeStream(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	changes := newChangeStream()
+	server := httptest.NewServer(changes)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "?module=first")
+	t.Ok(err)
+	defer res.Body.Close()
+	t.Equals("text/event-stream", res.Header.Get("Content-Type"))
+
+	// the client is subscribed before the response headers are sent
+	timestamp := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	changes.publish(&kn.Change{Module: "second", Zone: 1, Attribute: "targetTemp", Old: 20, New: 21, Time: timestamp})
+	changes.publish(&kn.Change{Module: "first", Attribute: "holdMode", Old: nil, New: "fan", Time: timestamp})
+
+	reader := bufio.NewReader(res.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		t.Ok(err)
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	t.Equals([]string{
+		"event: change",
+		`data: {"module":"first","attribute":"holdMode","old":null,"new":"fan","timestamp":"2021-01-02T03:04:05Z"}`,
+		"",
+	}, lines)
+}
@@ -1,12 +1,14 @@
 module koolnova2mqtt
 
-go 1.14
+go 1.16
 
 require (
 	github.com/RobinUS2/golang-moving-average v1.0.0
+	github.com/eclipse/paho.golang v0.11.0
 	github.com/eclipse/paho.mqtt.golang v1.3.0
 	github.com/epiclabs-io/diff3 v0.0.0-20181217103619-05282cece609 // indirect
 	github.com/epiclabs-io/ut v0.0.0-20201221095005-a2a4f565f0d0
-	github.com/goburrow/serial v0.1.0 // indirect
+	github.com/goburrow/serial v0.1.0
 	github.com/wz2b/modbus v0.1.1
+	gopkg.in/yaml.v3 v3.0.1
 )
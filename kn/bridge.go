@@ -2,10 +2,15 @@ package kn
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"koolnova2mqtt/metrics"
 	"koolnova2mqtt/watcher"
 	"log"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // MqttClient defines the expected MQTT client pub sub interface
@@ -14,23 +19,148 @@ type MqttClient interface {
 	Subscribe(topic string, callback func(message string)) error
 }
 
+// RetainedLister is implemented by MQTT clients that can list the topics that have
+// retained messages. It is used to retract entities that are no longer published.
+type RetainedLister interface {
+	Retained(filters []string) ([]string, error)
+}
+
+// PropertyPublisher is implemented by MQTT clients that can attach user properties to
+// messages, such as MQTT 5 clients. Bridges use them to tag messages with their module,
+// zone and attribute.
+type PropertyPublisher interface {
+	PublishWithProperties(topic string, qos byte, retained bool, payload string, properties map[string]string) error
+}
+
+// Responder is implemented by MQTT clients that support request/response, such as MQTT 5
+// clients, and subscriptions with a QoS. respond publishes a response to the request, or is
+// nil if none was asked for. Bridges respond to set commands with their outcome.
+type Responder interface {
+	SubscribeRequests(topic string, qos byte, callback func(message string, respond func(payload string) error)) error
+}
+
+// ClassPublisher is implemented by MQTT clients that need the topic class of every message,
+// such as clients that publish to several brokers, each of them carrying only some classes.
+// It takes precedence over PropertyPublisher.
+type ClassPublisher interface {
+	PublishClass(class, topic string, qos byte, retained bool, payload string, properties map[string]string) error
+}
+
+// Unsubscriber is implemented by MQTT clients that can cancel subscriptions. Bridges that
+// are stopped unsubscribe from their command topics, so commands no longer reach them.
+type Unsubscriber interface {
+	Unsubscribe(topics ...string) error
+}
+
 // Config defines de Modbus<>MQTT bridge configuration
 type Config struct {
-	ModuleName  string         // name of the module the modbus interface is connected to
-	SlaveID     byte           // SlaveID of the module in the bus
-	TopicPrefix string         // MQTT topic prefix to publish information
-	HassPrefix  string         // Home Assistant sensor discovery prefix
-	Mqtt        MqttClient     // MQTT client
-	Modbus      watcher.Modbus // Modbus client
+	ModuleName       string            // name of the module the modbus interface is connected to
+	SlaveID          byte              // SlaveID of the module in the bus
+	TopicPrefix      string            // MQTT topic prefix to publish information
+	HassPrefix       string            // Home Assistant sensor discovery prefix
+	HomiePrefix      string            // Homie base topic, where OUTPUT_HOMIE publishes the module as a device
+	MinTemp          float32           // Minimum target temperature offered to Home Assistant
+	MaxTemp          float32           // Maximum target temperature offered to Home Assistant
+	PollInterval     time.Duration     // How often zone registers are polled
+	SysPollInterval  time.Duration     // How often system registers are polled. Defaults to PollInterval
+	FastPollInterval time.Duration     // Poll interval after a change or a set command. Zero disables adaptive polling
+	FastPollDuration time.Duration     // How long to poll at FastPollInterval after a change
+	Zones            map[int]ZoneInfo  // Optional per-zone settings, by zone number
+	BridgeID         string            // Home Assistant device identifier of koolnova2mqtt itself
+	Version          string            // koolnova2mqtt version reported to Home Assistant
+	StatusTopic      string            // Topic where koolnova2mqtt publishes its own online/offline status, if any
+	MaxFailures      int               // Consecutive failed polls before the module is reported offline
+	Output           string            // What to publish: comma-separated OUTPUT_TOPICS (default), OUTPUT_JSON, OUTPUT_BOTH and OUTPUT_HOMIE
+	Policies         map[string]Policy // QoS and retain flag of every topic class. Missing classes use DefaultPolicies
+	StateDebounce    time.Duration     // How long to wait for more changes before publishing the JSON state
+	Stats            *Stats            // Polling statistics. Pass the same instance to keep them across restarts
+	OnChange         func(*Change)     // Optional callback invoked when a published value changes
+	Mqtt             MqttClient        // MQTT client
+	Modbus           watcher.Modbus    // Modbus client
+}
+
+// Stats collects polling statistics of a bridge
+type Stats struct {
+	PollLatency  *metrics.Histogram // duration of successful polls, in seconds
+	PollFailures metrics.Counter    // failed polls
+}
+
+// NewStats returns empty polling statistics
+func NewStats() *Stats {
+	return &Stats{
+		PollLatency: metrics.NewHistogram(metrics.LatencyBuckets),
+	}
 }
 
+// Change describes a change in a value published by a bridge
+type Change struct {
+	Module    string      `json:"module"`
+	Zone      int         `json:"zone,omitempty"` // zero for system values
+	Attribute string      `json:"attribute"`      // topic of the value, relative to the zone or sys topic
+	Old       interface{} `json:"old"`            // nil if the value was not known
+	New       interface{} `json:"new"`
+	Time      time.Time   `json:"timestamp"`
+}
+
+// ZoneInfo contains user-supplied settings of a zone
+type ZoneInfo struct {
+	Name string // Friendly name shown in Home Assistant
+	Area string // Home Assistant area suggested for the zone
+	Slug string // Replaces zone<N> in the zone's MQTT topics
+}
+
+const DEFAULT_MIN_TEMP = 15
+const DEFAULT_MAX_TEMP = 35
+const DEFAULT_POLL_INTERVAL = 2 * time.Second
+const DEFAULT_MAX_FAILURES = 3
+const DEFAULT_FAST_POLL_DURATION = 30 * time.Second
+const DEFAULT_STATE_DEBOUNCE = 500 * time.Millisecond
+
+// Output modes, selecting how a bridge publishes the state of its module
+const OUTPUT_TOPICS = "topics" // one topic per attribute, plus Home Assistant discovery
+const OUTPUT_JSON = "json"     // a JSON document with the state of the whole module
+const OUTPUT_BOTH = "both"     // both of the above. Deprecated: list OUTPUT_TOPICS and OUTPUT_JSON instead
+const OUTPUT_HOMIE = "homie"   // a Homie 4.0 device, for controllers such as openHAB
+
+// ModuleState is the JSON document published to the state topic of a module
+// in OUTPUT_JSON and OUTPUT_BOTH modes
+type ModuleState struct {
+	Module string       `json:"module"`
+	Zones  []ZoneStatus `json:"zones"`
+	Sys    *SysStatus   `json:"sys"`
+	Time   time.Time    `json:"timestamp"`
+}
+
+// ErrRetainedUnsupported is returned by Purge if the MQTT client cannot list retained topics
+var ErrRetainedUnsupported = errors.New("MQTT client cannot list retained topics")
+
+// ErrZonesChanged is returned by Tick when a zone is no longer present or a new zone
+// appears. The bridge must be restarted.
+var ErrZonesChanged = errors.New("Zones changed, the bridge must be restarted")
+
 // Bridge bridges Modbus and MQTT protocols
 type Bridge struct {
-	Config                  // embedded configuration
-	zw     *watcher.Watcher // watcher to detect register changes in zones
-	sysw   *watcher.Watcher // watcher to detect register changes in system registers
-	zones  []*Zone          // List of present zones in this module
-	sys    *SysDriver
+	Config                       // embedded configuration
+	zw          *watcher.Watcher // watcher to detect register changes in zones
+	sysw        registerGroups   // watchers to detect register changes in system registers
+	zones       []*Zone          // List of present zones in this module
+	sys         *SysDriver
+	failures    int                    // consecutive failed polls
+	status      string                 // availability last published, empty if unknown
+	published   map[string]bool        // retained topics published since Start
+	started     bool                   // whether Start succeeded
+	lock        sync.Mutex             // protects zones, started and temperature samples
+	values      map[string]interface{} // last value published to each state topic
+	valueLock   sync.Mutex             // protects values and published
+	nextSysPoll time.Time              // when system registers must be polled again
+	fastUntil   time.Time              // end of the fast polling period
+	pollLock    sync.Mutex             // protects fastUntil
+	modeLock    sync.Mutex             // serializes changes to the system mode register, which combine cached bits
+	stateTimer  *time.Timer            // publishes the JSON state once changes settle, nil if not scheduled. Protected by valueLock
+	stopped     bool                   // whether Stop was called. Protected by valueLock
+	commands    []string               // command topics subscribed since Start. Protected by valueLock
+	homieDevice string                 // base topic of the Homie device, once its attributes were published
+	homieTopics map[string]string      // Homie property topic of every attribute topic
 }
 
 // getActiveZones returns the list of active zones in this module
@@ -55,53 +185,118 @@ func NewBridge(config *Config) *Bridge {
 	b := &Bridge{
 		Config: *config,
 	}
+	if b.MinTemp == 0 {
+		b.MinTemp = DEFAULT_MIN_TEMP
+	}
+	if b.MaxTemp == 0 {
+		b.MaxTemp = DEFAULT_MAX_TEMP
+	}
+	if b.PollInterval == 0 {
+		b.PollInterval = DEFAULT_POLL_INTERVAL
+	}
+	if b.SysPollInterval == 0 {
+		b.SysPollInterval = b.PollInterval
+	}
+	if b.FastPollDuration == 0 {
+		b.FastPollDuration = DEFAULT_FAST_POLL_DURATION
+	}
+	if b.MaxFailures == 0 {
+		b.MaxFailures = DEFAULT_MAX_FAILURES
+	}
+	if b.Output == "" {
+		b.Output = OUTPUT_TOPICS
+	}
+	if b.HomiePrefix == "" {
+		b.HomiePrefix = DEFAULT_HOMIE_PREFIX
+	}
+	if b.StateDebounce == 0 {
+		b.StateDebounce = DEFAULT_STATE_DEBOUNCE
+	}
+	policies := make(map[string]Policy)
+	for class, policy := range DefaultPolicies {
+		policies[class] = policy
+	}
+	for class, policy := range b.Policies {
+		policies[class] = policy
+	}
+	b.Policies = policies
+	if b.Stats == nil {
+		b.Stats = NewStats()
+	}
+	b.values = make(map[string]interface{})
 	return b
 }
 
 // Start starts the bridge, publishes the configuration to Home Assistant topics and publishes
-// the current state. Call Start() every time MQTT gets disconnected.
+// the current state
 func (b *Bridge) Start() error {
 
+	newWatcher := func(address, quantity uint16) *watcher.Watcher {
+		return watcher.New(&watcher.Config{
+			Address:  address,
+			Quantity: quantity,
+			SlaveID:  b.SlaveID,
+			Modbus:   b.Modbus,
+		})
+	}
+
 	// Define a watcher to watch the zone registers
-	zw := watcher.New(&watcher.Config{
-		Address:  FIRST_ZONE_REGISTER,
-		Quantity: TOTAL_ZONE_REGISTERS,
-		SlaveID:  b.SlaveID,
-		Modbus:   b.Modbus,
-	})
+	zw := newWatcher(FIRST_ZONE_REGISTER, TOTAL_ZONE_REGISTERS)
 
-	// Define a watcher to watch the system registers
-	sysw := watcher.New(&watcher.Config{
-		Address:  FIRST_SYS_REGISTER,
-		Quantity: TOTAL_SYS_REGISTERS,
-		SlaveID:  b.SlaveID,
-		Modbus:   b.Modbus,
-	})
+	// Define watchers to watch the system registers before and after the static
+	// serial configuration, which is only read on start
+	const firstModeRegister = FIRST_STATIC_REGISTER + TOTAL_STATIC_REGISTERS
+	acw := newWatcher(FIRST_SYS_REGISTER, FIRST_STATIC_REGISTER-FIRST_SYS_REGISTER)
+	staticw := newWatcher(FIRST_STATIC_REGISTER, TOTAL_STATIC_REGISTERS)
+	modew := newWatcher(firstModeRegister, FIRST_SYS_REGISTER+TOTAL_SYS_REGISTERS-firstModeRegister)
 
 	b.zw = zw
-	b.sysw = sysw
+	b.sysw = registerGroups{acw, modew}
+	b.published = make(map[string]bool)
 	sys := NewSys(&SysConfig{
-		Watcher: b.sysw,
+		Watcher: registerGroups{acw, staticw, modew},
 	})
 	b.sys = sys
 
 	log.Printf("Starting bridge for %s\n", b.ModuleName)
-	err := b.poll()
+	err := b.poll(true)
+	if err == nil {
+		err = staticw.Poll()
+	}
 	if err != nil {
+		b.setOnline(false)
 		return err
 	}
 
+	// Find out what previous runs published, so stale entities can be retracted
+	previous, err := b.retained()
+	if err != nil {
+		log.Printf("Cannot read retained topics of %s: %s\n", b.ModuleName, err)
+	}
+
 	// Get Active zones
 	zones, err := getActiveZones(b.zw)
+	b.lock.Lock()
 	b.zones = zones
+	b.lock.Unlock()
 	log.Printf("%d zones are present in %s\n", len(zones), b.ModuleName)
 
-	// Downsize watched range to the required number of registers
-	b.zw.Resize(len(zones) * REG_PER_ZONE)
-
 	holdModeTopic := b.getSysTopic("holdMode")
 	holdModeSetTopic := holdModeTopic + "/set"
 
+	// describe the Homie device before publishing its values and subscribing to its set topics
+	if b.hasOutput(OUTPUT_HOMIE) {
+		b.publishHomieDevice(zones)
+	}
+
+	// the JSON state is published once the initial values are known, do not retract it
+	if b.publishesJSON() && b.Policies[CLASS_STATE].Retained {
+		b.published[b.getStateTopic()] = true
+	}
+
+	// describe koolnova2mqtt itself, so the module's device is connected through it
+	b.publishBridgeDevice()
+
 	// configure publishing when modbus registers change
 	for _, zone := range zones {
 		zone := zone
@@ -113,122 +308,112 @@ func (b *Bridge) Start() error {
 		hvacModeTopic := b.getZoneTopic(zone.ZoneNumber, "hvacMode")
 		hvacModeSetTopic := hvacModeTopic + "/set"
 
+		// the current temperature and the zone state are published on the first Tick, do not retract them
+		if b.publishesTopics() {
+			if b.Policies[CLASS_TELEMETRY].Retained {
+				b.published[currentTempTopic] = true
+			}
+			if b.Policies[CLASS_STATE].Retained {
+				b.published[b.getZoneTopic(zone.ZoneNumber, "state")] = true
+			}
+		}
+
 		// In HA there is three HVAC modes: "cool", "heat" and "off". Therefore,
 		// publish "OFF" if we detect the REG_ENABLED change is off
 		// Otherwise, publish "heat" or "cool" depending on REG_MODE
 		zone.OnEnabledChange = func() {
-			hvacModeTopic := b.getZoneTopic(zone.ZoneNumber, "hvacMode")
-			var mode string
-			if zone.isOn() {
-				mode = sys.HVACMode()
-			} else {
-				mode = HVAC_MODE_OFF
-			}
-			b.Mqtt.Publish(hvacModeTopic, 0, true, mode)
+			b.publishState(zone.ZoneNumber, "hvacMode", b.getHvacMode(zone))
 		}
 
 		// if the current temperature changes, forward value to the
 		// correspondig MQTT topic
 		zone.OnCurrentTempChange = func(currentTemp float32) {
-			b.Mqtt.Publish(currentTempTopic, 0, true, fmt.Sprintf("%g", currentTemp))
+			b.publishState(zone.ZoneNumber, "currentTemp", currentTemp)
 		}
 
 		// if the target temperature changes, publish it to MQTT
 		// this is fired when the target is set over MQTT or via a thermostat
 		zone.OnTargetTempChange = func(targetTemp float32) {
-			b.Mqtt.Publish(targetTempTopic, 0, true, fmt.Sprintf("%g", targetTemp))
+			b.publishState(zone.ZoneNumber, "targetTemp", targetTemp)
 		}
 
 		// Publish changes to the fan mode
 		zone.OnFanModeChange = func(fanMode FanMode) {
-			b.Mqtt.Publish(fanModeTopic, 0, true, FanMode2Str(fanMode))
+			b.publishState(zone.ZoneNumber, "fanMode", FanMode2Str(fanMode))
 		}
 
 		// Subscribe to target temperature set topic in MQTT
-		err = b.Mqtt.Subscribe(targetTempSetTopic, func(message string) {
-			targetTemp, err := strconv.ParseFloat(message, 32)
-			if err != nil {
-				log.Printf("Error parsing targetTemperature in topic %s: %s", targetTempSetTopic, err)
-				return
-			}
-			err = zone.setTargetTemperature(float32(targetTemp))
-			if err != nil {
-				log.Printf("Cannot set target temperature to %g in zone %d", targetTemp, zone.ZoneNumber)
+		err = b.subscribeSet(zone.ZoneNumber, "targetTemp", func(message string, respond func(payload string) error) {
+			targetTemp, parseErr := strconv.ParseFloat(message, 32)
+			requested := message
+			if parseErr == nil {
+				requested = fmt.Sprint(float32(targetTemp))
 			}
+			b.handleSet(zone.ZoneNumber, "targetTemp", requested, respond, func() error {
+				if parseErr != nil {
+					return fmt.Errorf("invalid temperature %q", message)
+				}
+				return b.SetTargetTemp(zone.ZoneNumber, float32(targetTemp))
+			}, func() (interface{}, error) {
+				err := zone.refresh(REG_TARGET_TEMP)
+				return zone.getTargetTemperature(), err
+			})
 		})
 		if err != nil {
 			return err
 		}
 
 		// Subscribe to fan mode set topic in MQTT
-		err = b.Mqtt.Subscribe(fanModeSetTopic, func(message string) {
-			fm, err := Str2FanMode(message)
-			if err != nil {
-				log.Printf("Unknown fan mode %q in message to zone %d", message, zone.ZoneNumber)
-			}
-			err = zone.setFanMode(fm)
-			if err != nil {
-				log.Printf("Cannot set fan mode to %s in zone %d", message, zone.ZoneNumber)
-			}
+		err = b.subscribeSet(zone.ZoneNumber, "fanMode", func(message string, respond func(payload string) error) {
+			b.handleSet(zone.ZoneNumber, "fanMode", message, respond, func() error {
+				return b.SetFanMode(zone.ZoneNumber, message)
+			}, func() (interface{}, error) {
+				err := zone.refresh(REG_MODE)
+				return FanMode2Str(zone.getFanMode()), err
+			})
 		})
 		if err != nil {
 			return err
 		}
 
 		// Subscribe to HVAC Mode set topic in MQTT
-		err = b.Mqtt.Subscribe(hvacModeSetTopic, func(message string) {
-			// If user sets the Home Assistant HVAC mode to off, turn off this zone
-			if message == HVAC_MODE_OFF {
-				err := zone.setOn(false) // turn zone off (REG_ENABLED)
-				if err != nil {
-					log.Printf("Cannot set zone %d to off", zone.ZoneNumber)
+		err = b.subscribeSet(zone.ZoneNumber, "hvacMode", func(message string, respond func(payload string) error) {
+			b.handleSet(zone.ZoneNumber, "hvacMode", message, respond, func() error {
+				return b.SetHvacMode(zone.ZoneNumber, message)
+			}, func() (interface{}, error) {
+				err := zone.refresh(REG_ENABLED)
+				if err == nil {
+					err = sys.Refresh(REG_SYS_KN_MODE)
 				}
-				return
-			}
-			// Translate HA HVAC mode to Koolnova's
-			knMode := sys.GetSystemKNMode()
-			knMode = ApplyHvacMode(knMode, message)
-			err = sys.SetSystemKNMode(knMode)
-			if err != nil {
-				log.Printf("Cannot set knmode mode to %x in zone %d", knMode, zone.ZoneNumber)
-			}
-			err := zone.setOn(true)
-			if err != nil {
-				log.Printf("Cannot set zone %d to on", zone.ZoneNumber)
-				return
-			}
+				return b.getHvacMode(zone), err
+			})
 		})
 		if err != nil {
 			return err
 		}
 
-		// Subscribe to changes in hold mode:
-		err = b.Mqtt.Subscribe(holdModeSetTopic, func(message string) {
-			// Translate HA's hold mode to Koolnova's
-			knMode := sys.GetSystemKNMode()
-			knMode = ApplyHoldMode(knMode, message)
-			err := sys.SetSystemKNMode(knMode)
-			if err != nil {
-				log.Printf("Cannot set knmode mode to %x in zone %d", knMode, zone.ZoneNumber)
-			}
+		// Subscribe to the zone's JSON set topic, to change several attributes at once
+		err = b.subscribeCommand(b.getZoneTopic(zone.ZoneNumber, "set"), func(message string, respond func(payload string) error) {
+			b.handleZoneSet(zone, message, respond)
 		})
 		if err != nil {
 			return err
 		}
 
-		// Define a Home Assistant thermostat
-		name := fmt.Sprintf("%s_zone%d", b.ModuleName, zone.ZoneNumber)
-		b.publishComponent(HA_COMPONENT_CLIMATE, fmt.Sprintf("zone%d", zone.ZoneNumber), map[string]interface{}{
-			"name":                      name,
+		// Define a Home Assistant thermostat. unique_id must not depend on
+		// the friendly name or the topic slug so renaming a zone keeps the HA entity
+		id := fmt.Sprintf("%s_zone%d", b.ModuleName, zone.ZoneNumber)
+		b.publishZoneComponent(zone.ZoneNumber, HA_COMPONENT_CLIMATE, fmt.Sprintf("zone%d", zone.ZoneNumber), map[string]interface{}{
+			"name":                      b.getZoneName(zone.ZoneNumber, ""),
 			"current_temperature_topic": currentTempTopic,
 			"precision":                 0.1,
 			"temperature_state_topic":   targetTempTopic,
 			"temperature_command_topic": targetTempSetTopic,
 			"temperature_unit":          "C",
 			"temp_step":                 0.5,
-			"unique_id":                 name,
-			"min_temp":                  15,
-			"max_temp":                  35,
+			"unique_id":                 id,
+			"min_temp":                  b.MinTemp,
+			"max_temp":                  b.MaxTemp,
 			"modes":                     []string{HVAC_MODE_COOL, HVAC_MODE_HEAT, HVAC_MODE_OFF},
 			"mode_state_topic":          hvacModeTopic,
 			"mode_command_topic":        hvacModeSetTopic,
@@ -241,57 +426,68 @@ func (b *Bridge) Start() error {
 		})
 
 		// Define a current temperature sensor:
-		name = fmt.Sprintf("%s_zone%d_temp", b.ModuleName, zone.ZoneNumber)
-		b.publishComponent(HA_COMPONENT_SENSOR, fmt.Sprintf("zone%d_temp", zone.ZoneNumber), map[string]interface{}{
-			"name":                name,
+		b.publishZoneComponent(zone.ZoneNumber, HA_COMPONENT_SENSOR, fmt.Sprintf("zone%d_temp", zone.ZoneNumber), map[string]interface{}{
+			"name":                b.getZoneName(zone.ZoneNumber, "temp"),
 			"device_class":        "temperature",
 			"state_topic":         currentTempTopic,
 			"unit_of_measurement": "°C",
-			"unique_id":           name,
+			"unique_id":           id + "_temp",
 		})
 
 		// Define a target temperature sensor:
-		name = fmt.Sprintf("%s_zone%d_target_temp", b.ModuleName, zone.ZoneNumber)
-		b.publishComponent(HA_COMPONENT_SENSOR, fmt.Sprintf("zone%d_target_temp", zone.ZoneNumber), map[string]interface{}{
-			"name":                name,
+		b.publishZoneComponent(zone.ZoneNumber, HA_COMPONENT_SENSOR, fmt.Sprintf("zone%d_target_temp", zone.ZoneNumber), map[string]interface{}{
+			"name":                b.getZoneName(zone.ZoneNumber, "target_temp"),
 			"device_class":        "temperature",
 			"state_topic":         targetTempTopic,
 			"unit_of_measurement": "°C",
-			"unique_id":           name,
+			"unique_id":           id + "_target_temp",
 		})
 
 	}
 
+	// Subscribe to changes in hold mode:
+	err = b.subscribeSet(0, "holdMode", func(message string, respond func(payload string) error) {
+		b.handleSet(0, "holdMode", message, respond, func() error {
+			return b.SetHoldMode(message)
+		}, func() (interface{}, error) {
+			err := sys.Refresh(REG_SYS_KN_MODE)
+			return sys.HoldMode(), err
+		})
+	})
+	if err != nil {
+		return err
+	}
+
 	// Publish changes to system registers:
 	sys.OnACAirflowChange = func(ac ACMachine) {
 		airflow := sys.GetAirflow(ac)
-		b.Mqtt.Publish(b.getACTopic(ac, "airflow"), 0, true, strconv.Itoa(airflow))
+		b.publishState(0, acAttribute(ac, "airflow"), airflow)
 	}
 
 	sys.OnACTargetTempChange = func(ac ACMachine) {
 		targetTemp := sys.GetMachineTargetTemp(ac)
-		b.Mqtt.Publish(b.getACTopic(ac, "targetTemp"), 0, true, fmt.Sprintf("%g", targetTemp))
+		b.publishState(0, acAttribute(ac, "targetTemp"), targetTemp)
 	}
 
 	sys.OnACTargetFanModeChange = func(ac ACMachine) {
 		targetAirflow := sys.GetTargetFanMode(ac)
-		b.Mqtt.Publish(b.getACTopic(ac, "fanMode"), 0, true, FanMode2Str(targetAirflow))
+		b.publishState(0, acAttribute(ac, "fanMode"), FanMode2Str(targetAirflow))
 	}
 
 	sys.OnEfficiencyChange = func() {
 		efficiency := sys.GetEfficiency()
-		b.Mqtt.Publish(b.getSysTopic("efficiency"), 0, true, strconv.Itoa(efficiency))
+		b.publishState(0, "efficiency", efficiency)
 	}
 
 	sys.OnSystemEnabledChange = func() {
 		enabled := sys.GetSystemEnabled()
-		b.Mqtt.Publish(b.getSysTopic("enabled"), 0, true, fmt.Sprintf("%t", enabled))
+		b.publishState(0, "enabled", enabled)
 		b.publishHvacMode()
 	}
 
 	sys.OnKnModeChange = func() {
 		b.publishHvacMode()
-		b.Mqtt.Publish(holdModeTopic, 0, true, sys.HoldMode())
+		b.publishState(0, "holdMode", sys.HoldMode())
 	}
 
 	// Trigger a callback on all registers so the MQTT broker is updated on connect:
@@ -299,65 +495,602 @@ func (b *Bridge) Start() error {
 	b.sysw.TriggerCallbacks()
 
 	// Publish one-off static information
-	b.Mqtt.Publish(b.getSysTopic("serialBaud"), 0, true, strconv.Itoa(sys.GetBaudRate()))
-	b.Mqtt.Publish(b.getSysTopic("serialParity"), 0, true, sys.GetParity())
-	b.Mqtt.Publish(b.getSysTopic("slaveId"), 0, true, strconv.Itoa(sys.GetSlaveID()))
+	b.publishState(0, "serialBaud", sys.GetBaudRate())
+	b.publishState(0, "serialParity", sys.GetParity())
+	b.publishState(0, "slaveId", sys.GetSlaveID())
+	b.lock.Lock()
+	b.started = true
+	b.lock.Unlock()
+	b.setOnline(true)
+	b.retract(previous)
 	return nil
 }
 
-// poll polls modbus for changes
-func (b *Bridge) poll() error {
+// Stop cancels the publication of the JSON state of a bridge that is no longer used, so
+// its stale state does not overwrite the one published by the bridge that replaces it,
+// and unsubscribes from its command topics, so commands are not handled by both
+func (b *Bridge) Stop() {
+	b.valueLock.Lock()
+	b.stopped = true
+	if b.stateTimer != nil {
+		b.stateTimer.Stop()
+		b.stateTimer = nil
+	}
+	commands := b.commands
+	b.commands = nil
+	b.valueLock.Unlock()
+
+	if unsubscriber, ok := b.Mqtt.(Unsubscriber); ok && len(commands) > 0 {
+		err := unsubscriber.Unsubscribe(commands...)
+		if err != nil {
+			log.Printf("Cannot unsubscribe from the command topics of %s: %s\n", b.ModuleName, err)
+		}
+	}
+}
+
+// poll polls modbus for changes in the zone registers and, if sys is true, in the system registers
+func (b *Bridge) poll(sys bool) error {
+	start := time.Now()
 	err := b.zw.Poll()
 	if err != nil {
 		log.Printf("Timeout polling %s zone registers: %s\n", b.ModuleName, err)
+		b.Stats.PollFailures.Inc()
 		return err
 	}
 
-	err = b.sysw.Poll()
-	if err != nil {
-		log.Printf("Timeout polling %s system registers: %s\n", b.ModuleName, err)
-		return err
+	if sys {
+		err = b.sysw.Poll()
+		if err != nil {
+			log.Printf("Timeout polling %s system registers: %s\n", b.ModuleName, err)
+			b.Stats.PollFailures.Inc()
+			return err
+		}
+		b.nextSysPoll = start.Add(b.SysPollInterval)
 	}
+	b.Stats.PollLatency.Observe(time.Since(start).Seconds())
 	return nil
 }
 
-// Tick must be invoked periodically to refesh registers from modbus
+// Interval returns how long to wait until the next Tick. It is FastPollInterval for
+// FastPollDuration after a change or a set command, and PollInterval otherwise.
+func (b *Bridge) Interval() time.Duration {
+	if b.isFast(time.Now()) && b.FastPollInterval < b.PollInterval {
+		return b.FastPollInterval
+	}
+	return b.PollInterval
+}
+
+// isFast returns whether the bridge is in the fast polling period
+func (b *Bridge) isFast(now time.Time) bool {
+	if b.FastPollInterval == 0 {
+		return false
+	}
+	b.pollLock.Lock()
+	defer b.pollLock.Unlock()
+	return now.Before(b.fastUntil)
+}
+
+// accelerate starts or extends the fast polling period
+func (b *Bridge) accelerate() {
+	if b.FastPollInterval == 0 {
+		return
+	}
+	b.pollLock.Lock()
+	defer b.pollLock.Unlock()
+	b.fastUntil = time.Now().Add(b.FastPollDuration)
+}
+
+// Tick must be invoked every Interval() to refesh registers from modbus
 // it also samples temperature and calculates a moving average of read temperatures
+// System registers are only polled every SysPollInterval, unless polling fast.
+// The module is reported offline after MaxFailures consecutive failed polls.
 func (b *Bridge) Tick() error {
-	err := b.poll()
+	now := time.Now()
+	err := b.poll(b.isFast(now) || !now.Before(b.nextSysPoll))
 	if err != nil {
+		b.failures++
+		if b.failures >= b.MaxFailures {
+			b.setOnline(false)
+		}
 		return err
 	}
+	b.failures = 0
+	b.setOnline(true)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	present := make(map[int]bool, len(b.zones))
 	for _, z := range b.zones {
+		if !z.isPresent() {
+			log.Printf("Zone %d of %s is no longer present\n", z.ZoneNumber, b.ModuleName)
+			return ErrZonesChanged
+		}
+		present[z.ZoneNumber] = true
 		z.sampleTemperature()
 	}
+	for n := 1; n <= NUM_ZONES; n++ {
+		zone := Zone{ZoneConfig: ZoneConfig{ZoneNumber: n, Watcher: b.zw}}
+		if !present[n] && zone.isPresent() {
+			log.Printf("Zone %d of %s is now present\n", n, b.ModuleName)
+			return ErrZonesChanged
+		}
+	}
 	return nil
 }
 
 func (b *Bridge) getZoneTopic(zoneNum int, subtopic string) string {
-	return fmt.Sprintf("%s/%s/zone%d/%s", b.TopicPrefix, b.ModuleName, zoneNum, subtopic)
+	return fmt.Sprintf("%s/%s/%s/%s", b.TopicPrefix, b.ModuleName, b.getZoneSlug(zoneNum), subtopic)
+}
+
+// getZoneSlug returns the topic level of a zone
+func (b *Bridge) getZoneSlug(zoneNum int) string {
+	if info, ok := b.Zones[zoneNum]; ok && info.Slug != "" {
+		return info.Slug
+	}
+	return fmt.Sprintf("zone%d", zoneNum)
+}
+
+// getZoneName returns the name of a zone entity such as "target_temp", or of the
+// zone itself if entity is empty. Friendly names are used if configured.
+func (b *Bridge) getZoneName(zoneNum int, entity string) string {
+	if info, ok := b.Zones[zoneNum]; ok && info.Name != "" {
+		if entity == "" {
+			return info.Name
+		}
+		return info.Name + " " + strings.Replace(entity, "_", " ", -1)
+	}
+	name := fmt.Sprintf("%s_zone%d", b.ModuleName, zoneNum)
+	if entity != "" {
+		name += "_" + entity
+	}
+	return name
+}
+
+// getAvailabilityTopic returns the topic where the module's online/offline status is published
+func (b *Bridge) getAvailabilityTopic() string {
+	return fmt.Sprintf("%s/%s/availability", b.TopicPrefix, b.ModuleName)
+}
+
+// getStatusTopic returns the topic where the bridge's Supervisor publishes its state
+func (b *Bridge) getStatusTopic() string {
+	return fmt.Sprintf("%s/%s/status", b.TopicPrefix, b.ModuleName)
+}
+
+// getStateTopic returns the topic of the module's JSON state
+func (b *Bridge) getStateTopic() string {
+	return fmt.Sprintf("%s/%s/state", b.TopicPrefix, b.ModuleName)
+}
+
+// hasOutput returns whether output is one of the bridge's output modes. OUTPUT_BOTH
+// stands for OUTPUT_TOPICS and OUTPUT_JSON.
+func (b *Bridge) hasOutput(output string) bool {
+	for _, o := range strings.Split(b.Output, ",") {
+		o = strings.TrimSpace(o)
+		if o == output || o == OUTPUT_BOTH && (output == OUTPUT_TOPICS || output == OUTPUT_JSON) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishesTopics returns whether the bridge publishes a topic per attribute
+func (b *Bridge) publishesTopics() bool {
+	return b.hasOutput(OUTPUT_TOPICS)
+}
+
+// publishesJSON returns whether the bridge publishes the JSON state of the module
+func (b *Bridge) publishesJSON() bool {
+	return b.hasOutput(OUTPUT_JSON)
+}
+
+// subscribeSet subscribes to the set topic of an attribute of a zone, or of the system if
+// zoneNum is zero, and to the set topic of its Homie property, if any
+func (b *Bridge) subscribeSet(zoneNum int, attribute string, callback func(message string, respond func(payload string) error)) error {
+	topic := b.getTopic(zoneNum, attribute)
+	err := b.subscribeCommand(topic+"/set", callback)
+	if err != nil {
+		return err
+	}
+	if homieTopic, ok := b.homieTopics[topic]; ok {
+		return b.subscribeCommand(homieTopic+"/set", callback)
+	}
+	return nil
+}
+
+// subscribeCommand subscribes to a command topic with the QoS of CLASS_COMMANDS. respond is
+// nil unless the MQTT client is a Responder and the sender of the command asked for a response.
+// Other clients always subscribe with QoS 0.
+func (b *Bridge) subscribeCommand(topic string, callback func(message string, respond func(payload string) error)) error {
+	b.valueLock.Lock()
+	b.commands = append(b.commands, topic)
+	b.valueLock.Unlock()
+	if responder, ok := b.Mqtt.(Responder); ok {
+		return responder.SubscribeRequests(topic, b.Policies[CLASS_COMMANDS].QoS, callback)
+	}
+	return b.Mqtt.Subscribe(topic, func(message string) {
+		callback(message, nil)
+	})
+}
+
+// setOnline publishes the availability of the module when it changes
+func (b *Bridge) setOnline(online bool) {
+	status := AVAILABILITY_OFFLINE
+	if online {
+		status = AVAILABILITY_ONLINE
+	}
+	if status == b.status {
+		return
+	}
+	if b.publish(CLASS_AVAILABILITY, b.getAvailabilityTopic(), status) == nil {
+		b.status = status
+		if online {
+			b.setHomieState(HOMIE_STATE_READY)
+		} else {
+			b.setHomieState(HOMIE_STATE_ALERT)
+		}
+	}
 }
 
 func (b *Bridge) getSysTopic(subtopic string) string {
 	return fmt.Sprintf("%s/%s/sys/%s", b.TopicPrefix, b.ModuleName, subtopic)
 }
 
-func (b *Bridge) getACTopic(ac ACMachine, subtopic string) string {
-	return b.getSysTopic(fmt.Sprintf("ac%d/%s", ac, subtopic))
+// acAttribute returns the sys attribute of an AC machine
+func acAttribute(ac ACMachine, attribute string) string {
+	return fmt.Sprintf("ac%d/%s", ac, attribute)
 }
 
 func (b *Bridge) publishHvacMode() {
-	for _, zone := range b.zones {
+	b.lock.Lock()
+	zones := b.zones
+	b.lock.Unlock()
+	for _, zone := range zones {
 		if zone.isOn() {
-			hvacModeTopic := b.getZoneTopic(zone.ZoneNumber, "hvacMode")
-			mode := b.sys.HVACMode()
-			b.Mqtt.Publish(hvacModeTopic, 0, true, mode)
+			b.publishState(zone.ZoneNumber, "hvacMode", b.sys.HVACMode())
+		}
+	}
+}
+
+// getHvacMode returns the Home Assistant HVAC mode of a zone: "off", or the
+// heating or cooling mode of the module if the zone is on
+func (b *Bridge) getHvacMode(z *Zone) string {
+	if z.isOn() {
+		return b.sys.HVACMode()
+	}
+	return HVAC_MODE_OFF
+}
+
+// getTopic returns the topic of an attribute of a zone, or of the system if zoneNum is zero
+func (b *Bridge) getTopic(zoneNum int, attribute string) string {
+	if zoneNum == 0 {
+		return b.getSysTopic(attribute)
+	}
+	return b.getZoneTopic(zoneNum, attribute)
+}
+
+// getDevice returns the Home Assistant device that represents this module
+func (b *Bridge) getDevice() map[string]interface{} {
+	device := map[string]interface{}{
+		"identifiers":  []string{b.getDeviceID()},
+		"name":         b.ModuleName,
+		"manufacturer": HA_MANUFACTURER,
+		"model":        HA_MODEL,
+	}
+	if b.Version != "" {
+		device["sw_version"] = b.Version
+	}
+	if b.hasBridgeDevice() {
+		device["via_device"] = b.BridgeID
+	}
+	return device
+}
+
+// hasBridgeDevice returns whether koolnova2mqtt is published as a Home Assistant device of
+// its own. Its only entity is its connectivity, so StatusTopic is required.
+func (b *Bridge) hasBridgeDevice() bool {
+	return b.BridgeID != "" && b.StatusTopic != ""
+}
+
+// publishBridgeDevice publishes the Home Assistant device of koolnova2mqtt, with a sensor
+// that shows whether it is connected. Every module publishes the same configuration, outside
+// of the module's topics so it is never retracted.
+func (b *Bridge) publishBridgeDevice() {
+	if !b.hasBridgeDevice() || !b.publishesTopics() {
+		return
+	}
+	device := map[string]interface{}{
+		"identifiers": []string{b.BridgeID},
+		"name":        "koolnova2mqtt",
+	}
+	if b.Version != "" {
+		device["sw_version"] = b.Version
+	}
+	configJSON, _ := json.Marshal(map[string]interface{}{
+		"name":            "koolnova2mqtt",
+		"device_class":    "connectivity",
+		"entity_category": "diagnostic",
+		"state_topic":     b.StatusTopic,
+		"payload_on":      AVAILABILITY_ONLINE,
+		"payload_off":     AVAILABILITY_OFFLINE,
+		"unique_id":       b.BridgeID + "_status",
+		"device":          device,
+	})
+	b.publish(CLASS_DISCOVERY, fmt.Sprintf("%s/%s/%s/status/config", b.HassPrefix, HA_COMPONENT_BINARY_SENSOR, b.BridgeID), string(configJSON))
+}
+
+// getDeviceID returns the Home Assistant device identifier of this module
+func (b *Bridge) getDeviceID() string {
+	return fmt.Sprintf("%s_slave%d", b.ModuleName, b.SlaveID)
+}
+
+// publishZoneComponent publishes the configuration of a component that belongs to a zone.
+// Home Assistant only assigns areas to devices, so zones with an area are published as
+// a device of their own, connected through the module's device.
+func (b *Bridge) publishZoneComponent(zoneNum int, component, ObjectID string, config map[string]interface{}) {
+	if info, ok := b.Zones[zoneNum]; ok && info.Area != "" {
+		config["device"] = map[string]interface{}{
+			"identifiers":    []string{fmt.Sprintf("%s_zone%d", b.ModuleName, zoneNum)},
+			"name":           b.getZoneName(zoneNum, ""),
+			"manufacturer":   HA_MANUFACTURER,
+			"model":          HA_MODEL,
+			"suggested_area": info.Area,
+			"via_device":     b.getDeviceID(),
 		}
 	}
+	b.publishComponent(component, ObjectID, config)
 }
 
-// publishComponent publishes a Home Assistant component configuration for autodiscovery
+// publishComponent publishes a Home Assistant component configuration for autodiscovery.
+// Components are attached to the module's device unless they define their own.
+// Entities are unavailable when the module is offline or, if StatusTopic is set, when
+// koolnova2mqtt itself is.
 func (b *Bridge) publishComponent(component, ObjectID string, config map[string]interface{}) {
+	// Home Assistant reads the attribute topics
+	if !b.publishesTopics() {
+		return
+	}
+	if _, ok := config["device"]; !ok {
+		config["device"] = b.getDevice()
+	}
+	if b.StatusTopic == "" {
+		config["availability_topic"] = b.getAvailabilityTopic()
+	} else {
+		config["availability"] = []map[string]string{
+			{"topic": b.StatusTopic},
+			{"topic": b.getAvailabilityTopic()},
+		}
+		config["availability_mode"] = "all"
+	}
 	configJSON, _ := json.Marshal(config)
-	b.Mqtt.Publish(fmt.Sprintf("%s/%s/%s/%s/config", b.HassPrefix, component, b.ModuleName, ObjectID), 0, true, string(configJSON))
+	b.publish(CLASS_DISCOVERY, fmt.Sprintf("%s/%s/%s/%s/config", b.HassPrefix, component, b.ModuleName, ObjectID), string(configJSON))
+}
+
+// publish publishes a message about the module with the policy of its topic class
+func (b *Bridge) publish(class, topic, payload string) error {
+	return b.publishWithProperties(class, topic, payload, b.properties(0, ""))
+}
+
+// publishWithProperties publishes a message with the policy of its topic class.
+// Retained messages are remembered, so they are not retracted.
+func (b *Bridge) publishWithProperties(class, topic, payload string, properties map[string]string) error {
+	if b.Policies[class].Retained {
+		b.valueLock.Lock()
+		if b.published != nil {
+			b.published[topic] = true
+		}
+		b.valueLock.Unlock()
+	}
+	return b.send(class, topic, payload, properties)
+}
+
+// send publishes a message with the policy of its topic class. The user properties are
+// only sent if the MQTT client is a ClassPublisher or a PropertyPublisher.
+func (b *Bridge) send(class, topic, payload string, properties map[string]string) error {
+	policy := b.Policies[class]
+	return sendClass(b.Mqtt, class, topic, policy.QoS, policy.Retained, payload, properties)
+}
+
+// sendClass publishes a message of a topic class, along with its user properties if the
+// MQTT client is a ClassPublisher or a PropertyPublisher
+func sendClass(mqttClient MqttClient, class, topic string, qos byte, retained bool, payload string, properties map[string]string) error {
+	if publisher, ok := mqttClient.(ClassPublisher); ok {
+		return publisher.PublishClass(class, topic, qos, retained, payload, properties)
+	}
+	if publisher, ok := mqttClient.(PropertyPublisher); ok {
+		return publisher.PublishWithProperties(topic, qos, retained, payload, properties)
+	}
+	return mqttClient.Publish(topic, qos, retained, payload)
+}
+
+// clearRetained deletes the retained message of a topic with the QoS of its topic class.
+// Retained messages are deleted with an empty retained message, whatever the class policy.
+func clearRetained(mqttClient MqttClient, policies map[string]Policy, hassPrefix, topic string) error {
+	class := topicClass(topic, hassPrefix)
+	return sendClass(mqttClient, class, topic, policies[class].QoS, true, "", nil)
+}
+
+// properties returns the user properties of a message about the module, about a zone
+// if zoneNum is not zero and about an attribute if attribute is not empty
+func (b *Bridge) properties(zoneNum int, attribute string) map[string]string {
+	properties := map[string]string{"module": b.ModuleName}
+	if zoneNum != 0 {
+		properties["zone"] = strconv.Itoa(zoneNum)
+	}
+	if attribute != "" {
+		properties["attribute"] = attribute
+	}
+	return properties
+}
+
+// publishResult publishes the outcome of a set command to its result topic and, if the
+// sender asked for one, as a response
+func (b *Bridge) publishResult(topic string, result interface{}, respond func(payload string) error) {
+	payload, _ := json.Marshal(result)
+	b.send(CLASS_COMMANDS, topic, string(payload), b.properties(0, ""))
+	if respond != nil {
+		err := respond(string(payload))
+		if err != nil {
+			log.Printf("Cannot respond to %s: %s\n", topic, err)
+		}
+	}
+}
+
+// publishState publishes a value of a zone, or of the system if zoneNum is zero,
+// and reports it to OnChange if it is different from the last one published
+func (b *Bridge) publishState(zoneNum int, attribute string, value interface{}) error {
+	topic := b.getTopic(zoneNum, attribute)
+
+	b.valueLock.Lock()
+	old, known := b.values[topic]
+	b.values[topic] = value
+	changed := known && old != value
+	var zoneState *ZoneStatus
+	if !known || old != value {
+		if b.OnChange != nil {
+			b.OnChange(&Change{
+				Module:    b.ModuleName,
+				Zone:      zoneNum,
+				Attribute: attribute,
+				Old:       old,
+				New:       value,
+				Time:      time.Now(),
+			})
+		}
+		if zoneNum != 0 {
+			zoneState = b.zoneState(zoneNum)
+		}
+		if b.publishesJSON() && b.stateTimer == nil && !b.stopped {
+			// wait for more changes, such as the rest of a poll, and publish them together
+			b.stateTimer = time.AfterFunc(b.StateDebounce, b.publishModuleState)
+		}
+	}
+	b.valueLock.Unlock()
+
+	// the temperature drifts continuously, it does not mean someone is changing settings
+	if changed && attribute != "currentTemp" {
+		b.accelerate()
+	}
+	var err error
+	class := attributeClass(attribute)
+	properties := b.properties(zoneNum, attribute)
+	if homieTopic, ok := b.homieTopics[topic]; ok {
+		err = b.publishWithProperties(class, homieTopic, fmt.Sprint(value), properties)
+	}
+	if !b.publishesTopics() {
+		return err
+	}
+	err = b.publishWithProperties(class, topic, fmt.Sprint(value), properties)
+	if zoneState != nil {
+		payload, _ := json.Marshal(zoneState)
+		b.publishWithProperties(CLASS_STATE, b.getZoneTopic(zoneNum, "state"), string(payload), b.properties(zoneNum, ""))
+	}
+	return err
+}
+
+// publishModuleState publishes the JSON state of the module
+func (b *Bridge) publishModuleState() {
+	b.valueLock.Lock()
+	b.stateTimer = nil
+	stopped := b.stopped
+	b.valueLock.Unlock()
+	if stopped {
+		return
+	}
+	sys, err := b.SysStatus()
+	if errors.Is(err, ErrNotStarted) {
+		// the initial values changed while starting, publish them once Start finishes
+		b.valueLock.Lock()
+		if b.stateTimer == nil && !b.stopped {
+			b.stateTimer = time.AfterFunc(b.StateDebounce, b.publishModuleState)
+		}
+		b.valueLock.Unlock()
+		return
+	}
+	if err != nil {
+		return
+	}
+	payload, _ := json.Marshal(&ModuleState{
+		Module: b.ModuleName,
+		Zones:  b.ZoneStatus(),
+		Sys:    sys,
+		Time:   time.Now(),
+	})
+	b.publish(CLASS_STATE, b.getStateTopic(), string(payload))
+}
+
+// zoneState returns the state of a zone as last published to its topics, or nil
+// until all of them were published. b.valueLock must be held.
+func (b *Bridge) zoneState(zoneNum int) *ZoneStatus {
+	hvacMode, ok1 := b.values[b.getTopic(zoneNum, "hvacMode")].(string)
+	currentTemp, ok2 := b.values[b.getTopic(zoneNum, "currentTemp")].(float32)
+	targetTemp, ok3 := b.values[b.getTopic(zoneNum, "targetTemp")].(float32)
+	fanMode, ok4 := b.values[b.getTopic(zoneNum, "fanMode")].(string)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil
+	}
+	return &ZoneStatus{
+		Zone:        zoneNum,
+		Name:        b.getZoneName(zoneNum, ""),
+		On:          hvacMode != HVAC_MODE_OFF,
+		HvacMode:    hvacMode,
+		CurrentTemp: currentTemp,
+		TargetTemp:  targetTemp,
+		FanMode:     fanMode,
+	}
+}
+
+// retainedFilters returns the topic filters that match everything a module publishes
+func retainedFilters(topicPrefix, hassPrefix, homiePrefix, moduleName string) []string {
+	return []string{
+		fmt.Sprintf("%s/%s/#", topicPrefix, moduleName),
+		fmt.Sprintf("%s/+/%s/+/config", hassPrefix, moduleName),
+		fmt.Sprintf("%s/%s/#", homiePrefix, HomieID(moduleName)),
+	}
+}
+
+// retained returns the retained topics of this module, if the MQTT client can list them
+func (b *Bridge) retained() ([]string, error) {
+	lister, ok := b.Mqtt.(RetainedLister)
+	if !ok {
+		return nil, nil
+	}
+	return lister.Retained(retainedFilters(b.TopicPrefix, b.HassPrefix, b.HomiePrefix, b.ModuleName))
+}
+
+// retract clears the retained topics that were not published since Start, such as those
+// of zones that are no longer present, so Home Assistant removes their entities.
+// The status topic is owned by the Supervisor and is kept.
+func (b *Bridge) retract(topics []string) {
+	b.valueLock.Lock()
+	defer b.valueLock.Unlock()
+	for _, topic := range topics {
+		if !b.published[topic] && topic != b.StatusTopic && topic != b.getStatusTopic() {
+			log.Printf("Retracting stale topic %s\n", topic)
+			clearRetained(b.Mqtt, b.Policies, b.HassPrefix, topic)
+		}
+	}
+}
+
+// Purge clears all retained topics of a module, including its Home Assistant discovery
+// configuration and its Homie device, and returns how many were cleared. Topics are cleared
+// with the QoS of their topic class in policies, or DefaultPolicies if nil. The module's
+// bridge must not be running.
+func Purge(mqttClient MqttClient, policies map[string]Policy, topicPrefix, hassPrefix, homiePrefix, moduleName string) (int, error) {
+	if policies == nil {
+		policies = DefaultPolicies
+	}
+	lister, ok := mqttClient.(RetainedLister)
+	if !ok {
+		return 0, ErrRetainedUnsupported
+	}
+	topics, err := lister.Retained(retainedFilters(topicPrefix, hassPrefix, homiePrefix, moduleName))
+	if err != nil {
+		return 0, err
+	}
+	for _, topic := range topics {
+		err = clearRetained(mqttClient, policies, hassPrefix, topic)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(topics), nil
 }
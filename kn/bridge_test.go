@@ -2,13 +2,16 @@ package kn_test
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"koolnova2mqtt/kn"
 	"koolnova2mqtt/modbus"
+	"koolnova2mqtt/watcher"
 	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/epiclabs-io/ut"
 )
@@ -21,6 +24,7 @@ type Message struct {
 type MqttClientMock struct {
 	subscriptions map[string]func(message string)
 	messages      []Message
+	retained      []string
 }
 
 func NewMqttClientMock() *MqttClientMock {
@@ -69,6 +73,17 @@ func (m *MqttClientMock) Subscribe(topic string, callback func(message string))
 	return nil
 }
 
+func (m *MqttClientMock) Unsubscribe(topics ...string) error {
+	for _, topic := range topics {
+		delete(m.subscriptions, topic)
+	}
+	return nil
+}
+
+func (m *MqttClientMock) Retained(filters []string) ([]string, error) {
+	return m.retained, nil
+}
+
 func getKeys(funcMap map[string]func(string)) []string {
 	keys := make([]string, 0, len(funcMap))
 	for k := range funcMap {
@@ -122,6 +137,13 @@ func TestBridge(tx *testing.T) {
 		SlaveID:     49,
 		TopicPrefix: "topicPrefix",
 		HassPrefix:  "hassPrefix",
+		Zones: map[int]kn.ZoneInfo{
+			2:  {Name: "Kitchen", Area: "Kitchen"},
+			10: {Slug: "office"},
+		},
+		BridgeID:    "koolnova2mqtt_test",
+		Version:     "test",
+		StatusTopic: "topicPrefix/status",
 		Mqtt:        mqttClient,
 		Modbus:      modbusClient,
 	})
@@ -158,14 +180,18 @@ func TestBridge(tx *testing.T) {
 	holdModes := []string{kn.HOLD_MODE_UNDERFLOOR_ONLY, kn.HOLD_MODE_FAN_ONLY, kn.HOLD_MODE_UNDERFLOOR_AND_FAN}
 
 	for z := 1; z < 11; z++ {
-		simulateMessage(fmt.Sprintf("topicPrefix/TestModule/zone%d/fanMode/set", z), kn.FanMode2Str(kn.FAN_HIGH))
-		simulateMessage(fmt.Sprintf("topicPrefix/TestModule/zone%d/fanMode/set", z), kn.FanMode2Str(kn.FAN_MED))
-		simulateMessage(fmt.Sprintf("topicPrefix/TestModule/zone%d/fanMode/set", z), kn.FanMode2Str(kn.FAN_LOW))
-		simulateMessage(fmt.Sprintf("topicPrefix/TestModule/zone%d/fanMode/set", z), kn.FanMode2Str(kn.FAN_AUTO))
-		simulateMessage(fmt.Sprintf("topicPrefix/TestModule/zone%d/fanMode/set", z), "bad mode")
-		simulateMessage(fmt.Sprintf("topicPrefix/TestModule/zone%d/targetTemp/set", z), strconv.Itoa(20+z))
+		zoneTopic := fmt.Sprintf("topicPrefix/TestModule/zone%d", z)
+		if z == 10 {
+			zoneTopic = "topicPrefix/TestModule/office"
+		}
+		simulateMessage(zoneTopic+"/fanMode/set", kn.FanMode2Str(kn.FAN_HIGH))
+		simulateMessage(zoneTopic+"/fanMode/set", kn.FanMode2Str(kn.FAN_MED))
+		simulateMessage(zoneTopic+"/fanMode/set", kn.FanMode2Str(kn.FAN_LOW))
+		simulateMessage(zoneTopic+"/fanMode/set", kn.FanMode2Str(kn.FAN_AUTO))
+		simulateMessage(zoneTopic+"/fanMode/set", "bad mode")
+		simulateMessage(zoneTopic+"/targetTemp/set", strconv.Itoa(20+z))
 		for i := 0; i < len(hvacModes); i++ {
-			simulateMessage(fmt.Sprintf("topicPrefix/TestModule/zone%d/hvacMode/set", z), hvacModes[i])
+			simulateMessage(zoneTopic+"/hvacMode/set", hvacModes[i])
 			for j := 0; j < len(holdModes); j++ {
 				simulateMessage("topicPrefix/TestModule/sys/holdMode/set", holdModes[j])
 			}
@@ -191,3 +217,715 @@ func TestBridge(tx *testing.T) {
 	t.EqualsFile("current-temp.json", mqttClient.messages)
 
 }
+
+func TestAvailability(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mqttClient := NewMqttClientMock()
+	modbusClient := modbus.NewMock()
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:  "TestModule",
+		SlaveID:     49,
+		TopicPrefix: "topicPrefix",
+		HassPrefix:  "hassPrefix",
+		MaxFailures: 2,
+		Mqtt:        mqttClient,
+		Modbus:      modbusClient,
+	})
+	availabilityTopic := "topicPrefix/TestModule/availability"
+
+	t.Ok(b.Start())
+	t.Equals(Message{Topic: availabilityTopic, Payload: kn.AVAILABILITY_ONLINE}, *mqttClient.LastMessage())
+	for _, m := range mqttClient.messages {
+		if strings.HasSuffix(m.Topic, "/config") {
+			t.Equals(availabilityTopic, m.Payload.(map[string]interface{})["availability_topic"])
+		}
+	}
+
+	// the module goes offline after MaxFailures consecutive failed polls
+	state := modbusClient.State[49]
+	delete(modbusClient.State, 49)
+	mqttClient.Clear()
+	t.MustFail(b.Tick(), "expected polling an unknown slave to fail")
+	t.Equals(0, len(mqttClient.messages))
+	t.MustFail(b.Tick(), "expected polling an unknown slave to fail")
+	t.Equals([]Message{{Topic: availabilityTopic, Payload: kn.AVAILABILITY_OFFLINE}}, mqttClient.messages)
+	t.MustFail(b.Tick(), "expected polling an unknown slave to fail")
+	t.Equals(1, len(mqttClient.messages))
+
+	// and back online as soon as a poll succeeds
+	modbusClient.State[49] = state
+	mqttClient.Clear()
+	t.Ok(b.Tick())
+	t.Equals(Message{Topic: availabilityTopic, Payload: kn.AVAILABILITY_ONLINE}, mqttClient.messages[0])
+}
+
+func TestRetract(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mqttClient := NewMqttClientMock()
+	modbusClient := modbus.NewMock()
+	config := &kn.Config{
+		ModuleName:  "TestModule",
+		SlaveID:     49,
+		TopicPrefix: "topicPrefix",
+		HassPrefix:  "hassPrefix",
+		Mqtt:        mqttClient,
+		Modbus:      modbusClient,
+	}
+
+	// topics of zones that are not present anymore are cleared on start
+	mqttClient.retained = []string{
+		"hassPrefix/climate/TestModule/zone1/config",
+		"hassPrefix/climate/TestModule/zone12/config",
+		"topicPrefix/TestModule/zone1/currentTemp",
+		"topicPrefix/TestModule/zone12/currentTemp",
+	}
+	b := kn.NewBridge(config)
+	t.Ok(b.Start())
+	var cleared []string
+	for _, m := range mqttClient.messages {
+		if m.Payload == "" {
+			cleared = append(cleared, m.Topic)
+		}
+	}
+	t.Equals([]string{"hassPrefix/climate/TestModule/zone12/config", "topicPrefix/TestModule/zone12/currentTemp"}, cleared)
+
+	// the bridge must be restarted when a zone disappears
+	modbusClient.WriteRegister(49, 2*kn.REG_PER_ZONE+kn.REG_ENABLED, 0)
+	t.Equals(kn.ErrZonesChanged, b.Tick())
+
+	// a stopped bridge no longer receives commands
+	t.Assert(len(mqttClient.subscriptions) > 0, "expected subscriptions")
+	b.Stop()
+	t.Equals(0, len(mqttClient.subscriptions))
+
+	// and when a new zone appears
+	b = kn.NewBridge(config)
+	t.Ok(b.Start())
+	t.Ok(b.Tick())
+	modbusClient.WriteRegister(49, 10*kn.REG_PER_ZONE+kn.REG_ENABLED, 3)
+	t.Equals(kn.ErrZonesChanged, b.Tick())
+	b.Stop()
+
+	mqttClient.Clear()
+	n, err := kn.Purge(mqttClient, nil, "topicPrefix", "hassPrefix", "homiePrefix", "TestModule")
+	t.Ok(err)
+	t.Equals(4, n)
+	t.Equals(Message{Topic: "topicPrefix/TestModule/zone12/currentTemp", Payload: ""}, *mqttClient.LastMessage())
+}
+
+func TestChanges(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var changes []kn.Change
+	modbusClient := modbus.NewMock()
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:  "TestModule",
+		SlaveID:     49,
+		TopicPrefix: "topicPrefix",
+		HassPrefix:  "hassPrefix",
+		Mqtt:        NewMqttClientMock(),
+		Modbus:      modbusClient,
+		OnChange: func(change *kn.Change) {
+			t.Assert(!change.Time.IsZero(), "expected a timestamp")
+			change.Time = time.Time{}
+			changes = append(changes, *change)
+		},
+	})
+
+	// every value is reported on start
+	t.Ok(b.Start())
+	t.Assert(len(changes) > 0, "expected the initial state to be reported")
+	for _, c := range changes {
+		t.Equals(nil, c.Old)
+	}
+	t.Ok(b.Tick())
+
+	// values are only reported when they change
+	changes = nil
+	t.Ok(b.Tick())
+	t.Equals(0, len(changes))
+
+	t.Ok(b.SetTargetTemp(1, 23))
+	t.Equals([]kn.Change{{Module: "TestModule", Zone: 1, Attribute: "targetTemp", Old: float32(20.5), New: float32(23)}}, changes)
+
+	// changes made on the module are noticed on the next poll
+	changes = nil
+	modbusClient.State[49][2] = 44
+	t.Ok(b.Tick())
+	t.Equals([]kn.Change{{Module: "TestModule", Zone: 1, Attribute: "targetTemp", Old: float32(23), New: float32(22)}}, changes)
+
+	changes = nil
+	t.Ok(b.SetHoldMode(kn.HOLD_MODE_FAN_ONLY))
+	t.Equals(1, len(changes))
+	t.Equals("holdMode", changes[0].Attribute)
+	t.Equals(kn.HOLD_MODE_FAN_ONLY, changes[0].New)
+}
+
+// readRecorder counts how many times each register is read
+type readRecorder struct {
+	watcher.Modbus
+	reads map[uint16]int
+}
+
+func (m *readRecorder) ReadRegister(slaveID byte, address uint16, quantity uint16) ([]uint16, error) {
+	for n := uint16(0); n < quantity; n++ {
+		m.reads[address+n]++
+	}
+	return m.Modbus.ReadRegister(slaveID, address, quantity)
+}
+
+func TestAdaptivePolling(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var changes []string
+	modbusClient := modbus.NewMock()
+	recorder := &readRecorder{Modbus: modbusClient, reads: make(map[uint16]int)}
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:       "TestModule",
+		SlaveID:          49,
+		TopicPrefix:      "topicPrefix",
+		HassPrefix:       "hassPrefix",
+		PollInterval:     time.Second,
+		SysPollInterval:  time.Hour,
+		FastPollInterval: 100 * time.Millisecond,
+		Mqtt:             NewMqttClientMock(),
+		Modbus:           recorder,
+		OnChange: func(change *kn.Change) {
+			changes = append(changes, change.Attribute)
+		},
+	})
+	t.Ok(b.Start())
+	t.Ok(b.Tick())
+	t.Equals(time.Second, b.Interval())
+
+	// system registers are not polled again until SysPollInterval elapses
+	changes = nil
+	modbusClient.State[49][kn.REG_EFFICIENCY-1] = 5
+	t.Ok(b.Tick())
+	t.Equals(0, len(changes))
+
+	// a set command polls everything fast for a while
+	t.Ok(b.SetTargetTemp(1, 23))
+	t.Equals(100*time.Millisecond, b.Interval())
+	changes = nil
+	t.Ok(b.Tick())
+	t.Equals([]string{"efficiency"}, changes)
+
+	// the static serial configuration is only read on start
+	t.Equals(2, recorder.reads[kn.REG_EFFICIENCY])
+	t.Equals(1, recorder.reads[kn.REG_SERIAL_CONFIG])
+	t.Equals(1, recorder.reads[kn.REG_SLAVE_ID])
+
+	// and so does a change detected while polling
+	b = kn.NewBridge(&b.Config)
+	t.Ok(b.Start())
+	t.Equals(time.Second, b.Interval())
+	modbusClient.State[49][kn.REG_TARGET_TEMP-1] = 44
+	t.Ok(b.Tick())
+	t.Equals(100*time.Millisecond, b.Interval())
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "timeout" }
+func (timeoutError) Timeout() bool { return true }
+
+// unresponsiveModbus fails writes with err while it is set
+type unresponsiveModbus struct {
+	watcher.Modbus
+	err error
+}
+
+func (m *unresponsiveModbus) WriteRegister(slaveID byte, address uint16, value uint16) ([]uint16, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.Modbus.WriteRegister(slaveID, address, value)
+}
+
+func TestSetResult(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mqttClient := NewMqttClientMock()
+	modbusClient := &unresponsiveModbus{Modbus: modbus.NewMock()}
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:  "TestModule",
+		SlaveID:     49,
+		TopicPrefix: "topicPrefix",
+		HassPrefix:  "hassPrefix",
+		Mqtt:        mqttClient,
+		Modbus:      modbusClient,
+	})
+	t.Ok(b.Start())
+
+	result := func(topic, payload string) interface{} {
+		mqttClient.Clear()
+		mqttClient.simulateMessage(topic+"/set", payload)
+		last := mqttClient.LastMessage()
+		t.Equals(topic+"/set/result", last.Topic)
+		return last.Payload
+	}
+	topic := "topicPrefix/TestModule/zone1/targetTemp"
+
+	t.Equals(map[string]interface{}{"result": kn.SET_ACCEPTED, "requested": "23.5", "value": "23.5"}, result(topic, "23.50"))
+	// the actual value is republished
+	t.Equals(Message{Topic: topic, Payload: "23.5"}, mqttClient.messages[len(mqttClient.messages)-2])
+
+	t.Equals(map[string]interface{}{"result": kn.SET_REJECTED, "requested": "warm", "error": `invalid temperature "warm"`}, result(topic, "warm"))
+
+	modbusClient.err = &modbus.SupersededError{Value: 50}
+	t.Equals(map[string]interface{}{"result": kn.SET_SUPERSEDED, "requested": "24"}, result(topic, "24"))
+
+	modbusClient.err = timeoutError{}
+	t.Equals(map[string]interface{}{"result": kn.SET_TIMEOUT, "requested": "24", "error": "timeout"}, result(topic, "24"))
+}
+
+// recordingModbus records the writes it receives
+type recordingModbus struct {
+	watcher.Modbus
+	writes []string
+}
+
+func (m *recordingModbus) WriteRegister(slaveID byte, address uint16, value uint16) ([]uint16, error) {
+	m.writes = append(m.writes, fmt.Sprintf("%d=%d", address, value))
+	return m.Modbus.WriteRegister(slaveID, address, value)
+}
+
+func (m *recordingModbus) WriteRegisters(slaveID byte, address uint16, values []uint16) ([]uint16, error) {
+	m.writes = append(m.writes, fmt.Sprintf("%d=%v", address, values))
+	return m.Modbus.WriteRegisters(slaveID, address, values)
+}
+
+func TestSetZone(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	modbusClient := &recordingModbus{Modbus: modbus.NewMock()}
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:  "TestModule",
+		SlaveID:     49,
+		TopicPrefix: "topicPrefix",
+		HassPrefix:  "hassPrefix",
+		Mqtt:        NewMqttClientMock(),
+		Modbus:      modbusClient,
+	})
+	t.Ok(b.Start())
+
+	set := func(settings *kn.ZoneSettings) []string {
+		modbusClient.writes = nil
+		t.Ok(b.SetZone(1, settings))
+		return modbusClient.writes
+	}
+	off, heat := kn.HVAC_MODE_OFF, kn.HVAC_MODE_HEAT
+	low, high := "low", "high"
+	temp := float32(22)
+
+	// adjacent registers are written at once
+	t.Equals([]string{"1=[2 20]"}, set(&kn.ZoneSettings{HvacMode: &off, FanMode: &low}))
+	t.Equals([]string{"2=[52 44]"}, set(&kn.ZoneSettings{FanMode: &high, TargetTemp: &temp}))
+
+	// the mode is written between, so the others are written separately
+	t.Equals([]string{"82=4", "1=3", "3=44"}, set(&kn.ZoneSettings{HvacMode: &heat, TargetTemp: &temp}))
+
+	status, err := b.GetZoneStatus(1)
+	t.Ok(err)
+	t.Equals(kn.HVAC_MODE_HEAT, status.HvacMode)
+	t.Equals("high", status.FanMode)
+	t.Equals(float32(22), status.TargetTemp)
+
+	// nothing is written if a value is invalid
+	turbo := "turbo"
+	modbusClient.writes = nil
+	err = b.SetZone(1, &kn.ZoneSettings{TargetTemp: &temp, FanMode: &turbo})
+	t.Assert(errors.Is(err, kn.ErrInvalidFanMode), "expected ErrInvalidFanMode, got %v", err)
+	t.Equals([]string(nil), modbusClient.writes)
+}
+
+func TestZoneSet(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mqttClient := NewMqttClientMock()
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:  "TestModule",
+		SlaveID:     49,
+		TopicPrefix: "topicPrefix",
+		HassPrefix:  "hassPrefix",
+		Mqtt:        mqttClient,
+		Modbus:      modbus.NewMock(),
+	})
+	t.Ok(b.Start())
+	t.Ok(b.Tick())
+
+	topic := "topicPrefix/TestModule/zone1"
+	set := func(payload string) map[string]interface{} {
+		mqttClient.Clear()
+		mqttClient.simulateMessage(topic+"/set", payload)
+		last := mqttClient.LastMessage()
+		t.Equals(topic+"/set/result", last.Topic)
+		return last.Payload.(map[string]interface{})
+	}
+	lastState := func() interface{} {
+		for n := len(mqttClient.messages) - 1; n >= 0; n-- {
+			if mqttClient.messages[n].Topic == topic+"/state" {
+				return mqttClient.messages[n].Payload
+			}
+		}
+		return nil
+	}
+
+	result := set(`{"hvacMode":"off","targetTemp":22.5,"fanMode":"low"}`)
+	t.Equals(kn.SET_ACCEPTED, result["result"])
+	state := map[string]interface{}{
+		"zone":        1.0,
+		"name":        "TestModule_zone1",
+		"on":          false,
+		"hvacMode":    "off",
+		"currentTemp": 20.5,
+		"targetTemp":  22.5,
+		"fanMode":     "low",
+	}
+	t.Equals(state, result["state"])
+	// the zone state topic follows the changes
+	t.Equals(state, lastState())
+
+	// the module only stores half degrees
+	result = set(`{"targetTemp":21.3}`)
+	t.Equals(kn.SET_CLAMPED, result["result"])
+	t.Equals(21.0, result["state"].(map[string]interface{})["targetTemp"])
+	t.Equals(result["state"], lastState())
+
+	// commands are validated as a whole
+	result = set(`{"targetTemp":23,"fanMode":"turbo"}`)
+	t.Equals(map[string]interface{}{"result": kn.SET_REJECTED, "error": `Unknown fan mode "turbo"`}, result)
+	result = set(`{"temp":20}`)
+	t.Equals(kn.SET_REJECTED, result["result"])
+	t.Assert(strings.HasPrefix(result["error"].(string), "invalid zone settings"), "unexpected error %v", result["error"])
+	t.Equals(nil, lastState())
+}
+
+func TestModuleState(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	recorder := &stateRecorder{
+		topic:    "topicPrefix/TestModule/state",
+		messages: make(chan string, 100),
+	}
+	expect := func() *kn.ModuleState {
+		select {
+		case payload := <-recorder.messages:
+			var state kn.ModuleState
+			t.Ok(json.Unmarshal([]byte(payload), &state))
+			return &state
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for the module state")
+		}
+		return nil
+	}
+
+	modbusClient := modbus.NewMock()
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:    "TestModule",
+		SlaveID:       49,
+		TopicPrefix:   "topicPrefix",
+		HassPrefix:    "hassPrefix",
+		Output:        kn.OUTPUT_JSON,
+		StateDebounce: 10 * time.Millisecond,
+		Mqtt:          recorder,
+		Modbus:        modbusClient,
+	})
+	t.Ok(b.Start())
+	t.Ok(b.Tick())
+
+	state := expect()
+	t.Equals("TestModule", state.Module)
+	t.Assert(!state.Time.IsZero(), "expected a timestamp")
+	t.Assert(state.Sys != nil, "expected the system state")
+	t.Equals(b.ZoneStatus(), state.Zones)
+
+	// changes detected by the same poll are published together
+	modbusClient.State[49][2] = 44
+	modbusClient.State[49][6] = 46
+	t.Ok(b.Tick())
+	state = expect()
+	t.Equals(float32(22), state.Zones[0].TargetTemp)
+	t.Equals(float32(23), state.Zones[1].TargetTemp)
+	select {
+	case payload := <-recorder.messages:
+		t.Fatalf("unexpected state %s", payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a stopped bridge does not publish the changes it was waiting for
+	modbusClient.State[49][2] = 46
+	t.Ok(b.Tick())
+	b.Stop()
+	select {
+	case payload := <-recorder.messages:
+		t.Fatalf("unexpected state %s", payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the initial state is published even if Start takes longer than StateDebounce
+	b = kn.NewBridge(&kn.Config{
+		ModuleName:    "TestModule",
+		SlaveID:       49,
+		TopicPrefix:   "topicPrefix",
+		HassPrefix:    "hassPrefix",
+		Output:        kn.OUTPUT_TOPICS + "," + kn.OUTPUT_JSON,
+		StateDebounce: 10 * time.Millisecond,
+		Mqtt:          &slowPublisher{MqttClient: recorder, topic: "topicPrefix/TestModule/sys/slaveId", delay: 100 * time.Millisecond},
+		Modbus:        modbusClient,
+	})
+	t.Ok(b.Start())
+	state = expect()
+	t.Equals(float32(23), state.Zones[1].TargetTemp)
+	b.Stop()
+}
+
+// slowPublisher delays the messages of one topic
+type slowPublisher struct {
+	kn.MqttClient
+	topic string
+	delay time.Duration
+}
+
+func (p *slowPublisher) Publish(topic string, qos byte, retained bool, payload string) error {
+	if topic == p.topic {
+		time.Sleep(p.delay)
+	}
+	return p.MqttClient.Publish(topic, qos, retained, payload)
+}
+
+func TestHomie(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mqttClient := NewMqttClientMock()
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:  "TestModule",
+		SlaveID:     49,
+		TopicPrefix: "topicPrefix",
+		HassPrefix:  "hassPrefix",
+		Output:      kn.OUTPUT_HOMIE,
+		Mqtt:        mqttClient,
+		Modbus:      modbus.NewMock(),
+	})
+	t.Ok(b.Start())
+	t.Ok(b.Tick())
+
+	last := make(map[string]interface{})
+	for _, m := range mqttClient.messages {
+		last[m.Topic] = m.Payload
+		// the topic tree and Home Assistant discovery are disabled
+		t.Assert(strings.HasPrefix(m.Topic, "homie/") || m.Topic == "topicPrefix/TestModule/availability", "unexpected topic %s", m.Topic)
+	}
+	device := "homie/test-module"
+	t.Equals("4.0", last[device+"/$homie"])
+	t.Equals("TestModule", last[device+"/$name"])
+	t.Equals(kn.HOMIE_STATE_READY, last[device+"/$state"])
+	t.Assert(strings.HasPrefix(last[device+"/$nodes"].(string), "zone1,zone2,"), "unexpected nodes %v", last[device+"/$nodes"])
+	t.Assert(strings.HasSuffix(last[device+"/$nodes"].(string), ",ac1,ac2,ac3,ac4,sys"), "unexpected nodes %v", last[device+"/$nodes"])
+	t.Equals("hvac-mode,current-temp,target-temp,fan-mode", last[device+"/zone1/$properties"])
+	t.Equals("enum", last[device+"/zone1/hvac-mode/$datatype"])
+	t.Equals("off,cool,heat", last[device+"/zone1/hvac-mode/$format"])
+	t.Equals("true", last[device+"/zone1/hvac-mode/$settable"])
+	t.Equals("15:35", last[device+"/zone1/target-temp/$format"])
+	t.Equals("°C", last[device+"/zone1/target-temp/$unit"])
+	t.Equals(nil, last[device+"/zone1/current-temp/$settable"])
+	t.Equals("20.5", last[device+"/zone1/target-temp"])
+	t.Equals("off,low,medium,high,auto", last[device+"/ac1/fan-mode/$format"])
+	t.Equals("underfloor,fan,underfloor and fan", last[device+"/sys/hold-mode/$format"])
+
+	// properties are set through their set topics
+	mqttClient.Clear()
+	mqttClient.simulateMessage(device+"/zone1/target-temp/set", "23")
+	t.Equals(Message{Topic: device + "/zone1/target-temp", Payload: "23"}, mqttClient.messages[0])
+}
+
+// mqtt5ClientMock records the user properties of published messages and lets tests
+// send set commands that expect a response
+type mqtt5ClientMock struct {
+	*MqttClientMock
+	properties map[string]map[string]string
+	policies   map[string]kn.Policy // QoS and retain flag of the last message of every topic
+	requests   map[string]func(message string, respond func(payload string) error)
+	qos        map[string]byte // QoS of every request subscription
+}
+
+func (m *mqtt5ClientMock) PublishWithProperties(topic string, qos byte, retained bool, payload string, properties map[string]string) error {
+	m.properties[topic] = properties
+	m.policies[topic] = kn.Policy{QoS: qos, Retained: retained}
+	return m.Publish(topic, qos, retained, payload)
+}
+
+func (m *mqtt5ClientMock) SubscribeRequests(topic string, qos byte, callback func(message string, respond func(payload string) error)) error {
+	m.requests[topic] = callback
+	m.qos[topic] = qos
+	return nil
+}
+
+func newMqtt5ClientMock() *mqtt5ClientMock {
+	return &mqtt5ClientMock{
+		MqttClientMock: NewMqttClientMock(),
+		properties:     make(map[string]map[string]string),
+		policies:       make(map[string]kn.Policy),
+		requests:       make(map[string]func(string, func(string) error)),
+		qos:            make(map[string]byte),
+	}
+}
+
+func TestMqtt5(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mqttClient := newMqtt5ClientMock()
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:  "TestModule",
+		SlaveID:     49,
+		TopicPrefix: "topicPrefix",
+		HassPrefix:  "hassPrefix",
+		Mqtt:        mqttClient,
+		Modbus:      modbus.NewMock(),
+	})
+	t.Ok(b.Start())
+	t.Ok(b.Tick())
+
+	// messages are tagged with the module, zone and attribute they are about
+	topic := "topicPrefix/TestModule/zone1/targetTemp"
+	t.Equals(map[string]string{"module": "TestModule", "zone": "1", "attribute": "targetTemp"}, mqttClient.properties[topic])
+	t.Equals(map[string]string{"module": "TestModule", "zone": "1"}, mqttClient.properties["topicPrefix/TestModule/zone1/state"])
+	t.Equals(map[string]string{"module": "TestModule", "attribute": "holdMode"}, mqttClient.properties["topicPrefix/TestModule/sys/holdMode"])
+	t.Equals(map[string]string{"module": "TestModule"}, mqttClient.properties["topicPrefix/TestModule/availability"])
+
+	// set commands are subscribed as requests, and their outcome is also sent as a response
+	t.Assert(mqttClient.subscriptions[topic+"/set"] == nil, "expected set commands to be subscribed as requests")
+	var response string
+	mqttClient.Clear()
+	mqttClient.requests[topic+"/set"]("23.5", func(payload string) error {
+		response = payload
+		return nil
+	})
+	t.Equals(`{"result":"accepted","requested":"23.5","value":"23.5"}`, response)
+	t.Equals(topic+"/set/result", mqttClient.LastMessage().Topic)
+
+	response = ""
+	mqttClient.requests["topicPrefix/TestModule/zone1/set"](`{"fanMode":"turbo"}`, func(payload string) error {
+		response = payload
+		return nil
+	})
+	t.Equals(`{"result":"rejected","error":"Unknown fan mode \"turbo\""}`, response)
+
+	// without a response topic, the outcome is only published to the result topic
+	mqttClient.Clear()
+	mqttClient.requests[topic+"/set"]("24", nil)
+	t.Equals(topic+"/set/result", mqttClient.LastMessage().Topic)
+}
+
+func TestPolicies(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mqttClient := newMqtt5ClientMock()
+	currentTempTopic := "topicPrefix/TestModule/zone1/currentTemp"
+	// left by a previous run that retained the telemetry
+	mqttClient.retained = []string{currentTempTopic}
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:  "TestModule",
+		SlaveID:     49,
+		TopicPrefix: "topicPrefix",
+		HassPrefix:  "hassPrefix",
+		Policies: map[string]kn.Policy{
+			kn.CLASS_TELEMETRY: {QoS: 0, Retained: false},
+			kn.CLASS_COMMANDS:  {QoS: 1, Retained: false},
+		},
+		Mqtt:   mqttClient,
+		Modbus: modbus.NewMock(),
+	})
+	t.Ok(b.Start())
+	// telemetry is no longer retained, so the retained message is retracted
+	t.Equals(Message{Topic: currentTempTopic, Payload: ""}, *mqttClient.LastMessage())
+	t.Ok(b.Tick())
+
+	retained := kn.Policy{QoS: 0, Retained: true}
+	t.Equals(kn.Policy{QoS: 0, Retained: false}, mqttClient.policies[currentTempTopic])
+	t.Equals(kn.Policy{QoS: 0, Retained: false}, mqttClient.policies["topicPrefix/TestModule/sys/ac1/airflow"])
+	t.Equals(retained, mqttClient.policies["topicPrefix/TestModule/zone1/targetTemp"])
+	t.Equals(retained, mqttClient.policies["topicPrefix/TestModule/zone1/state"])
+	t.Equals(retained, mqttClient.policies["topicPrefix/TestModule/availability"])
+	t.Equals(retained, mqttClient.policies["hassPrefix/climate/TestModule/zone1/config"])
+
+	// set topics are subscribed, and their results published, with the QoS of commands
+	topic := "topicPrefix/TestModule/zone1/targetTemp"
+	t.Equals(byte(1), mqttClient.qos[topic+"/set"])
+	t.Equals(byte(1), mqttClient.qos["topicPrefix/TestModule/zone1/set"])
+	mqttClient.requests[topic+"/set"]("22", nil)
+	t.Equals(kn.Policy{QoS: 1, Retained: false}, mqttClient.policies[topic+"/set/result"])
+}
+
+// classMqttClientMock records the topic class of published messages
+type classMqttClientMock struct {
+	*mqtt5ClientMock
+	classes map[string]string
+}
+
+func (m *classMqttClientMock) PublishClass(class, topic string, qos byte, retained bool, payload string, properties map[string]string) error {
+	m.classes[topic] = class
+	return m.PublishWithProperties(topic, qos, retained, payload, properties)
+}
+
+func TestTopicClasses(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mqttClient := &classMqttClientMock{mqtt5ClientMock: newMqtt5ClientMock(), classes: make(map[string]string)}
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:  "TestModule",
+		SlaveID:     49,
+		TopicPrefix: "topicPrefix",
+		HassPrefix:  "hassPrefix",
+		Mqtt:        mqttClient,
+		Modbus:      modbus.NewMock(),
+	})
+	t.Ok(b.Start())
+	t.Ok(b.Tick())
+
+	topic := "topicPrefix/TestModule/zone1/targetTemp"
+	t.Equals(kn.CLASS_STATE, mqttClient.classes[topic])
+	t.Equals(kn.CLASS_STATE, mqttClient.classes["topicPrefix/TestModule/zone1/state"])
+	t.Equals(kn.CLASS_TELEMETRY, mqttClient.classes["topicPrefix/TestModule/zone1/currentTemp"])
+	t.Equals(kn.CLASS_AVAILABILITY, mqttClient.classes["topicPrefix/TestModule/availability"])
+	t.Equals(kn.CLASS_DISCOVERY, mqttClient.classes["hassPrefix/climate/TestModule/zone1/config"])
+	t.Equals(map[string]string{"module": "TestModule", "zone": "1", "attribute": "targetTemp"}, mqttClient.properties[topic])
+	mqttClient.requests[topic+"/set"]("22", nil)
+	t.Equals(kn.CLASS_COMMANDS, mqttClient.classes[topic+"/set/result"])
+
+	// stale topics are cleared with the QoS of their class
+	staleConfig := "hassPrefix/climate/TestModule/zone12/config"
+	staleTemp := "topicPrefix/TestModule/zone12/currentTemp"
+	staleHomie := "homie/testmodule/zone-12/$name"
+	mqttClient.retained = []string{staleConfig, staleTemp, staleHomie}
+	retracting := kn.NewBridge(&kn.Config{
+		ModuleName:  "TestModule",
+		SlaveID:     49,
+		TopicPrefix: "topicPrefix",
+		HassPrefix:  "hassPrefix",
+		Policies:    map[string]kn.Policy{kn.CLASS_DISCOVERY: {QoS: 1, Retained: true}},
+		Mqtt:        mqttClient,
+		Modbus:      modbus.NewMock(),
+	})
+	t.Ok(retracting.Start())
+	t.Equals(kn.CLASS_DISCOVERY, mqttClient.classes[staleConfig])
+	t.Equals(kn.Policy{QoS: 1, Retained: true}, mqttClient.policies[staleConfig])
+	t.Equals(kn.CLASS_TELEMETRY, mqttClient.classes[staleTemp])
+	t.Equals(kn.Policy{QoS: 0, Retained: true}, mqttClient.policies[staleTemp])
+	t.Equals(kn.CLASS_DISCOVERY, mqttClient.classes[staleHomie])
+}
@@ -25,6 +25,8 @@ const FIRST_ZONE_REGISTER = REG_ENABLED
 const TOTAL_ZONE_REGISTERS = NUM_ZONES * REG_PER_ZONE
 const FIRST_SYS_REGISTER = REG_AIRFLOW
 const TOTAL_SYS_REGISTERS = 18
+const FIRST_STATIC_REGISTER = REG_SERIAL_CONFIG
+const TOTAL_STATIC_REGISTERS = 2
 
 type FanMode byte
 
@@ -61,6 +63,13 @@ const AC4 ACMachine = 4
 
 const HA_COMPONENT_SENSOR = "sensor"
 const HA_COMPONENT_CLIMATE = "climate"
+const HA_COMPONENT_BINARY_SENSOR = "binary_sensor"
+
+const AVAILABILITY_ONLINE = "online"
+const AVAILABILITY_OFFLINE = "offline"
+
+const HA_MANUFACTURER = "Koolnova"
+const HA_MODEL = "100-CPND00"
 
 func FanMode2Str(fm FanMode) string {
 	switch fm {
@@ -0,0 +1,226 @@
+package kn
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrNotStarted = errors.New("Bridge not started")
+var ErrUnknownZone = errors.New("Unknown zone")
+var ErrInvalidTemperature = errors.New("Target temperature out of range")
+var ErrInvalidFanMode = errors.New("Unknown fan mode")
+var ErrInvalidHvacMode = errors.New("Unknown HVAC mode")
+var ErrInvalidHoldMode = errors.New("Unknown hold mode")
+
+// ZoneStatus is a snapshot of the state of a zone, with the same values
+// that are published to the zone's topics
+type ZoneStatus struct {
+	Zone        int     `json:"zone"`
+	Name        string  `json:"name"`
+	On          bool    `json:"on"`
+	HvacMode    string  `json:"hvacMode"`
+	CurrentTemp float32 `json:"currentTemp"`
+	TargetTemp  float32 `json:"targetTemp"`
+	FanMode     string  `json:"fanMode"`
+}
+
+// MachineStatus is a snapshot of the state of an AC machine
+type MachineStatus struct {
+	Machine    ACMachine `json:"machine"`
+	Airflow    int       `json:"airflow"`
+	TargetTemp float32   `json:"targetTemp"`
+	FanMode    string    `json:"fanMode"`
+}
+
+// SysStatus is a snapshot of the system registers of a module, with the same
+// values that are published to the sys topics
+type SysStatus struct {
+	Enabled      bool            `json:"enabled"`
+	HoldMode     string          `json:"holdMode"`
+	Efficiency   int             `json:"efficiency"`
+	SerialBaud   int             `json:"serialBaud"`
+	SerialParity string          `json:"serialParity"`
+	SlaveID      int             `json:"slaveId"`
+	Machines     []MachineStatus `json:"machines"`
+}
+
+// ZoneStatus returns the state of all present zones. It is safe to call it
+// concurrently with Tick.
+func (b *Bridge) ZoneStatus() []ZoneStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	status := make([]ZoneStatus, 0, len(b.zones))
+	for _, z := range b.zones {
+		status = append(status, b.zoneStatus(z))
+	}
+	return status
+}
+
+// zoneStatus returns the state of a zone. b.lock must be held.
+func (b *Bridge) zoneStatus(z *Zone) ZoneStatus {
+	currentTemp := z.lastTemp
+	if z.temp.Count() == 0 {
+		currentTemp = z.getCurrentTemperature()
+	}
+	return ZoneStatus{
+		Zone:        z.ZoneNumber,
+		Name:        b.getZoneName(z.ZoneNumber, ""),
+		On:          z.isOn(),
+		HvacMode:    b.getHvacMode(z),
+		CurrentTemp: currentTemp,
+		TargetTemp:  z.getTargetTemperature(),
+		FanMode:     FanMode2Str(z.getFanMode()),
+	}
+}
+
+// GetZoneStatus returns the state of a present zone
+func (b *Bridge) GetZoneStatus(zoneNum int) (*ZoneStatus, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	z, err := b.getZone(zoneNum)
+	if err != nil {
+		return nil, err
+	}
+	status := b.zoneStatus(z)
+	return &status, nil
+}
+
+// SysStatus returns the state of the system registers
+func (b *Bridge) SysStatus() (*SysStatus, error) {
+	sys, err := b.getSys()
+	if err != nil {
+		return nil, err
+	}
+	status := &SysStatus{
+		Enabled:      sys.GetSystemEnabled(),
+		HoldMode:     sys.HoldMode(),
+		Efficiency:   sys.GetEfficiency(),
+		SerialBaud:   sys.GetBaudRate(),
+		SerialParity: sys.GetParity(),
+		SlaveID:      sys.GetSlaveID(),
+	}
+	for ac := AC1; ac <= ACMachines; ac++ {
+		status.Machines = append(status.Machines, MachineStatus{
+			Machine:    ac,
+			Airflow:    sys.GetAirflow(ac),
+			TargetTemp: sys.GetMachineTargetTemp(ac),
+			FanMode:    FanMode2Str(sys.GetTargetFanMode(ac)),
+		})
+	}
+	return status, nil
+}
+
+// getZone returns a present zone. b.lock must be held.
+func (b *Bridge) getZone(zoneNum int) (*Zone, error) {
+	for _, z := range b.zones {
+		if z.ZoneNumber == zoneNum {
+			return z, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %d", ErrUnknownZone, zoneNum)
+}
+
+// lockedZone returns a present zone
+func (b *Bridge) lockedZone(zoneNum int) (*Zone, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.getZone(zoneNum)
+}
+
+func (b *Bridge) getSys() (*SysDriver, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.started {
+		return nil, ErrNotStarted
+	}
+	return b.sys, nil
+}
+
+// ZoneSettings are attributes of a zone to change at once. Nil fields are left unchanged.
+type ZoneSettings struct {
+	HvacMode   *string  `json:"hvacMode"`
+	TargetTemp *float32 `json:"targetTemp"`
+	FanMode    *string  `json:"fanMode"`
+}
+
+// SetZone changes several attributes of a zone at once, writing adjacent registers
+// together. Nothing is written unless all values are valid.
+func (b *Bridge) SetZone(zoneNum int, settings *ZoneSettings) error {
+	z, err := b.lockedZone(zoneNum)
+	if err != nil {
+		return err
+	}
+	targetTemp := settings.TargetTemp
+	if targetTemp != nil && (*targetTemp < b.MinTemp || *targetTemp > b.MaxTemp) {
+		return fmt.Errorf("%w: %g is not between %g and %g", ErrInvalidTemperature, *targetTemp, b.MinTemp, b.MaxTemp)
+	}
+	var fanMode *FanMode
+	if settings.FanMode != nil {
+		fm, err := Str2FanMode(*settings.FanMode)
+		if err != nil {
+			return fmt.Errorf("%w %q", ErrInvalidFanMode, *settings.FanMode)
+		}
+		fanMode = &fm
+	}
+	var on *bool
+	if settings.HvacMode != nil {
+		switch *settings.HvacMode {
+		case HVAC_MODE_OFF, HVAC_MODE_COOL, HVAC_MODE_HEAT:
+		default:
+			return fmt.Errorf("%w %q", ErrInvalidHvacMode, *settings.HvacMode)
+		}
+		enabled := *settings.HvacMode != HVAC_MODE_OFF
+		on = &enabled
+	}
+	b.accelerate()
+
+	if on != nil && *on {
+		// Translate HA HVAC mode to Koolnova's. Heating and cooling are selected for the whole module.
+		sys, err := b.getSys()
+		if err != nil {
+			return err
+		}
+		b.modeLock.Lock()
+		knMode := ApplyHvacMode(sys.GetSystemKNMode(), *settings.HvacMode)
+		err = sys.SetSystemKNMode(knMode)
+		b.modeLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return z.update(on, fanMode, targetTemp)
+}
+
+// SetTargetTemp sets the target temperature of a zone
+func (b *Bridge) SetTargetTemp(zoneNum int, targetTemp float32) error {
+	return b.SetZone(zoneNum, &ZoneSettings{TargetTemp: &targetTemp})
+}
+
+// SetFanMode sets the fan mode of a zone, such as "auto" or "low"
+func (b *Bridge) SetFanMode(zoneNum int, fanMode string) error {
+	return b.SetZone(zoneNum, &ZoneSettings{FanMode: &fanMode})
+}
+
+// SetHvacMode turns a zone off, or on in heating or cooling mode. Heating and
+// cooling are selected for the whole module.
+func (b *Bridge) SetHvacMode(zoneNum int, hvacMode string) error {
+	return b.SetZone(zoneNum, &ZoneSettings{HvacMode: &hvacMode})
+}
+
+// SetHoldMode selects whether the module uses underfloor heating, fans or both
+func (b *Bridge) SetHoldMode(holdMode string) error {
+	sys, err := b.getSys()
+	if err != nil {
+		return err
+	}
+	switch holdMode {
+	case HOLD_MODE_UNDERFLOOR_ONLY, HOLD_MODE_FAN_ONLY, HOLD_MODE_UNDERFLOOR_AND_FAN:
+	default:
+		return fmt.Errorf("%w %q", ErrInvalidHoldMode, holdMode)
+	}
+	b.accelerate()
+	b.modeLock.Lock()
+	defer b.modeLock.Unlock()
+	knMode := ApplyHoldMode(sys.GetSystemKNMode(), holdMode)
+	return sys.SetSystemKNMode(knMode)
+}
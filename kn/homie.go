@@ -0,0 +1,196 @@
+package kn
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Homie 4.0 convention, see https://homieiot.github.io/specification/spec-core-v4_0_0/
+const HOMIE_VERSION = "4.0"
+const DEFAULT_HOMIE_PREFIX = "homie"
+
+// HOMIE_SYS_NODE is the ID of the Homie node with the system registers
+const HOMIE_SYS_NODE = "sys"
+
+// States of a Homie device. There is no "lost" state: MQTT allows a single last will per
+// connection, which the MQTT client uses for its status topic.
+const HOMIE_STATE_INIT = "init"                 // the device is publishing its attributes
+const HOMIE_STATE_READY = "ready"               // the module is online
+const HOMIE_STATE_ALERT = "alert"               // the module is offline
+const HOMIE_STATE_DISCONNECTED = "disconnected" // koolnova2mqtt stopped the bridge
+
+// Data types of Homie properties
+const HOMIE_INTEGER = "integer"
+const HOMIE_FLOAT = "float"
+const HOMIE_BOOLEAN = "boolean"
+const HOMIE_STRING = "string"
+const HOMIE_ENUM = "enum"
+
+// homieNode describes a node of a Homie device: a zone, an AC machine or the system
+type homieNode struct {
+	id         string
+	name       string
+	nodeType   string
+	zoneNum    int // zero for system nodes
+	properties []homieProperty
+}
+
+// homieProperty describes a property of a Homie node, published from an attribute of a zone
+// or of the system
+type homieProperty struct {
+	attribute string // such as "targetTemp" or "ac1/airflow"
+	name      string
+	datatype  string
+	format    string
+	unit      string
+	settable  bool
+}
+
+// HomieID converts a name such as "firstFloor" or "zone_1" to a Homie topic ID,
+// which only allows lowercase letters, digits and hyphens, such as "first-floor" or "zone-1"
+func HomieID(name string) string {
+	var id strings.Builder
+	hyphen := true // do not start with a hyphen
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= '0' && r <= '9':
+			id.WriteRune(r)
+			hyphen = false
+		case r >= 'A' && r <= 'Z':
+			if !hyphen {
+				id.WriteByte('-')
+			}
+			id.WriteRune(r - 'A' + 'a')
+			hyphen = false
+		case !hyphen:
+			id.WriteByte('-')
+			hyphen = true
+		}
+	}
+	return strings.TrimSuffix(id.String(), "-")
+}
+
+// homieACNode returns the ID of the Homie node of an AC machine
+func homieACNode(ac ACMachine) string {
+	return fmt.Sprintf("ac%d", ac)
+}
+
+// HomieSystemNodes returns the IDs of the nodes of a module's Homie device that are not
+// zones, which zone slugs must not turn into
+func HomieSystemNodes() []string {
+	nodes := []string{HOMIE_SYS_NODE}
+	for ac := AC1; ac <= ACMachines; ac++ {
+		nodes = append(nodes, homieACNode(ac))
+	}
+	return nodes
+}
+
+// getHomieDevice returns the base topic of the module's Homie device
+func (b *Bridge) getHomieDevice() string {
+	return fmt.Sprintf("%s/%s", b.HomiePrefix, HomieID(b.ModuleName))
+}
+
+// homieNodes returns the nodes of the module's Homie device
+func (b *Bridge) homieNodes(zones []*Zone) []homieNode {
+	var fanModes []string
+	for fm := FAN_OFF; fm <= FAN_AUTO; fm++ {
+		fanModes = append(fanModes, FanMode2Str(fm))
+	}
+	fanModeFormat := strings.Join(fanModes, ",")
+
+	var nodes []homieNode
+	for _, zone := range zones {
+		nodes = append(nodes, homieNode{
+			id:       HomieID(b.getZoneSlug(zone.ZoneNumber)),
+			name:     b.getZoneName(zone.ZoneNumber, ""),
+			nodeType: "zone",
+			zoneNum:  zone.ZoneNumber,
+			properties: []homieProperty{
+				{attribute: "hvacMode", name: "HVAC mode", datatype: HOMIE_ENUM, format: strings.Join([]string{HVAC_MODE_OFF, HVAC_MODE_COOL, HVAC_MODE_HEAT}, ","), settable: true},
+				{attribute: "currentTemp", name: "Current temperature", datatype: HOMIE_FLOAT, unit: "°C"},
+				{attribute: "targetTemp", name: "Target temperature", datatype: HOMIE_FLOAT, format: fmt.Sprintf("%g:%g", b.MinTemp, b.MaxTemp), unit: "°C", settable: true},
+				{attribute: "fanMode", name: "Fan mode", datatype: HOMIE_ENUM, format: fanModeFormat, settable: true},
+			},
+		})
+	}
+	for ac := AC1; ac <= ACMachines; ac++ {
+		nodes = append(nodes, homieNode{
+			id:       homieACNode(ac),
+			name:     fmt.Sprintf("AC machine %d", ac),
+			nodeType: "AC machine",
+			properties: []homieProperty{
+				{attribute: acAttribute(ac, "airflow"), name: "Airflow", datatype: HOMIE_INTEGER},
+				{attribute: acAttribute(ac, "targetTemp"), name: "Target temperature", datatype: HOMIE_FLOAT, unit: "°C"},
+				{attribute: acAttribute(ac, "fanMode"), name: "Fan mode", datatype: HOMIE_ENUM, format: fanModeFormat},
+			},
+		})
+	}
+	nodes = append(nodes, homieNode{
+		id:       HOMIE_SYS_NODE,
+		name:     "System",
+		nodeType: "system",
+		properties: []homieProperty{
+			{attribute: "enabled", name: "Enabled", datatype: HOMIE_BOOLEAN},
+			{attribute: "holdMode", name: "Hold mode", datatype: HOMIE_ENUM, format: strings.Join([]string{HOLD_MODE_UNDERFLOOR_ONLY, HOLD_MODE_FAN_ONLY, HOLD_MODE_UNDERFLOOR_AND_FAN}, ","), settable: true},
+			{attribute: "efficiency", name: "Efficiency", datatype: HOMIE_INTEGER},
+			{attribute: "serialBaud", name: "Serial baud rate", datatype: HOMIE_INTEGER},
+			{attribute: "serialParity", name: "Serial parity", datatype: HOMIE_STRING},
+			{attribute: "slaveId", name: "Slave ID", datatype: HOMIE_INTEGER},
+		},
+	})
+	return nodes
+}
+
+// publishHomieDevice publishes the attributes of the module's Homie device in the init state,
+// and maps the topic of every attribute to its Homie property. Values are published to both
+// by publishState. The device becomes ready when the module is online.
+func (b *Bridge) publishHomieDevice(zones []*Zone) {
+	device := b.getHomieDevice()
+	nodes := b.homieNodes(zones)
+	b.homieTopics = make(map[string]string)
+
+	b.publish(CLASS_DISCOVERY, device+"/$homie", HOMIE_VERSION)
+	b.publish(CLASS_AVAILABILITY, device+"/$state", HOMIE_STATE_INIT)
+	b.publish(CLASS_DISCOVERY, device+"/$name", b.ModuleName)
+	var nodeIDs []string
+	for _, node := range nodes {
+		nodeIDs = append(nodeIDs, node.id)
+	}
+	b.publish(CLASS_DISCOVERY, device+"/$nodes", strings.Join(nodeIDs, ","))
+	// $extensions is empty, which cannot be published as a retained message
+
+	for _, node := range nodes {
+		nodeTopic := device + "/" + node.id
+		b.publish(CLASS_DISCOVERY, nodeTopic+"/$name", node.name)
+		b.publish(CLASS_DISCOVERY, nodeTopic+"/$type", node.nodeType)
+		var propertyIDs []string
+		for _, property := range node.properties {
+			attribute := property.attribute[strings.LastIndex(property.attribute, "/")+1:]
+			id := HomieID(attribute)
+			propertyIDs = append(propertyIDs, id)
+			topic := nodeTopic + "/" + id
+			b.homieTopics[b.getTopic(node.zoneNum, property.attribute)] = topic
+
+			b.publish(CLASS_DISCOVERY, topic+"/$name", property.name)
+			b.publish(CLASS_DISCOVERY, topic+"/$datatype", property.datatype)
+			if property.format != "" {
+				b.publish(CLASS_DISCOVERY, topic+"/$format", property.format)
+			}
+			if property.unit != "" {
+				b.publish(CLASS_DISCOVERY, topic+"/$unit", property.unit)
+			}
+			if property.settable {
+				b.publish(CLASS_DISCOVERY, topic+"/$settable", "true")
+			}
+		}
+		b.publish(CLASS_DISCOVERY, nodeTopic+"/$properties", strings.Join(propertyIDs, ","))
+	}
+	b.homieDevice = device
+}
+
+// setHomieState publishes the state of the Homie device, once its attributes were published
+func (b *Bridge) setHomieState(state string) {
+	if b.homieDevice != "" {
+		b.publish(CLASS_AVAILABILITY, b.homieDevice+"/$state", state)
+	}
+}
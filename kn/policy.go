@@ -0,0 +1,63 @@
+package kn
+
+import (
+	"strings"
+)
+
+// Topic classes, which select the QoS and retain flag of the messages of a bridge
+const CLASS_DISCOVERY = "discovery"       // Home Assistant discovery configuration and Homie device attributes
+const CLASS_STATE = "state"               // settings of the zones and the system, and the JSON state documents
+const CLASS_TELEMETRY = "telemetry"       // measurements, such as the current temperature of the zones
+const CLASS_COMMANDS = "commands"         // results of set commands, and subscriptions to set topics
+const CLASS_AVAILABILITY = "availability" // availability and status of the module, and the state of its Homie device
+
+// Classes lists all topic classes
+var Classes = []string{CLASS_DISCOVERY, CLASS_STATE, CLASS_TELEMETRY, CLASS_COMMANDS, CLASS_AVAILABILITY}
+
+// Policy is how the messages of a topic class are published. For CLASS_COMMANDS,
+// QoS is also the QoS of the subscriptions to set topics.
+type Policy struct {
+	QoS      byte
+	Retained bool
+}
+
+// DefaultPolicies are the policies of the topic classes that Config.Policies does not define
+var DefaultPolicies = map[string]Policy{
+	CLASS_DISCOVERY:    {QoS: 0, Retained: true},
+	CLASS_STATE:        {QoS: 0, Retained: true},
+	CLASS_TELEMETRY:    {QoS: 0, Retained: true},
+	CLASS_COMMANDS:     {QoS: 0, Retained: false},
+	CLASS_AVAILABILITY: {QoS: 0, Retained: true},
+}
+
+// telemetryAttributes are the attributes measured by the module, rather than set by its users
+var telemetryAttributes = map[string]bool{"currentTemp": true, "airflow": true, "efficiency": true}
+
+// topicClass returns the topic class of a retained topic of a module, such as one to retract
+func topicClass(topic, hassPrefix string) string {
+	last := topic[strings.LastIndex(topic, "/")+1:]
+	switch {
+	case strings.HasPrefix(topic, hassPrefix+"/"):
+		return CLASS_DISCOVERY
+	case last == "availability", last == "status", last == "$state":
+		return CLASS_AVAILABILITY
+	case strings.HasPrefix(last, "$"):
+		// Homie device, node and property attributes
+		return CLASS_DISCOVERY
+	}
+	for attribute := range telemetryAttributes {
+		if last == attribute || last == HomieID(attribute) {
+			return CLASS_TELEMETRY
+		}
+	}
+	return CLASS_STATE
+}
+
+// attributeClass returns the topic class of an attribute of a zone or of the system,
+// such as "targetTemp" or "ac1/airflow"
+func attributeClass(attribute string) string {
+	if telemetryAttributes[attribute[strings.LastIndex(attribute, "/")+1:]] {
+		return CLASS_TELEMETRY
+	}
+	return CLASS_STATE
+}
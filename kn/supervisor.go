@@ -0,0 +1,153 @@
+package kn
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// States of a supervised bridge
+const STATE_STARTING = "starting" // the bridge is starting
+const STATE_RUNNING = "running"   // the last poll succeeded
+const STATE_DEGRADED = "degraded" // the last poll failed
+const STATE_STOPPED = "stopped"   // the bridge failed to start or the supervisor was stopped
+
+// Delays before restarting a bridge that failed to start. The delay doubles after every failure.
+const MIN_RESTART_DELAY = time.Second
+const MAX_RESTART_DELAY = 30 * time.Second
+
+// Consecutive failed polls after which a degraded bridge is restarted
+const MAX_DEGRADED_TICKS = 30
+
+// Supervisor runs a bridge, polling it every Interval() and restarting it when it fails
+// to start, when its zones change or after MAX_DEGRADED_TICKS failed polls in a row.
+// Every bridge has its own supervisor, so a failing module does not affect the others.
+type Supervisor struct {
+	config *Config
+	bridge *Bridge
+	state  string
+	lock   sync.Mutex // protects bridge and state
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewSupervisor returns a supervisor for the bridge with the given configuration
+func NewSupervisor(config *Config) *Supervisor {
+	return &Supervisor{
+		config: config,
+		state:  STATE_STOPPED,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Bridge returns the current bridge, or nil if it was never started
+func (s *Supervisor) Bridge() *Bridge {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.bridge
+}
+
+// State returns the state of the bridge
+func (s *Supervisor) State() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+// setState logs state changes and publishes them to the bridge's status topic.
+// Every restart goes through STATE_STARTING, so new bridges always publish their state.
+func (s *Supervisor) setState(b *Bridge, state string) {
+	s.lock.Lock()
+	changed := s.state != state
+	s.state = state
+	s.lock.Unlock()
+	if changed {
+		log.Printf("Bridge for %s is %s\n", b.ModuleName, state)
+		b.publish(CLASS_AVAILABILITY, b.getStatusTopic(), state)
+	}
+}
+
+// wait waits for d and returns false if the supervisor was stopped in the meantime
+func (s *Supervisor) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Run runs the bridge until Stop is called
+func (s *Supervisor) Run() {
+	defer close(s.done)
+	var b *Bridge
+	defer func() {
+		if b != nil {
+			b.Stop()
+		}
+	}()
+	degraded := 0
+	restart := true
+	delay := MIN_RESTART_DELAY
+	for {
+		if restart {
+			if b != nil {
+				b.Stop()
+			}
+			b = NewBridge(s.config)
+			s.lock.Lock()
+			s.bridge = b
+			s.lock.Unlock()
+			s.setState(b, STATE_STARTING)
+			err := b.Start()
+			if err != nil {
+				log.Printf("Error starting bridge for %s, retrying in %s: %s\n", b.ModuleName, delay, err)
+				s.setState(b, STATE_STOPPED)
+				if !s.wait(delay) {
+					return
+				}
+				delay *= 2
+				if delay > MAX_RESTART_DELAY {
+					delay = MAX_RESTART_DELAY
+				}
+				continue
+			}
+			restart = false
+			degraded = 0
+			delay = MIN_RESTART_DELAY
+			s.setState(b, STATE_RUNNING)
+		}
+
+		if !s.wait(b.Interval()) {
+			s.setState(b, STATE_STOPPED)
+			b.setHomieState(HOMIE_STATE_DISCONNECTED)
+			return
+		}
+		err := b.Tick()
+		switch {
+		case errors.Is(err, ErrZonesChanged):
+			// restart so discovery matches the present zones
+			restart = true
+		case err != nil:
+			s.setState(b, STATE_DEGRADED)
+			degraded++
+			if degraded >= MAX_DEGRADED_TICKS {
+				log.Printf("Bridge for %s failed %d polls in a row, restarting\n", b.ModuleName, degraded)
+				restart = true
+			}
+		default:
+			degraded = 0
+			s.setState(b, STATE_RUNNING)
+		}
+	}
+}
+
+// Stop stops the bridge and waits for Run to return
+func (s *Supervisor) Stop() {
+	close(s.stop)
+	<-s.done
+}
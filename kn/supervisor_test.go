@@ -0,0 +1,112 @@
+package kn_test
+
+import (
+	"errors"
+	"koolnova2mqtt/kn"
+	"koolnova2mqtt/modbus"
+	"koolnova2mqtt/watcher"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// stateRecorder is an MQTT client that forwards the messages of one topic to a channel
+type stateRecorder struct {
+	topic    string
+	messages chan string
+}
+
+func (r *stateRecorder) Publish(topic string, qos byte, retained bool, payload string) error {
+	if topic == r.topic {
+		r.messages <- payload
+	}
+	return nil
+}
+
+func (r *stateRecorder) Subscribe(topic string, callback func(message string)) error {
+	return nil
+}
+
+// failingModbus fails all operations while fail is set
+type failingModbus struct {
+	watcher.Modbus
+	fail int32
+}
+
+var errFailing = errors.New("Failing")
+
+func (m *failingModbus) ReadRegister(slaveID byte, address uint16, quantity uint16) ([]uint16, error) {
+	if atomic.LoadInt32(&m.fail) != 0 {
+		return nil, errFailing
+	}
+	return m.Modbus.ReadRegister(slaveID, address, quantity)
+}
+
+func (m *failingModbus) setFailing(fail bool) {
+	var v int32
+	if fail {
+		v = 1
+	}
+	atomic.StoreInt32(&m.fail, v)
+}
+
+func TestSupervisor(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	recorder := &stateRecorder{
+		topic:    "topicPrefix/TestModule/status",
+		messages: make(chan string, 100),
+	}
+	expect := func(states ...string) {
+		for _, state := range states {
+			select {
+			case got := <-recorder.messages:
+				t.Equals(state, got)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for state %s", state)
+			}
+		}
+	}
+
+	mb := &failingModbus{Modbus: modbus.NewMock()}
+	s := kn.NewSupervisor(&kn.Config{
+		ModuleName:   "TestModule",
+		SlaveID:      49,
+		TopicPrefix:  "topicPrefix",
+		HassPrefix:   "hassPrefix",
+		PollInterval: 10 * time.Millisecond,
+		MaxFailures:  2,
+		Mqtt:         recorder,
+		Modbus:       mb,
+	})
+
+	// a bridge that cannot start is retried after a delay
+	mb.setFailing(true)
+	go s.Run()
+	expect(kn.STATE_STARTING, kn.STATE_STOPPED)
+	mb.setFailing(false)
+	expect(kn.STATE_STARTING, kn.STATE_RUNNING)
+	t.Equals(kn.STATE_RUNNING, s.State())
+	t.Assert(s.Bridge() != nil, "expected a bridge")
+
+	// failed polls degrade the bridge until a poll succeeds
+	mb.setFailing(true)
+	expect(kn.STATE_DEGRADED)
+	mb.setFailing(false)
+	expect(kn.STATE_RUNNING)
+
+	// a bridge that stays degraded is restarted
+	b := s.Bridge()
+	mb.setFailing(true)
+	expect(kn.STATE_DEGRADED, kn.STATE_STARTING, kn.STATE_STOPPED)
+	mb.setFailing(false)
+	expect(kn.STATE_STARTING, kn.STATE_RUNNING)
+	t.Assert(b != s.Bridge(), "expected a new bridge")
+
+	s.Stop()
+	expect(kn.STATE_STOPPED)
+	t.Equals(kn.STATE_STOPPED, s.State())
+}
@@ -1,6 +1,9 @@
 package kn
 
-import "errors"
+import (
+	"errors"
+	"koolnova2mqtt/watcher"
+)
 
 type SysConfig struct {
 	Watcher Watcher
@@ -75,6 +78,11 @@ func (s *SysDriver) WriteRegister(n int, value uint16) error {
 	return s.Watcher.WriteRegister(uint16(n), value)
 }
 
+// Refresh reads a register from the module, bypassing the cache
+func (s *SysDriver) Refresh(n int) error {
+	return s.Watcher.Refresh(uint16(n))
+}
+
 func (s *SysDriver) GetAirflow(ac ACMachine) int {
 	r := s.ReadRegister(REG_AIRFLOW + int(ac) - 1)
 	return r
@@ -164,3 +172,55 @@ func (s *SysDriver) HoldMode() string {
 	}
 	return "unknown"
 }
+
+// registerGroups watches several ranges of registers as one, such as the system registers,
+// which are polled in groups that skip the static serial configuration
+type registerGroups []*watcher.Watcher
+
+// get returns the watcher of the group that contains an address
+func (g registerGroups) get(address uint16) *watcher.Watcher {
+	for _, w := range g {
+		if address >= w.Address && address < w.Address+w.Quantity {
+			return w
+		}
+	}
+	panic(watcher.ErrAddressOutOfRange)
+}
+
+func (g registerGroups) ReadRegister(address uint16) uint16 {
+	return g.get(address).ReadRegister(address)
+}
+
+func (g registerGroups) WriteRegister(address uint16, value uint16) error {
+	return g.get(address).WriteRegister(address, value)
+}
+
+// WriteRegisters writes consecutive registers, which must belong to the same group
+func (g registerGroups) WriteRegisters(address uint16, values []uint16) error {
+	return g.get(address).WriteRegisters(address, values)
+}
+
+func (g registerGroups) Refresh(address uint16) error {
+	return g.get(address).Refresh(address)
+}
+
+func (g registerGroups) RegisterCallback(address uint16, callback func(address uint16)) {
+	g.get(address).RegisterCallback(address, callback)
+}
+
+// Poll polls every group, stopping at the first error
+func (g registerGroups) Poll() error {
+	for _, w := range g {
+		if err := w.Poll(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TriggerCallbacks calls the callbacks of every group
+func (g registerGroups) TriggerCallbacks() {
+	for _, w := range g {
+		w.TriggerCallbacks()
+	}
+}
@@ -0,0 +1,170 @@
+package kn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Outcomes of a set command
+const SET_ACCEPTED = "accepted"     // the module took the requested value
+const SET_CLAMPED = "clamped"       // the module took a different value, such as the closest one in range
+const SET_REJECTED = "rejected"     // the command was invalid, or the module kept the previous value
+const SET_TIMEOUT = "timeout"       // the module did not answer
+const SET_SUPERSEDED = "superseded" // a later command for the same register was sent instead
+
+// SetResult is published to the set/result topic of an attribute after a set command
+type SetResult struct {
+	Result    string `json:"result"`
+	Requested string `json:"requested"`
+	Value     string `json:"value,omitempty"` // value read back from the module
+	Error     string `json:"error,omitempty"`
+}
+
+// isTimeout returns whether an error is a timeout, such as a modbus.TimeoutError
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
+
+// isSuperseded returns whether a write was replaced by a later one, such as a modbus.SupersededError
+func isSuperseded(err error) bool {
+	var s interface{ Superseded() bool }
+	return errors.As(err, &s) && s.Superseded()
+}
+
+// setOutcome classifies the outcome of a set command, given its error, whether the module
+// took the requested value and whether it kept the previous one. It also returns the error
+// message to publish, if any.
+func setOutcome(err error, accepted, unchanged bool) (string, string) {
+	switch {
+	case isSuperseded(err):
+		// the later command publishes the outcome
+		return SET_SUPERSEDED, ""
+	case isTimeout(err):
+		return SET_TIMEOUT, err.Error()
+	case err != nil:
+		return SET_REJECTED, err.Error()
+	case accepted:
+		return SET_ACCEPTED, ""
+	case unchanged:
+		return SET_REJECTED, ""
+	}
+	return SET_CLAMPED, ""
+}
+
+// handleSet applies a set command received over MQTT. The affected registers are then read
+// back from the module with verify, since the module may clamp or ignore the value written.
+// The outcome is published to the attribute's set/result topic, along with the actual value,
+// and sent with respond if the sender asked for a response.
+func (b *Bridge) handleSet(zoneNum int, attribute, requested string, respond func(payload string) error, set func() error, verify func() (interface{}, error)) {
+	topic := b.getTopic(zoneNum, attribute)
+	b.valueLock.Lock()
+	previous := fmt.Sprint(b.values[topic])
+	b.valueLock.Unlock()
+
+	result := &SetResult{Requested: requested}
+	err := set()
+	if err == nil {
+		var value interface{}
+		value, err = verify()
+		if err == nil {
+			result.Value = fmt.Sprint(value)
+			b.publishState(zoneNum, attribute, value)
+		}
+	}
+	result.Result, result.Error = setOutcome(err, result.Value == requested, result.Value == previous)
+	if result.Error != "" {
+		log.Printf("Cannot set %s to %s: %s\n", topic, requested, result.Error)
+	} else if result.Result != SET_ACCEPTED {
+		log.Printf("Setting %s to %s was %s, the module has %s\n", topic, requested, result.Result, result.Value)
+	}
+
+	b.publishResult(topic+"/set/result", result, respond)
+}
+
+// ZoneSetResult is published to the set/result topic of a zone after a JSON set command
+type ZoneSetResult struct {
+	Result string      `json:"result"`
+	Error  string      `json:"error,omitempty"`
+	State  *ZoneStatus `json:"state,omitempty"` // state read back from the module
+}
+
+// handleZoneSet applies a JSON set command to several attributes of a zone at once, such as
+// {"hvacMode":"heat","targetTemp":21.5}. The command is validated as a whole and applied by
+// SetZone. The affected registers are then read back and the outcome is published to the
+// zone's set/result topic, along with the resulting zone state, and sent with respond if the
+// sender asked for a response.
+func (b *Bridge) handleZoneSet(zone *Zone, message string, respond func(payload string) error) {
+	topic := b.getZoneTopic(zone.ZoneNumber, "set")
+	result := &ZoneSetResult{}
+	var settings ZoneSettings
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&settings)
+	if err != nil {
+		err = fmt.Errorf("invalid zone settings %q: %w", message, err)
+	}
+
+	var previous, state *ZoneStatus
+	if err == nil {
+		previous, err = b.GetZoneStatus(zone.ZoneNumber)
+	}
+	if err == nil {
+		err = b.SetZone(zone.ZoneNumber, &settings)
+	}
+	if err == nil {
+		err = b.refreshZone(zone, &settings)
+	}
+	if err == nil {
+		state, err = b.GetZoneStatus(zone.ZoneNumber)
+		result.State = state
+	}
+
+	accepted, unchanged := true, true
+	if state != nil {
+		check := func(requested, value, old interface{}) {
+			if requested != value {
+				accepted = false
+				unchanged = unchanged && value == old
+			}
+		}
+		if settings.HvacMode != nil {
+			check(*settings.HvacMode, state.HvacMode, previous.HvacMode)
+		}
+		if settings.TargetTemp != nil {
+			check(*settings.TargetTemp, state.TargetTemp, previous.TargetTemp)
+		}
+		if settings.FanMode != nil {
+			check(*settings.FanMode, state.FanMode, previous.FanMode)
+		}
+	}
+	result.Result, result.Error = setOutcome(err, accepted, unchanged)
+	if result.Error != "" {
+		log.Printf("Cannot set %s to %s: %s\n", topic, message, result.Error)
+	} else if result.Result != SET_ACCEPTED && result.Result != SET_SUPERSEDED {
+		log.Printf("Setting %s to %s was %s\n", topic, message, result.Result)
+	}
+
+	b.publishResult(topic+"/result", result, respond)
+}
+
+// refreshZone reads back the registers affected by a set command, which publishes any changes
+func (b *Bridge) refreshZone(zone *Zone, settings *ZoneSettings) error {
+	var err error
+	if settings.HvacMode != nil {
+		err = zone.refresh(REG_ENABLED)
+		if err == nil {
+			err = b.sys.Refresh(REG_SYS_KN_MODE)
+		}
+	}
+	if err == nil && settings.FanMode != nil {
+		err = zone.refresh(REG_MODE)
+	}
+	if err == nil && settings.TargetTemp != nil {
+		err = zone.refresh(REG_TARGET_TEMP)
+	}
+	return err
+}
@@ -9,6 +9,8 @@ import (
 type Watcher interface {
 	ReadRegister(address uint16) (value uint16)
 	WriteRegister(address uint16, value uint16) error
+	WriteRegisters(address uint16, values []uint16) error
+	Refresh(address uint16) error
 	RegisterCallback(address uint16, callback func(address uint16))
 }
 
@@ -78,21 +80,45 @@ func (z *Zone) writeRegister(num int, value uint16) error {
 	return z.Watcher.WriteRegister(uint16((z.ZoneNumber-1)*REG_PER_ZONE+num), value)
 }
 
+// writeRegisters writes several registers of the zone, given by number. Adjacent
+// registers are written at once, so changing several attributes takes fewer round-trips.
+func (z *Zone) writeRegisters(values map[int]uint16) error {
+	for num := 1; num <= REG_PER_ZONE; num++ {
+		var block []uint16
+		first := num
+		for ; num <= REG_PER_ZONE; num++ {
+			value, ok := values[num]
+			if !ok {
+				break
+			}
+			block = append(block, value)
+		}
+		var err error
+		switch len(block) {
+		case 0:
+			continue
+		case 1:
+			err = z.writeRegister(first, block[0])
+		default:
+			err = z.Watcher.WriteRegisters(uint16((z.ZoneNumber-1)*REG_PER_ZONE+first), block)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refresh reads a register from the module, bypassing the cache
+func (z *Zone) refresh(num int) error {
+	return z.Watcher.Refresh(uint16((z.ZoneNumber-1)*REG_PER_ZONE + num))
+}
+
 func (z *Zone) isOn() bool {
 	r1 := z.readRegister(REG_ENABLED)
 	return r1&0x1 != 0
 }
 
-func (z *Zone) setOn(on bool) error {
-	var r1 uint16
-	if on {
-		r1 = 0x3
-	} else {
-		r1 = 0x2
-	}
-	return z.writeRegister(REG_ENABLED, r1)
-}
-
 func (z *Zone) isPresent() bool {
 	r1 := z.readRegister(REG_ENABLED)
 	return r1&0x2 != 0
@@ -124,19 +150,30 @@ func (z *Zone) getTargetTemperature() float32 {
 	return reg2temp(r3)
 }
 
-func (z *Zone) setTargetTemperature(targetTemp float32) error {
-	return z.writeRegister(REG_TARGET_TEMP, temp2reg(targetTemp))
-}
-
 func (z *Zone) getFanMode() FanMode {
 	r2 := z.readRegister(REG_MODE)
 	return (FanMode)(r2&0x00F0) >> 4
 }
 
-func (z *Zone) setFanMode(fanMode FanMode) error {
-	r2 := z.readRegister(REG_MODE) & 0x000F
-	fm := (uint16(fanMode) & 0x000F) << 4
-	return z.writeRegister(REG_MODE, r2|fm)
+// update changes several attributes of the zone at once. Nil values are left unchanged.
+func (z *Zone) update(on *bool, fanMode *FanMode, targetTemp *float32) error {
+	values := make(map[int]uint16)
+	if on != nil {
+		if *on {
+			values[REG_ENABLED] = 0x3
+		} else {
+			values[REG_ENABLED] = 0x2
+		}
+	}
+	if fanMode != nil {
+		r2 := z.readRegister(REG_MODE) & 0x000F
+		fm := (uint16(*fanMode) & 0x000F) << 4
+		values[REG_MODE] = r2 | fm
+	}
+	if targetTemp != nil {
+		values[REG_TARGET_TEMP] = temp2reg(*targetTemp)
+	}
+	return z.writeRegisters(values)
 }
 
 func (z *Zone) getKnMode() KnMode {
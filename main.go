@@ -3,62 +3,86 @@ package main
 import (
 	"koolnova2mqtt/kn"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 )
 
-// newBridges builds all bridges from a list of Modbus slaves
-func newBridges(slaves map[byte]string, templateConfig *kn.Config) []*kn.Bridge {
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// bridgeList holds the supervisors of all bridges
+type bridgeList struct {
+	supervisors []*kn.Supervisor
+}
+
+// get returns the current bridge of every supervisor. Bridges are replaced every time they restart.
+func (l *bridgeList) get() []*kn.Bridge {
 	var bridges []*kn.Bridge
-	for id, name := range slaves {
-		config := *templateConfig
-		config.ModuleName = name
-		config.SlaveID = id
-		bridge := kn.NewBridge(&config)
-		bridges = append(bridges, bridge)
+	for _, s := range l.supervisors {
+		if b := s.Bridge(); b != nil {
+			bridges = append(bridges, b)
+		}
 	}
 	return bridges
 }
 
 func main() {
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "simulate":
+			runSimulator(os.Args[2:])
+			return
+		case "purge":
+			runPurge(os.Args[2:])
+			return
+		}
+	}
+
 	// configure CTRL+C as a way to stop the application
 	ctrlC := make(chan os.Signal, 1)
 	signal.Notify(ctrlC, os.Interrupt, syscall.SIGTERM)
 
 	// read configuration from the command line
 	config := ParseCommandLine()
+	running := &bridgeList{}
+	for _, c := range config.Bridges {
+		running.supervisors = append(running.supervisors, kn.NewSupervisor(c))
+	}
 
-	go func() {
-		ticker := time.NewTicker(2 * time.Second)
-		var sessionID int
-		var bridges []*kn.Bridge
-		for range ticker.C {
-			newSessionID := config.MqttClient.ID
-			if sessionID != newSessionID {
-				bridges = newBridges(config.slaves, config.BridgeTemplateConfig)
-				for _, b := range bridges {
-					err := b.Start()
-					if err != nil {
-						log.Printf("Error starting bridge: %s\n", err)
-						break
-					} else {
-						sessionID = newSessionID
-					}
-				}
-			} else {
-				for _, b := range bridges {
-					b.Tick()
-				}
-			}
+	if config.HTTPListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", &metricsHandler{config: config, bridges: running.get})
+		api := &apiHandler{bridges: running.get}
+		mux.Handle("/modules", api)
+		mux.Handle("/modules/", api)
+		changes := newChangeStream()
+		for _, c := range config.Bridges {
+			c.OnChange = changes.publish
 		}
-	}()
+		mux.Handle("/events", changes)
+		mux.Handle("/", dashboardHandler())
+		go func() {
+			log.Printf("Serving HTTP on %s\n", config.HTTPListen)
+			err := http.ListenAndServe(config.HTTPListen, mux)
+			log.Fatalf("HTTP server failed: %s", err)
+		}()
+	}
+
+	for _, s := range running.supervisors {
+		go s.Run()
+	}
 
 	<-ctrlC
 
+	for _, s := range running.supervisors {
+		s.Stop()
+	}
 	config.MqttClient.Close()
-	config.BridgeTemplateConfig.Modbus.Close()
+	for _, mb := range config.Buses {
+		mb.Close()
+	}
 
 }
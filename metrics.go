@@ -0,0 +1,121 @@
+package main
+
+import (
+	"koolnova2mqtt/kn"
+	"koolnova2mqtt/metrics"
+	"koolnova2mqtt/modbus"
+	"koolnova2mqtt/mqtt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// metricsHandler serves the health of the bridges, modbus buses and MQTT client,
+// and the state of all zones, in Prometheus format
+type metricsHandler struct {
+	config  *Config
+	bridges func() []*kn.Bridge // returns the running bridges
+}
+
+var fanModes = []kn.FanMode{kn.FAN_OFF, kn.FAN_LOW, kn.FAN_MED, kn.FAN_HIGH, kn.FAN_AUTO}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (h *metricsHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w := metrics.NewWriter(rw)
+
+	w.Header("koolnova2mqtt_poll_duration_seconds", "Duration of successful polls of a module", metrics.HISTOGRAM)
+	for _, config := range h.config.Bridges {
+		w.Histogram("koolnova2mqtt_poll_duration_seconds", metrics.Labels{"module": config.ModuleName}, config.Stats.PollLatency)
+	}
+	w.Header("koolnova2mqtt_poll_failures_total", "Failed polls of a module", metrics.COUNTER)
+	for _, config := range h.config.Bridges {
+		w.Sample("koolnova2mqtt_poll_failures_total", metrics.Labels{"module": config.ModuleName}, float64(config.Stats.PollFailures.Value()))
+	}
+
+	busCounters := []struct {
+		name    string
+		help    string
+		counter func(s *modbus.Stats) *metrics.Counter
+	}{
+		{"koolnova2mqtt_modbus_requests_total", "Modbus operations requested", func(s *modbus.Stats) *metrics.Counter { return &s.Requests }},
+		{"koolnova2mqtt_modbus_retries_total", "Modbus operations retried after an error", func(s *modbus.Stats) *metrics.Counter { return &s.Retries }},
+		{"koolnova2mqtt_modbus_timeouts_total", "Modbus attempts that timed out", func(s *modbus.Stats) *metrics.Counter { return &s.Timeouts }},
+		{"koolnova2mqtt_modbus_crc_errors_total", "Modbus responses with a wrong checksum", func(s *modbus.Stats) *metrics.Counter { return &s.CRCErrors }},
+		{"koolnova2mqtt_modbus_failures_total", "Modbus operations that failed after all retries", func(s *modbus.Stats) *metrics.Counter { return &s.Failures }},
+		{"koolnova2mqtt_modbus_merged_writes_total", "Queued modbus writes replaced by a later write to the same register", func(s *modbus.Stats) *metrics.Counter { return &s.Merged }},
+		{"koolnova2mqtt_modbus_dropped_writes_total", "Modbus writes dropped because the bus queue was full", func(s *modbus.Stats) *metrics.Counter { return &s.Dropped }},
+	}
+	for _, c := range busCounters {
+		w.Header(c.name, c.help, metrics.COUNTER)
+		for _, mb := range h.config.Buses {
+			w.Sample(c.name, metrics.Labels{"bus": mb.Endpoint}, float64(c.counter(&mb.Stats).Value()))
+		}
+	}
+
+	mqttMetrics := []struct {
+		name  string
+		help  string
+		kind  string
+		value func(c *mqtt.Client) float64
+	}{
+		{"koolnova2mqtt_mqtt_connected", "Whether the MQTT client is connected", metrics.GAUGE, func(c *mqtt.Client) float64 { return boolToFloat(c.Connected()) }},
+		{"koolnova2mqtt_mqtt_reconnects_total", "MQTT reconnections", metrics.COUNTER, func(c *mqtt.Client) float64 { return float64(c.Stats.Reconnects.Value()) }},
+		{"koolnova2mqtt_mqtt_publish_failures_total", "MQTT messages that could not be published", metrics.COUNTER, func(c *mqtt.Client) float64 { return float64(c.Stats.PublishFailures.Value()) }},
+		{"koolnova2mqtt_mqtt_outbox_messages", "MQTT messages waiting in the outbox to be published", metrics.GAUGE, func(c *mqtt.Client) float64 { return float64(c.Queued()) }},
+		{"koolnova2mqtt_mqtt_outbox_dropped_total", "MQTT messages dropped because the outbox was full", metrics.COUNTER, func(c *mqtt.Client) float64 { return float64(c.Stats.OutboxDropped.Value()) }},
+		{"koolnova2mqtt_mqtt_outbox_replayed_total", "MQTT messages published from the outbox after reconnecting", metrics.COUNTER, func(c *mqtt.Client) float64 { return float64(c.Stats.OutboxReplayed.Value()) }},
+	}
+	for _, m := range mqttMetrics {
+		w.Header(m.name, m.help, m.kind)
+		for _, broker := range h.config.MqttClient.Brokers {
+			w.Sample(m.name, metrics.Labels{"server": broker.Client.Server()}, m.value(broker.Client))
+		}
+	}
+
+	type zoneSample struct {
+		labels metrics.Labels
+		status kn.ZoneStatus
+	}
+	var zones []zoneSample
+	for _, b := range h.bridges() {
+		for _, status := range b.ZoneStatus() {
+			zones = append(zones, zoneSample{
+				labels: metrics.Labels{"module": b.ModuleName, "zone": strconv.Itoa(status.Zone), "name": status.Name},
+				status: status,
+			})
+		}
+	}
+	w.Header("koolnova2mqtt_zone_current_temperature_celsius", "Current temperature of a zone", metrics.GAUGE)
+	for _, z := range zones {
+		w.Sample("koolnova2mqtt_zone_current_temperature_celsius", z.labels, float64(z.status.CurrentTemp))
+	}
+	w.Header("koolnova2mqtt_zone_target_temperature_celsius", "Target temperature of a zone", metrics.GAUGE)
+	for _, z := range zones {
+		w.Sample("koolnova2mqtt_zone_target_temperature_celsius", z.labels, float64(z.status.TargetTemp))
+	}
+	w.Header("koolnova2mqtt_zone_on", "Whether a zone is on", metrics.GAUGE)
+	for _, z := range zones {
+		w.Sample("koolnova2mqtt_zone_on", z.labels, boolToFloat(z.status.On))
+	}
+	w.Header("koolnova2mqtt_zone_fan_mode", "Fan mode of a zone, 1 for the current mode", metrics.GAUGE)
+	for _, z := range zones {
+		for _, fm := range fanModes {
+			labels := metrics.Labels{"mode": kn.FanMode2Str(fm)}
+			for k, v := range z.labels {
+				labels[k] = v
+			}
+			w.Sample("koolnova2mqtt_zone_fan_mode", labels, boolToFloat(z.status.FanMode == kn.FanMode2Str(fm)))
+		}
+	}
+
+	if w.Err() != nil {
+		log.Printf("Error writing metrics: %s\n", w.Err())
+	}
+}
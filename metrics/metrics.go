@@ -0,0 +1,148 @@
+// Package metrics implements counters and histograms and writes them in the
+// Prometheus text exposition format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const COUNTER = "counter"
+const GAUGE = "gauge"
+const HISTOGRAM = "histogram"
+
+// LatencyBuckets are the default histogram buckets for latencies, in seconds
+var LatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Counter is a value that only goes up. It is safe for concurrent use.
+type Counter struct {
+	value uint64
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Histogram counts observations in cumulative buckets. It is safe for concurrent use.
+type Histogram struct {
+	buckets []float64 // upper bounds, in increasing order
+	counts  []uint64  // observations per bucket, not cumulative
+	count   uint64
+	sum     float64
+	lock    sync.Mutex
+}
+
+// NewHistogram returns a new histogram with the given bucket upper bounds
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Observe adds an observation to the histogram
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// Labels are the label names and values of a sample
+type Labels map[string]string
+
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, l[name])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// with returns a copy of the labels with an additional label
+func (l Labels) with(name, value string) Labels {
+	labels := Labels{name: value}
+	for k, v := range l {
+		labels[k] = v
+	}
+	return labels
+}
+
+// Writer writes metrics in the Prometheus text exposition format. The first
+// error is remembered and returned by Err.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+// NewWriter returns a new Writer that writes to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) printf(format string, args ...interface{}) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.w, format, args...)
+	}
+}
+
+// Header describes a metric. It must be written once, before its samples.
+func (w *Writer) Header(name, help, kind string) {
+	w.printf("# HELP %s %s\n", name, help)
+	w.printf("# TYPE %s %s\n", name, kind)
+}
+
+// Sample writes a counter or gauge sample
+func (w *Writer) Sample(name string, labels Labels, value float64) {
+	w.printf("%s%s %s\n", name, labels, formatFloat(value))
+}
+
+// Histogram writes all the samples of a histogram
+func (w *Writer) Histogram(name string, labels Labels, h *Histogram) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		w.Sample(name+"_bucket", labels.with("le", formatFloat(bound)), float64(cumulative))
+	}
+	w.Sample(name+"_bucket", labels.with("le", "+Inf"), float64(h.count))
+	w.Sample(name+"_sum", labels, h.sum)
+	w.Sample(name+"_count", labels, float64(h.count))
+}
+
+// Err returns the first error found while writing
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
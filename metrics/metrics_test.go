@@ -0,0 +1,46 @@
+package metrics_test
+
+import (
+	"bytes"
+	"koolnova2mqtt/metrics"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestWriter(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var counter metrics.Counter
+	counter.Inc()
+	counter.Inc()
+	t.Equals(uint64(2), counter.Value())
+
+	h := metrics.NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	var buf bytes.Buffer
+	w := metrics.NewWriter(&buf)
+	w.Header("test_total", "A counter", metrics.COUNTER)
+	w.Sample("test_total", nil, float64(counter.Value()))
+	w.Sample("test_total", metrics.Labels{"module": "first\"floor", "bus": "tcp://host:502"}, 1.5)
+	w.Header("test_seconds", "A histogram", metrics.HISTOGRAM)
+	w.Histogram("test_seconds", metrics.Labels{"module": "garage"}, h)
+	t.Ok(w.Err())
+	t.Equals(`# HELP test_total A counter
+# TYPE test_total counter
+test_total 2
+test_total{bus="tcp://host:502",module="first\"floor"} 1.5
+# HELP test_seconds A histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1",module="garage"} 2
+test_seconds_bucket{le="1",module="garage"} 3
+test_seconds_bucket{le="+Inf",module="garage"} 4
+test_seconds_sum{module="garage"} 3.65
+test_seconds_count{module="garage"} 4
+`, buf.String())
+}
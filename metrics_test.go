@@ -0,0 +1,63 @@
+package main
+
+import (
+	"koolnova2mqtt/kn"
+	"koolnova2mqtt/modbus"
+	"koolnova2mqtt/mqtt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestMetrics(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	// nothing listens on the server, so the client stays disconnected
+	mqttClient, err := mqtt.New(&mqtt.Config{Server: "tcp://127.0.0.1:1"})
+	t.Ok(err)
+	defer mqttClient.Close()
+
+	bridgeConfig := &kn.Config{
+		ModuleName:  "first",
+		SlaveID:     49,
+		TopicPrefix: "koolnova2mqtt",
+		MinTemp:     15,
+		MaxTemp:     35,
+		Mqtt:        nopMqttClient{},
+		Modbus:      modbus.NewMock(),
+		Stats:       kn.NewStats(),
+	}
+	b := kn.NewBridge(bridgeConfig)
+	t.Ok(b.Start())
+
+	handler := &metricsHandler{
+		config: &Config{
+			MqttClient: mqtt.NewFanOut(&mqtt.Broker{Client: mqttClient}),
+			Buses:      []*modbus.Modbus{{Endpoint: "/dev/ttyUSB0"}},
+			Bridges:    []*kn.Config{bridgeConfig},
+		},
+		bridges: func() []*kn.Bridge {
+			return []*kn.Bridge{b}
+		},
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	t.Equals(http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	for _, sample := range []string{
+		"# TYPE koolnova2mqtt_poll_duration_seconds histogram\n",
+		`koolnova2mqtt_poll_duration_seconds_count{module="first"} 1` + "\n",
+		`koolnova2mqtt_poll_failures_total{module="first"} 0` + "\n",
+		`koolnova2mqtt_modbus_requests_total{bus="/dev/ttyUSB0"} 0` + "\n",
+		`koolnova2mqtt_mqtt_connected{server="tcp://127.0.0.1:1"} 0` + "\n",
+		`koolnova2mqtt_zone_target_temperature_celsius{module="first",name="first_zone1",zone="1"} 20.5` + "\n",
+		`koolnova2mqtt_zone_fan_mode{mode="auto",module="first",name="first_zone1",zone="1"} 1` + "\n",
+	} {
+		t.Assert(strings.Contains(body, sample), "missing %q in metrics:\n%s", sample, body)
+	}
+}
@@ -2,12 +2,18 @@ package modbus
 
 import (
 	"errors"
+	"sync"
 )
 
 type Mock struct {
 	State map[byte][]uint16
+	lock  sync.Mutex
 }
 
+var ErrUnknownSlave = errors.New("Unknown slave")
+var ErrIllegalDataAddress = errors.New("Illegal data address")
+var ErrIllegalFunction = errors.New("Illegal function")
+
 func NewMock() *Mock {
 	return &Mock{
 		State: map[byte][]uint16{
@@ -18,23 +24,47 @@ func NewMock() *Mock {
 }
 
 func (ms *Mock) ReadRegister(slaveID byte, address uint16, quantity uint16) (results []uint16, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
 	state, ok := ms.State[slaveID]
 	if !ok {
-		return nil, errors.New("Unknown slave")
+		return nil, ErrUnknownSlave
 	}
 	address--
+	if int(address)+int(quantity) > len(state) {
+		return nil, ErrIllegalDataAddress
+	}
 	for a := address; a < address+quantity; a++ {
 		results = append(results, state[a])
 	}
 	return results, nil
 }
 func (ms *Mock) WriteRegister(slaveID byte, address uint16, value uint16) (results []uint16, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
 	state, ok := ms.State[slaveID]
 	if !ok {
-		return nil, errors.New("Unknown slave")
+		return nil, ErrUnknownSlave
+	}
+	if address == 0 || int(address) > len(state) {
+		return nil, ErrIllegalDataAddress
 	}
 	state[address-1] = value
 	return []uint16{value}, nil
 }
 
+func (ms *Mock) WriteRegisters(slaveID byte, address uint16, values []uint16) (results []uint16, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	state, ok := ms.State[slaveID]
+	if !ok {
+		return nil, ErrUnknownSlave
+	}
+	if address == 0 || int(address)+len(values)-1 > len(state) {
+		return nil, ErrIllegalDataAddress
+	}
+	copy(state[address-1:], values)
+	return append([]uint16(nil), values...), nil
+}
+
 func (ms *Mock) Close() error { return nil }
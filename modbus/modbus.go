@@ -3,45 +3,103 @@ package modbus
 import (
 	"encoding/binary"
 	"errors"
+	"koolnova2mqtt/metrics"
 	"log"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/goburrow/serial"
 	gmodbus "github.com/wz2b/modbus"
 )
 
 type Config struct {
-	Port     string
-	BaudRate int
+	Endpoint string // rtu:///dev/ttyUSB0, tcp://host:502 or rtuovertcp://host:4196. A bare path means rtu
+	BaudRate int    // serial settings, only used by rtu endpoints
 	DataBits int
 	Parity   string
 	StopBits int
 	Timeout  time.Duration
+	Throttle time.Duration // pause after every operation, so slow devices can keep up
 }
 
 type Modbus struct {
-	handler *gmodbus.RTUClientHandler
-	client  gmodbus.Client
-	lock    sync.RWMutex
+	Endpoint string // endpoint this client is connected to
+	Stats    Stats
+	handler  handler
+	client   gmodbus.Client
+	throttle time.Duration
+	lock     sync.RWMutex
+	noBlocks map[byte]bool // slaves that rejected Write Multiple Registers
+}
+
+// Stats counts the outcome of modbus operations
+type Stats struct {
+	Requests  metrics.Counter // operations requested
+	Retries   metrics.Counter // attempts repeated after an error
+	Timeouts  metrics.Counter // attempts that timed out
+	CRCErrors metrics.Counter // responses with a wrong checksum
+	Failures  metrics.Counter // operations that failed after all retries
+	Merged    metrics.Counter // queued writes replaced by a later write to the same register
+	Dropped   metrics.Counter // writes refused because the queue was full
+}
+
+// TimeoutError is returned when the last attempt of an operation timed out
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout returns true, so timeouts can be told apart like net.Error timeouts
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// isTimeout returns whether an attempt failed because the device did not answer in time
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, serial.ErrTimeout) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// count updates the statistics with the error of a failed attempt
+func (s *Stats) count(err error) {
+	switch {
+	case isTimeout(err):
+		s.Timeouts.Inc()
+	case errors.Is(err, ErrCRC), strings.HasPrefix(err.Error(), "modbus: response crc"):
+		s.CRCErrors.Inc()
+	}
 }
 
 func throttle(ms int) {
 	time.Sleep(time.Duration(ms) * time.Millisecond)
 }
 
+// DEFAULT_THROTTLE is the recommended pause after every operation
+const DEFAULT_THROTTLE = 100 * time.Millisecond
+
 var ErrIncorrectResultSize = errors.New("Incorrect number of results returned")
 
 func New(config *Config) (*Modbus, error) {
-	handler := gmodbus.NewRTUClientHandler(config.Port)
-	handler.BaudRate = config.BaudRate
-	handler.DataBits = config.DataBits
-	handler.Parity = config.Parity
-	handler.StopBits = config.StopBits
-	handler.Timeout = config.Timeout
+	handler, err := newHandler(config)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Modbus{
-		handler: handler,
-		client:  gmodbus.NewClient(handler),
+		Endpoint: config.Endpoint,
+		handler:  handler,
+		client:   gmodbus.NewClient(handler),
+		throttle: config.Throttle,
+		noBlocks: make(map[byte]bool),
 	}, handler.Connect()
 }
 
@@ -84,11 +142,55 @@ func (mb *Modbus) WriteRegister(slaveID byte, address uint16, value uint16) (res
 	return results, err
 }
 
+// WriteRegisters writes consecutive registers at once with Write Multiple Registers (function code 16).
+// The device does not echo the values, so the values written are returned. Slaves that reject
+// the function code are remembered and written one register at a time.
+func (mb *Modbus) WriteRegisters(slaveID byte, address uint16, values []uint16) (results []uint16, err error) {
+	mb.lock.RLock()
+	noBlocks := mb.noBlocks[slaveID]
+	mb.lock.RUnlock()
+	if !noBlocks {
+		err = mb.try(slaveID, func() error {
+			data := make([]byte, 2*len(values))
+			for n, v := range values {
+				binary.BigEndian.PutUint16(data[2*n:], v)
+			}
+			_, err := mb.client.WriteMultipleRegisters(address-1, uint16(len(values)), data)
+			return err
+		})
+		var exception *gmodbus.ModbusError
+		if !errors.As(err, &exception) || exception.ExceptionCode != gmodbus.ExceptionCodeIllegalFunction {
+			if err != nil {
+				return nil, err
+			}
+			return append([]uint16(nil), values...), nil
+		}
+		log.Printf("Slave %d does not support writing multiple registers, writing them one at a time\n", slaveID)
+		mb.lock.Lock()
+		mb.noBlocks[slaveID] = true
+		mb.lock.Unlock()
+	}
+	for n, v := range values {
+		r, err := mb.WriteRegister(slaveID, address+uint16(n), v)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r...)
+	}
+	return results, nil
+}
+
 func (mb *Modbus) try(slaveID byte, f func() error) (err error) {
 	mb.lock.Lock()
 	defer mb.lock.Unlock()
-	defer throttle(100)
-	mb.handler.SlaveId = slaveID
+	defer time.Sleep(mb.throttle)
+	mb.Stats.Requests.Inc()
+	defer func() {
+		if err != nil {
+			mb.Stats.Failures.Inc()
+		}
+	}()
+	mb.handler.SetSlaveID(slaveID)
 	retries := 5
 	delay := 100
 	for retries > 0 {
@@ -96,6 +198,12 @@ func (mb *Modbus) try(slaveID byte, f func() error) (err error) {
 		if err == nil {
 			return nil
 		}
+		var exception *gmodbus.ModbusError
+		if errors.As(err, &exception) {
+			// the device answered, so it would answer the same again
+			return err
+		}
+		mb.Stats.count(err)
 		log.Printf("Retried modbus operation due to %s. %d retries left\n", err, retries)
 		mb.handler.Close()
 		throttle(100)
@@ -104,8 +212,14 @@ func (mb *Modbus) try(slaveID byte, f func() error) (err error) {
 			return connectErr
 		}
 		retries--
+		if retries > 0 {
+			mb.Stats.Retries.Inc()
+		}
 		throttle(delay)
 		delay *= 2
 	}
+	if isTimeout(err) {
+		return &TimeoutError{Err: err}
+	}
 	return err
 }
@@ -0,0 +1,150 @@
+package modbus_test
+
+import (
+	"errors"
+	"io"
+	"koolnova2mqtt/modbus"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func startServer(t *ut.DefaultTestTools, mock modbus.Registers, framing modbus.Framing, address string) (*modbus.Server, string) {
+	l, err := net.Listen("tcp", address)
+	t.Ok(err)
+	server := modbus.NewServer(mock, framing)
+	go server.Serve(l)
+	return server, l.Addr().String()
+}
+
+func testTransport(tx *testing.T, scheme string, framing modbus.Framing) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mock := modbus.NewMock()
+	server, address := startServer(t, mock, framing, "127.0.0.1:0")
+
+	mb, err := modbus.New(&modbus.Config{
+		Endpoint: scheme + "://" + address,
+		Timeout:  200 * time.Millisecond,
+	})
+	t.Ok(err)
+	defer mb.Close()
+
+	results, err := mb.ReadRegister(49, 1, 8)
+	t.Ok(err)
+	t.Equals(mock.State[49][:8], results)
+
+	results, err = mb.ReadRegister(50, 65, 18)
+	t.Ok(err)
+	t.Equals(mock.State[50][64:82], results)
+
+	results, err = mb.WriteRegister(49, 3, 44)
+	t.Ok(err)
+	t.Equals([]uint16{44}, results)
+	t.Equals(uint16(44), mock.State[49][2])
+
+	results, err = mb.WriteRegisters(49, 1, []uint16{2, 84, 44})
+	t.Ok(err)
+	t.Equals([]uint16{2, 84, 44}, results)
+	t.Equals([]uint16{2, 84, 44}, mock.State[49][:3])
+
+	// the connection must be reestablished if the remote end goes away
+	server.Close()
+	server, _ = startServer(t, mock, framing, address)
+	defer server.Close()
+
+	results, err = mb.ReadRegister(49, 3, 1)
+	t.Ok(err)
+	t.Equals([]uint16{44}, results)
+}
+
+func TestTCP(tx *testing.T) {
+	testTransport(tx, modbus.SCHEME_TCP, modbus.FRAMING_TCP)
+}
+
+func TestRTUOverTCP(tx *testing.T) {
+	testTransport(tx, modbus.SCHEME_RTU_OVER_TCP, modbus.FRAMING_RTU)
+}
+
+// singleRegisters rejects Write Multiple Registers, like some controllers do
+type singleRegisters struct {
+	*modbus.Mock
+	rejected int
+}
+
+func (r *singleRegisters) WriteRegisters(slaveID byte, address uint16, values []uint16) ([]uint16, error) {
+	r.rejected++
+	return nil, modbus.ErrIllegalFunction
+}
+
+func TestWriteRegistersFallback(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	registers := &singleRegisters{Mock: modbus.NewMock()}
+	server, address := startServer(t, registers, modbus.FRAMING_TCP, "127.0.0.1:0")
+	defer server.Close()
+
+	mb, err := modbus.New(&modbus.Config{
+		Endpoint: modbus.SCHEME_TCP + "://" + address,
+		Timeout:  200 * time.Millisecond,
+	})
+	t.Ok(err)
+	defer mb.Close()
+
+	// rejected block writes are not retried, but written one register at a time
+	results, err := mb.WriteRegisters(49, 5, []uint16{2, 84})
+	t.Ok(err)
+	t.Equals([]uint16{2, 84}, results)
+	t.Equals([]uint16{2, 84}, registers.State[49][4:6])
+	t.Equals(1, registers.rejected)
+	t.Equals(uint64(0), mb.Stats.Retries.Value())
+
+	// the slave is not asked again
+	_, err = mb.WriteRegisters(49, 9, []uint16{2, 84})
+	t.Ok(err)
+	t.Equals([]uint16{2, 84}, registers.State[49][8:10])
+	t.Equals(1, registers.rejected)
+}
+
+func TestEndpoint(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	_, err := modbus.New(&modbus.Config{Endpoint: "udp://127.0.0.1:502"})
+	t.Assert(errors.Is(err, modbus.ErrUnsupportedScheme), "expected unsupported scheme error, got %s", err)
+
+	_, err = modbus.New(&modbus.Config{Endpoint: "tcp:///dev/ttyUSB0"})
+	t.MustFail(err, "expected tcp endpoint without host to fail")
+}
+
+func TestRTUResync(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mock := modbus.NewMock()
+	server, address := startServer(t, mock, modbus.FRAMING_RTU, "127.0.0.1:0")
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", address)
+	t.Ok(err)
+	defer conn.Close()
+	t.Ok(conn.SetDeadline(time.Now().Add(2 * time.Second)))
+
+	request := []byte{49, 3, 0, 0, 0, 1, 0x81, 0xFA} // read register 1 of slave 49
+	garbage := []byte{0x00, 0xFF}                    // noise
+	garbage = append(garbage, request[:3]...)        // a truncated frame
+	garbage = append(garbage, request[:6]...)        // a frame with a bad CRC
+	garbage = append(garbage, 0x00, 0x00)
+	_, err = conn.Write(append(garbage, request...))
+	t.Ok(err)
+
+	// the server skips the garbage and answers the request
+	response := make([]byte, 7)
+	_, err = io.ReadFull(conn, response)
+	t.Ok(err)
+	t.Equals([]byte{49, 3, 2, byte(mock.State[49][0] >> 8), byte(mock.State[49][0])}, response[:5])
+}
@@ -0,0 +1,233 @@
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Device is a modbus client, such as Modbus or Mock
+type Device interface {
+	ReadRegister(slaveID byte, address uint16, quantity uint16) (results []uint16, err error)
+	WriteRegister(slaveID byte, address uint16, value uint16) (results []uint16, err error)
+	WriteRegisters(slaveID byte, address uint16, values []uint16) (results []uint16, err error)
+	Close() error
+}
+
+// DEFAULT_QUEUE_LENGTH is the default maximum number of pending writes of a bus
+const DEFAULT_QUEUE_LENGTH = 32
+
+var ErrQueueFull = errors.New("Too many pending modbus writes")
+var ErrQueueClosed = errors.New("Modbus queue closed")
+
+// SupersededError is returned for a queued write that was replaced by a later write
+// to the same register before being sent
+type SupersededError struct {
+	Value uint16 // value written instead
+}
+
+func (e *SupersededError) Error() string {
+	return fmt.Sprintf("Superseded by a later write of %d", e.Value)
+}
+
+// Superseded returns true, so callers can tell these errors apart without importing this package
+func (e *SupersededError) Superseded() bool {
+	return true
+}
+
+// QueueConfig contains the configuration of a Queue
+type QueueConfig struct {
+	Device    Device // Device operations are sent to
+	MaxLength int    // Maximum number of pending writes. Further writes are dropped
+	Stats     *Stats // Where to count merged and dropped writes
+}
+
+// Queue sends the operations of all modbus slaves of a bus to the device one at a time.
+// Writes go before reads, so commands are not delayed by polling, and a write to a
+// register that already has a pending write replaces it instead of being queued again,
+// so bursts of commands such as slider drags only send the last value.
+type Queue struct {
+	QueueConfig
+	writes []*request
+	reads  []*request
+	closed bool
+	lock   sync.Mutex
+	cond   *sync.Cond
+}
+
+// request is a pending operation. The caller waits until done is closed.
+type request struct {
+	slaveID  byte
+	address  uint16
+	quantity uint16   // number of registers to read, zero for writes
+	values   []uint16 // values to write
+	block    bool     // whether values are written with WriteRegisters
+	results  []uint16
+	err      error
+	done     chan struct{}
+}
+
+// NewQueue returns a new Queue and starts sending operations to the device
+func NewQueue(config *QueueConfig) *Queue {
+	q := &Queue{
+		QueueConfig: *config,
+	}
+	if q.MaxLength == 0 {
+		q.MaxLength = DEFAULT_QUEUE_LENGTH
+	}
+	if q.Stats == nil {
+		q.Stats = &Stats{}
+	}
+	q.cond = sync.NewCond(&q.lock)
+	go q.run()
+	return q
+}
+
+// ReadRegister queues a read and waits for its results
+func (q *Queue) ReadRegister(slaveID byte, address uint16, quantity uint16) ([]uint16, error) {
+	r := &request{
+		slaveID:  slaveID,
+		address:  address,
+		quantity: quantity,
+		done:     make(chan struct{}),
+	}
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return nil, ErrQueueClosed
+	}
+	q.reads = append(q.reads, r)
+	q.cond.Signal()
+	q.lock.Unlock()
+	<-r.done
+	return r.results, r.err
+}
+
+// WriteRegister queues a write and waits for its results. If the register already has a
+// pending write, the pending write fails with a SupersededError and this one takes its place.
+func (q *Queue) WriteRegister(slaveID byte, address uint16, value uint16) ([]uint16, error) {
+	r := &request{
+		slaveID: slaveID,
+		address: address,
+		values:  []uint16{value},
+		done:    make(chan struct{}),
+	}
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return nil, ErrQueueClosed
+	}
+	if n := q.pendingWrite(slaveID, address); n >= 0 {
+		old := q.writes[n]
+		old.err = &SupersededError{Value: value}
+		close(old.done)
+		q.writes[n] = r
+		q.Stats.Merged.Inc()
+	} else if err := q.push(r); err != nil {
+		q.lock.Unlock()
+		return nil, err
+	}
+	q.lock.Unlock()
+	<-r.done
+	return r.results, r.err
+}
+
+// WriteRegisters queues a write of consecutive registers and waits for its results.
+// Block writes are not merged, but keep their order with respect to other writes.
+func (q *Queue) WriteRegisters(slaveID byte, address uint16, values []uint16) ([]uint16, error) {
+	r := &request{
+		slaveID: slaveID,
+		address: address,
+		values:  values,
+		block:   true,
+		done:    make(chan struct{}),
+	}
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return nil, ErrQueueClosed
+	}
+	if err := q.push(r); err != nil {
+		q.lock.Unlock()
+		return nil, err
+	}
+	q.lock.Unlock()
+	<-r.done
+	return r.results, r.err
+}
+
+// push adds a write to the queue, unless it is full. q.lock must be held.
+func (q *Queue) push(r *request) error {
+	if len(q.writes) >= q.MaxLength {
+		q.Stats.Dropped.Inc()
+		log.Printf("Dropped write of %v to register %d of slave %d: %s\n", r.values, r.address, r.slaveID, ErrQueueFull)
+		return ErrQueueFull
+	}
+	q.writes = append(q.writes, r)
+	q.cond.Signal()
+	return nil
+}
+
+// pendingWrite returns the index of the pending write to a register, or -1. q.lock must be held.
+func (q *Queue) pendingWrite(slaveID byte, address uint16) int {
+	for n, r := range q.writes {
+		if r.slaveID == slaveID && r.address == address && !r.block {
+			return n
+		}
+	}
+	return -1
+}
+
+// Len returns the number of pending operations
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.writes) + len(q.reads)
+}
+
+// next waits for the next operation, writes first. It returns nil once the queue is closed.
+func (q *Queue) next() *request {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.writes) == 0 && len(q.reads) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	var r *request
+	switch {
+	case len(q.writes) > 0:
+		r, q.writes = q.writes[0], q.writes[1:]
+	case len(q.reads) > 0:
+		r, q.reads = q.reads[0], q.reads[1:]
+	}
+	return r
+}
+
+func (q *Queue) run() {
+	for r := q.next(); r != nil; r = q.next() {
+		switch {
+		case r.block:
+			r.results, r.err = q.Device.WriteRegisters(r.slaveID, r.address, r.values)
+		case r.values != nil:
+			r.results, r.err = q.Device.WriteRegister(r.slaveID, r.address, r.values[0])
+		default:
+			r.results, r.err = q.Device.ReadRegister(r.slaveID, r.address, r.quantity)
+		}
+		close(r.done)
+	}
+}
+
+// Close fails pending operations, stops the queue and closes the device
+func (q *Queue) Close() error {
+	q.lock.Lock()
+	q.closed = true
+	for _, r := range append(q.writes, q.reads...) {
+		r.err = ErrQueueClosed
+		close(r.done)
+	}
+	q.writes = nil
+	q.reads = nil
+	q.cond.Signal()
+	q.lock.Unlock()
+	return q.Device.Close()
+}
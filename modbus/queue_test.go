@@ -0,0 +1,154 @@
+package modbus_test
+
+import (
+	"errors"
+	"fmt"
+	"koolnova2mqtt/modbus"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// slowDevice records the operations it receives and waits for each one to be released
+type slowDevice struct {
+	*modbus.Mock
+	operations chan string
+	release    chan struct{}
+}
+
+func (d *slowDevice) ReadRegister(slaveID byte, address uint16, quantity uint16) ([]uint16, error) {
+	d.operations <- fmt.Sprintf("read %d", address)
+	<-d.release
+	return d.Mock.ReadRegister(slaveID, address, quantity)
+}
+
+func (d *slowDevice) WriteRegisters(slaveID byte, address uint16, values []uint16) ([]uint16, error) {
+	d.operations <- fmt.Sprintf("write %d=%v", address, values)
+	<-d.release
+	return d.Mock.WriteRegisters(slaveID, address, values)
+}
+
+func (d *slowDevice) WriteRegister(slaveID byte, address uint16, value uint16) ([]uint16, error) {
+	d.operations <- fmt.Sprintf("write %d=%d", address, value)
+	<-d.release
+	return d.Mock.WriteRegister(slaveID, address, value)
+}
+
+func TestQueue(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	device := &slowDevice{
+		Mock:       modbus.NewMock(),
+		operations: make(chan string, 10),
+		release:    make(chan struct{}),
+	}
+	stats := &modbus.Stats{}
+	q := modbus.NewQueue(&modbus.QueueConfig{
+		Device:    device,
+		MaxLength: 2,
+		Stats:     stats,
+	})
+
+	type result struct {
+		results []uint16
+		err     error
+	}
+	// start runs f in the background and waits until the queue holds n operations
+	start := func(n int, f func() ([]uint16, error)) chan result {
+		c := make(chan result, 1)
+		go func() {
+			results, err := f()
+			c <- result{results, err}
+		}()
+		for q.Len() != n {
+			time.Sleep(time.Millisecond)
+		}
+		return c
+	}
+	read := func(n int, address uint16) chan result {
+		return start(n, func() ([]uint16, error) {
+			return q.ReadRegister(49, address, 1)
+		})
+	}
+	write := func(n int, address, value uint16) chan result {
+		return start(n, func() ([]uint16, error) {
+			return q.WriteRegister(49, address, value)
+		})
+	}
+	// receive waits for the device to receive an operation
+	receive := func(operation string) {
+		select {
+		case got := <-device.operations:
+			t.Equals(operation, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s", operation)
+		}
+	}
+	expect := func(operation string) {
+		receive(operation)
+		device.release <- struct{}{}
+	}
+
+	// keep the device busy while operations pile up
+	busy := read(0, 1)
+	receive("read 1")
+	first := read(1, 2)
+	superseded := write(2, 3, 10)
+
+	// writes to a register with a pending write replace it
+	last := write(2, 3, 20)
+	r := <-superseded
+	var supersededErr *modbus.SupersededError
+	t.Assert(errors.As(r.err, &supersededErr), "expected SupersededError, got %v", r.err)
+	t.Equals(uint16(20), supersededErr.Value)
+	t.Equals(uint64(1), stats.Merged.Value())
+	other := write(3, 4, 30)
+
+	// further writes are dropped when the queue is full
+	_, err := q.WriteRegister(49, 5, 40)
+	t.Equals(modbus.ErrQueueFull, err)
+	t.Equals(uint64(1), stats.Dropped.Value())
+
+	// writes are sent before pending reads, in order
+	device.release <- struct{}{}
+	expect("write 3=20")
+	expect("write 4=30")
+	expect("read 2")
+	for _, c := range []chan result{busy, last, other, first} {
+		r := <-c
+		t.Ok(r.err)
+	}
+	t.Equals(uint16(20), device.State[49][2])
+	t.Equals(uint16(30), device.State[49][3])
+
+	// block writes are not merged, but keep their order
+	busy = read(0, 1)
+	receive("read 1")
+	last = write(1, 3, 21)
+	block := start(2, func() ([]uint16, error) {
+		return q.WriteRegisters(49, 3, []uint16{22, 23})
+	})
+	device.release <- struct{}{}
+	expect("write 3=21")
+	expect("write 3=[22 23]")
+	for _, c := range []chan result{busy, last, block} {
+		r := <-c
+		t.Ok(r.err)
+	}
+	t.Equals([]uint16{22, 23}, device.State[49][2:4])
+
+	// pending operations fail when the queue is closed
+	busy = read(0, 1)
+	receive("read 1")
+	first = read(1, 2)
+	t.Ok(q.Close())
+	r = <-first
+	t.Equals(modbus.ErrQueueClosed, r.err)
+	device.release <- struct{}{}
+	r = <-busy
+	t.Ok(r.err)
+	_, err = q.ReadRegister(49, 1, 1)
+	t.Equals(modbus.ErrQueueClosed, err)
+}
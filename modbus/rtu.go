@@ -0,0 +1,139 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	gmodbus "github.com/wz2b/modbus"
+)
+
+const rtuMaxSize = 256
+
+var ErrCRC = errors.New("Modbus RTU frame CRC mismatch")
+var ErrUnknownFunction = errors.New("Unknown modbus function code")
+
+// crc16 calculates the Modbus RTU CRC of the given data
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// encodeRTU builds a RTU frame: slave id, function code, data and CRC
+func encodeRTU(slaveID byte, pdu *gmodbus.ProtocolDataUnit) []byte {
+	adu := make([]byte, 0, len(pdu.Data)+4)
+	adu = append(adu, slaveID, pdu.FunctionCode)
+	adu = append(adu, pdu.Data...)
+	crc := crc16(adu)
+	return append(adu, byte(crc), byte(crc>>8))
+}
+
+// decodeRTU verifies the CRC of a RTU frame and returns its slave id and PDU
+func decodeRTU(adu []byte) (slaveID byte, pdu *gmodbus.ProtocolDataUnit, err error) {
+	length := len(adu)
+	if length < 4 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	crc := binary.LittleEndian.Uint16(adu[length-2:])
+	if crc != crc16(adu[:length-2]) {
+		return 0, nil, ErrCRC
+	}
+	return adu[0], &gmodbus.ProtocolDataUnit{
+		FunctionCode: adu[1],
+		Data:         adu[2 : length-2],
+	}, nil
+}
+
+// rtuStream keeps the bytes of the frame being read, so that after a corrupted frame
+// the next one can be looked for in the bytes that followed its first byte
+type rtuStream struct {
+	r        io.Reader
+	buffered []byte // bytes received and not yet discarded
+	read     int    // bytes of buffered already returned for the current frame
+}
+
+func (s *rtuStream) Read(p []byte) (int, error) {
+	if s.read < len(s.buffered) {
+		n := copy(p, s.buffered[s.read:])
+		s.read += n
+		return n, nil
+	}
+	n, err := s.r.Read(p)
+	s.buffered = append(s.buffered, p[:n]...)
+	s.read += n
+	return n, err
+}
+
+// next discards the bytes of a complete frame
+func (s *rtuStream) next() {
+	s.discard(s.read)
+}
+
+// resync discards the first byte of a corrupted frame, so that the following
+// reads look for a frame starting on the next one
+func (s *rtuStream) resync() {
+	s.discard(1)
+}
+
+func (s *rtuStream) discard(n int) {
+	s.buffered = append(s.buffered[:0], s.buffered[n:]...)
+	s.read = 0
+}
+
+// readRTUFrame reads a complete RTU frame from a stream. RTU frames carry no
+// length information, so the remaining length is inferred from the function code
+// and from whether the frame is a request or a response.
+func readRTUFrame(r io.Reader, request bool) ([]byte, error) {
+	frame := make([]byte, 2, rtuMaxSize)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	readMore := func(n int) error {
+		start := len(frame)
+		frame = frame[:start+n]
+		_, err := io.ReadFull(r, frame[start:])
+		return err
+	}
+
+	functionCode := frame[1]
+	var err error
+	switch {
+	case functionCode&0x80 != 0:
+		// exception code
+		err = readMore(1)
+	case functionCode == gmodbus.FuncCodeReadHoldingRegisters && !request:
+		if err = readMore(1); err == nil {
+			err = readMore(int(frame[2]))
+		}
+	case functionCode == gmodbus.FuncCodeWriteMultipleRegisters && request:
+		// address, quantity, byte count and values
+		if err = readMore(5); err == nil {
+			err = readMore(int(frame[6]))
+		}
+	case functionCode == gmodbus.FuncCodeReadHoldingRegisters,
+		functionCode == gmodbus.FuncCodeWriteSingleRegister,
+		functionCode == gmodbus.FuncCodeWriteMultipleRegisters:
+		err = readMore(4)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownFunction, functionCode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// CRC
+	if err = readMore(2); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
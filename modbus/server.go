@@ -0,0 +1,245 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	gmodbus "github.com/wz2b/modbus"
+)
+
+// Registers is the register map served by a Server. Addresses are 1-based,
+// as in the rest of this package.
+type Registers interface {
+	ReadRegister(slaveID byte, address uint16, quantity uint16) (results []uint16, err error)
+	WriteRegister(slaveID byte, address uint16, value uint16) (results []uint16, err error)
+	WriteRegisters(slaveID byte, address uint16, values []uint16) (results []uint16, err error)
+}
+
+// Framing selects how modbus frames are delimited on the wire
+type Framing int
+
+const FRAMING_TCP Framing = 0 // Modbus TCP (MBAP header)
+const FRAMING_RTU Framing = 1 // Modbus RTU (slave id + PDU + CRC)
+
+const tcpHeaderSize = 7
+
+// Server answers modbus requests on behalf of one or more slaves
+type Server struct {
+	Registers Registers
+	Framing   Framing
+	lock      sync.Mutex
+	listeners []net.Listener
+	conns     map[io.ReadWriteCloser]struct{}
+	closed    bool
+}
+
+// NewServer returns a new modbus server backed by the given registers
+func NewServer(registers Registers, framing Framing) *Server {
+	return &Server{
+		Registers: registers,
+		Framing:   framing,
+		conns:     make(map[io.ReadWriteCloser]struct{}),
+	}
+}
+
+// Serve accepts connections on the listener and serves them until the
+// listener fails or the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	s.listeners = append(s.listeners, l)
+	s.lock.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves requests coming from a single stream, such as a TCP
+// connection or a pseudo terminal, until it is closed
+func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	var err error
+	rtu := &rtuStream{r: conn}
+	for err == nil {
+		if s.Framing == FRAMING_RTU {
+			err = s.serveRTU(rtu, conn)
+		} else {
+			err = s.serveTCP(conn)
+		}
+	}
+	if err != io.EOF && !s.isClosed() {
+		log.Printf("Modbus server connection closed: %s\n", err)
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+// Close stops all listeners and closes all connections
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveRTU(rtu *rtuStream, w io.Writer) error {
+	frame, err := readRTUFrame(rtu, true)
+	if errors.Is(err, ErrUnknownFunction) {
+		// line noise or the middle of a frame: look for a frame on the next byte
+		rtu.resync()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	slaveID, request, err := decodeRTU(frame)
+	if err != nil {
+		// a real slave ignores corrupted frames
+		rtu.resync()
+		return nil
+	}
+	rtu.next()
+	response := s.handle(slaveID, request)
+	if response == nil {
+		return nil
+	}
+	_, err = w.Write(encodeRTU(slaveID, response))
+	return err
+}
+
+func (s *Server) serveTCP(conn io.ReadWriter) error {
+	header := make([]byte, tcpHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 2 {
+		return io.ErrUnexpectedEOF
+	}
+	pduBytes := make([]byte, length-1)
+	if _, err := io.ReadFull(conn, pduBytes); err != nil {
+		return err
+	}
+	response := s.handle(header[6], &gmodbus.ProtocolDataUnit{
+		FunctionCode: pduBytes[0],
+		Data:         pduBytes[1:],
+	})
+	if response == nil {
+		response = exception(pduBytes[0], gmodbus.ExceptionCodeGatewayTargetDeviceFailedToRespond)
+	}
+	adu := make([]byte, tcpHeaderSize+1+len(response.Data))
+	copy(adu, header[:4])
+	binary.BigEndian.PutUint16(adu[4:], uint16(2+len(response.Data)))
+	adu[6] = header[6]
+	adu[tcpHeaderSize] = response.FunctionCode
+	copy(adu[tcpHeaderSize+1:], response.Data)
+	_, err := conn.Write(adu)
+	return err
+}
+
+func exception(functionCode byte, exceptionCode byte) *gmodbus.ProtocolDataUnit {
+	return &gmodbus.ProtocolDataUnit{
+		FunctionCode: functionCode | 0x80,
+		Data:         []byte{exceptionCode},
+	}
+}
+
+// handle executes a request and returns the response PDU, or nil if the slave
+// does not exist and therefore must not answer
+func (s *Server) handle(slaveID byte, request *gmodbus.ProtocolDataUnit) *gmodbus.ProtocolDataUnit {
+	data := request.Data
+	var err error
+	var response []byte
+	switch request.FunctionCode {
+	case gmodbus.FuncCodeReadHoldingRegisters:
+		if len(data) != 4 {
+			return exception(request.FunctionCode, gmodbus.ExceptionCodeIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(data)
+		quantity := binary.BigEndian.Uint16(data[2:])
+		var results []uint16
+		results, err = s.Registers.ReadRegister(slaveID, address+1, quantity)
+		if err == nil {
+			response = make([]byte, 1+2*len(results))
+			response[0] = byte(2 * len(results))
+			for i, r := range results {
+				binary.BigEndian.PutUint16(response[1+2*i:], r)
+			}
+		}
+	case gmodbus.FuncCodeWriteSingleRegister:
+		if len(data) != 4 {
+			return exception(request.FunctionCode, gmodbus.ExceptionCodeIllegalDataValue)
+		}
+		// the response is an echo of the request, even if the slave
+		// stored a different value
+		address := binary.BigEndian.Uint16(data)
+		_, err = s.Registers.WriteRegister(slaveID, address+1, binary.BigEndian.Uint16(data[2:]))
+		response = data
+	case gmodbus.FuncCodeWriteMultipleRegisters:
+		if len(data) < 5 || len(data) != 5+int(data[4]) {
+			return exception(request.FunctionCode, gmodbus.ExceptionCodeIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(data)
+		quantity := binary.BigEndian.Uint16(data[2:])
+		if int(quantity)*2 != int(data[4]) {
+			return exception(request.FunctionCode, gmodbus.ExceptionCodeIllegalDataValue)
+		}
+		values := make([]uint16, quantity)
+		for i := range values {
+			values[i] = binary.BigEndian.Uint16(data[5+2*i:])
+		}
+		_, err = s.Registers.WriteRegisters(slaveID, address+1, values)
+		if err == nil {
+			response = append([]byte(nil), data[:4]...)
+		}
+	default:
+		return exception(request.FunctionCode, gmodbus.ExceptionCodeIllegalFunction)
+	}
+
+	switch {
+	case err == nil:
+		return &gmodbus.ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: response}
+	case errors.Is(err, ErrUnknownSlave):
+		return nil
+	case errors.Is(err, ErrIllegalDataAddress):
+		return exception(request.FunctionCode, gmodbus.ExceptionCodeIllegalDataAddress)
+	case errors.Is(err, ErrIllegalFunction):
+		return exception(request.FunctionCode, gmodbus.ExceptionCodeIllegalFunction)
+	}
+	return exception(request.FunctionCode, gmodbus.ExceptionCodeServerDeviceFailure)
+}
@@ -0,0 +1,178 @@
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	gmodbus "github.com/wz2b/modbus"
+)
+
+const SCHEME_RTU = "rtu"
+const SCHEME_TCP = "tcp"
+const SCHEME_RTU_OVER_TCP = "rtuovertcp"
+
+var ErrUnsupportedScheme = errors.New("Unsupported modbus endpoint scheme")
+
+// handler abstracts the transport used to reach the modbus slaves
+type handler interface {
+	gmodbus.ClientHandler
+	Connect() error
+	Close() error
+	SetSlaveID(slaveID byte)
+}
+
+// Endpoint is a parsed modbus endpoint URL
+type Endpoint struct {
+	Scheme  string
+	Address string // serial port or host:port
+}
+
+// ParseEndpoint parses endpoints such as rtu:///dev/ttyUSB0, tcp://host:502 or
+// rtuovertcp://host:4196. A bare path is taken as a serial port.
+func ParseEndpoint(s string) (*Endpoint, error) {
+	if !strings.Contains(s, "://") {
+		return &Endpoint{Scheme: SCHEME_RTU, Address: s}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case SCHEME_RTU:
+		// allow rtu://COM3 as well as rtu:///dev/ttyUSB0
+		return &Endpoint{Scheme: u.Scheme, Address: u.Host + u.Path}, nil
+	case SCHEME_TCP, SCHEME_RTU_OVER_TCP:
+		if u.Host == "" {
+			return nil, fmt.Errorf("Missing host in modbus endpoint %q", s)
+		}
+		return &Endpoint{Scheme: u.Scheme, Address: u.Host}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+}
+
+// newHandler builds the handler corresponding to the configured endpoint
+func newHandler(config *Config) (handler, error) {
+	ep, err := ParseEndpoint(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch ep.Scheme {
+	case SCHEME_TCP:
+		h := gmodbus.NewTCPClientHandler(ep.Address)
+		h.Timeout = config.Timeout
+		return &tcpHandler{h}, nil
+	case SCHEME_RTU_OVER_TCP:
+		return &rtuOverTCPHandler{
+			Address: ep.Address,
+			Timeout: config.Timeout,
+		}, nil
+	}
+	h := gmodbus.NewRTUClientHandler(ep.Address)
+	h.BaudRate = config.BaudRate
+	h.DataBits = config.DataBits
+	h.Parity = config.Parity
+	h.StopBits = config.StopBits
+	h.Timeout = config.Timeout
+	return &rtuHandler{h}, nil
+}
+
+// rtuHandler talks Modbus RTU over a local serial port
+type rtuHandler struct {
+	*gmodbus.RTUClientHandler
+}
+
+func (h *rtuHandler) SetSlaveID(slaveID byte) {
+	h.SlaveId = slaveID
+}
+
+// tcpHandler talks Modbus TCP
+type tcpHandler struct {
+	*gmodbus.TCPClientHandler
+}
+
+func (h *tcpHandler) SetSlaveID(slaveID byte) {
+	h.SlaveId = slaveID
+}
+
+// rtuOverTCPHandler sends raw RTU frames over a TCP connection, which is what
+// most transparent Ethernet/Wi-Fi RS485 gateways expect
+type rtuOverTCPHandler struct {
+	Address string
+	Timeout time.Duration
+	slaveID byte
+	conn    net.Conn
+	lock    sync.Mutex
+}
+
+func (h *rtuOverTCPHandler) SetSlaveID(slaveID byte) {
+	h.slaveID = slaveID
+}
+
+func (h *rtuOverTCPHandler) Connect() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.connect()
+}
+
+func (h *rtuOverTCPHandler) connect() error {
+	if h.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", h.Address, h.Timeout)
+	if err != nil {
+		return err
+	}
+	h.conn = conn
+	return nil
+}
+
+func (h *rtuOverTCPHandler) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.conn == nil {
+		return nil
+	}
+	err := h.conn.Close()
+	h.conn = nil
+	return err
+}
+
+func (h *rtuOverTCPHandler) Encode(pdu *gmodbus.ProtocolDataUnit) ([]byte, error) {
+	return encodeRTU(h.slaveID, pdu), nil
+}
+
+func (h *rtuOverTCPHandler) Decode(adu []byte) (*gmodbus.ProtocolDataUnit, error) {
+	_, pdu, err := decodeRTU(adu)
+	return pdu, err
+}
+
+func (h *rtuOverTCPHandler) Verify(aduRequest []byte, aduResponse []byte) error {
+	if aduResponse[0] != aduRequest[0] {
+		return fmt.Errorf("modbus: response slave id '%v' does not match request '%v'", aduResponse[0], aduRequest[0])
+	}
+	return nil
+}
+
+func (h *rtuOverTCPHandler) Send(aduRequest []byte) ([]byte, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.connect(); err != nil {
+		return nil, err
+	}
+	var deadline time.Time
+	if h.Timeout > 0 {
+		deadline = time.Now().Add(h.Timeout)
+	}
+	if err := h.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := h.conn.Write(aduRequest); err != nil {
+		return nil, err
+	}
+	return readRTUFrame(h.conn, false)
+}
@@ -0,0 +1,43 @@
+package mqtt
+
+import "sync"
+
+// dispatcher runs the callbacks of received messages away from the connection, so a set
+// command waiting for a slow modbus bus does not hold up the others. Messages of different
+// topics are handled concurrently, while messages of the same topic are handled one at a
+// time in the order they arrived, so a burst of commands ends with the last value sent.
+type dispatcher struct {
+	lock    sync.Mutex
+	pending map[string][]func() // callbacks waiting for each topic that has one running
+}
+
+// dispatch runs a callback after the previous callbacks of the same topic
+func (d *dispatcher) dispatch(topic string, callback func()) {
+	d.lock.Lock()
+	if d.pending == nil {
+		d.pending = make(map[string][]func())
+	}
+	queue, running := d.pending[topic]
+	d.pending[topic] = append(queue, callback)
+	d.lock.Unlock()
+	if !running {
+		go d.run(topic)
+	}
+}
+
+// run runs the callbacks of a topic until there are no more
+func (d *dispatcher) run(topic string) {
+	for {
+		d.lock.Lock()
+		queue := d.pending[topic]
+		if len(queue) == 0 {
+			delete(d.pending, topic)
+			d.lock.Unlock()
+			return
+		}
+		callback := queue[0]
+		d.pending[topic] = queue[1:]
+		d.lock.Unlock()
+		callback()
+	}
+}
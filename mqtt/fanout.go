@@ -0,0 +1,297 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Broker is one of the brokers of a FanOut client, along with the topics it carries
+type Broker struct {
+	Client   *Client
+	Prefixes map[string]string // topic prefixes replaced in this broker, such as "koolnova2mqtt" by "site1/koolnova2mqtt"
+	Classes  []string          // topic classes published to this broker. All if empty
+	ReadOnly bool              // do not subscribe to this broker, so it cannot send commands
+	Embedded []string          // topic classes with JSON payloads that refer to other topics, such as Home Assistant discovery
+}
+
+// FanOut is an MQTT client that publishes every message to several brokers, such as a
+// local broker for home automation and a cloud broker for monitoring. Each broker can
+// use its own topic prefixes and carry only some topic classes. The last retained message
+// of every topic is kept, and published again to the brokers that start a new session.
+type FanOut struct {
+	Brokers  []*Broker
+	retained map[string]*retainedMessage // last retained message of every topic
+	lock     sync.Mutex                  // protects retained
+}
+
+// retainedMessage is a retained message published through a FanOut client
+type retainedMessage struct {
+	class      string
+	qos        byte
+	payload    string
+	properties map[string]string
+}
+
+// NewFanOut returns a client that publishes to all the brokers
+func NewFanOut(brokers ...*Broker) *FanOut {
+	f := &FanOut{
+		Brokers:  brokers,
+		retained: make(map[string]*retainedMessage),
+	}
+	for _, b := range brokers {
+		b := b
+		b.Client.OnNewSession(func() {
+			f.republish(b)
+		})
+	}
+	return f
+}
+
+// Topic returns a topic or topic filter as seen by the broker, replacing its longest
+// matching prefix
+func (b *Broker) Topic(topic string) string {
+	return replacePrefix(topic, b.Prefixes)
+}
+
+// clientTopic returns the topic of a message received from the broker as seen by the
+// users of the FanOut client, undoing the prefix replacement
+func (b *Broker) clientTopic(topic string) string {
+	reverse := make(map[string]string, len(b.Prefixes))
+	for prefix, replacement := range b.Prefixes {
+		reverse[replacement] = prefix
+	}
+	return replacePrefix(topic, reverse)
+}
+
+// replacePrefix replaces the longest prefix of a topic that is in prefixes. Prefixes match
+// whole topic levels, so "koolnova" does not match "koolnova2mqtt/module".
+func replacePrefix(topic string, prefixes map[string]string) string {
+	longest := ""
+	for prefix := range prefixes {
+		if len(prefix) > len(longest) && (topic == prefix || strings.HasPrefix(topic, prefix+"/")) {
+			longest = prefix
+		}
+	}
+	if longest == "" {
+		return topic
+	}
+	return prefixes[longest] + topic[len(longest):]
+}
+
+// Payload returns the payload of a message as seen by the broker. The payloads of the
+// Embedded classes are JSON objects, such as Home Assistant discovery configurations, and
+// the topics they refer to, in keys such as "topic" or "state_topic", are replaced too.
+// Other payloads are not changed.
+func (b *Broker) Payload(class, payload string) string {
+	if len(b.Prefixes) == 0 || !strings.HasPrefix(payload, "{") || !contains(b.Embedded, class) {
+		return payload
+	}
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.UseNumber()
+	var config map[string]interface{}
+	if decoder.Decode(&config) != nil {
+		return payload
+	}
+	b.replaceTopics(config)
+	data, err := json.Marshal(config)
+	if err != nil {
+		return payload
+	}
+	return string(data)
+}
+
+// replaceTopics replaces the prefixes of the topics in a decoded JSON value
+func (b *Broker) replaceTopics(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if topic, ok := item.(string); ok && (key == "topic" || strings.HasSuffix(key, "_topic")) {
+				v[key] = b.Topic(topic)
+			} else {
+				b.replaceTopics(item)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			b.replaceTopics(item)
+		}
+	}
+}
+
+// contains returns whether list contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Carries returns whether messages of a topic class are published to the broker.
+// Messages without a class, such as the ones that clear retained topics, go to all brokers.
+func (b *Broker) Carries(class string) bool {
+	return class == "" || len(b.Classes) == 0 || contains(b.Classes, class)
+}
+
+func (f *FanOut) Publish(topic string, qos byte, retained bool, payload string) error {
+	return f.PublishClass("", topic, qos, retained, payload, nil)
+}
+
+func (f *FanOut) PublishWithProperties(topic string, qos byte, retained bool, payload string, properties map[string]string) error {
+	return f.PublishClass("", topic, qos, retained, payload, properties)
+}
+
+// PublishClass publishes a message to the brokers that carry its topic class. A broker
+// that is down does not hold up the others, so an error is only returned if the message
+// could not be published to any of them. Failures of a single broker are only reported
+// by its Stats, and retained messages reach it again when it starts a new session.
+func (f *FanOut) PublishClass(class, topic string, qos byte, retained bool, payload string, properties map[string]string) error {
+	if retained {
+		f.lock.Lock()
+		if payload == "" {
+			delete(f.retained, topic)
+		} else {
+			f.retained[topic] = &retainedMessage{class: class, qos: qos, payload: payload, properties: properties}
+		}
+		f.lock.Unlock()
+	}
+	var firstErr error
+	published := false
+	for _, b := range f.Brokers {
+		if !b.Carries(class) {
+			continue
+		}
+		err := b.Client.PublishWithProperties(b.Topic(topic), qos, retained, b.Payload(class, payload), properties)
+		if err == nil {
+			published = true
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if published {
+		return nil
+	}
+	return firstErr
+}
+
+func (f *FanOut) Subscribe(topic string, callback func(message string)) error {
+	return f.SubscribeRequests(topic, 0, func(message string, respond func(payload string) error) {
+		callback(message)
+	})
+}
+
+// SubscribeRequests subscribes to a topic in all brokers that are not read-only. Responses go
+// back to the broker the request came from. Brokers that are down subscribe when they
+// reconnect, so only a failure of the main broker, the first one, is returned.
+func (f *FanOut) SubscribeRequests(topic string, qos byte, callback func(message string, respond func(payload string) error)) error {
+	var mainErr error
+	for i, b := range f.Brokers {
+		if b.ReadOnly {
+			continue
+		}
+		err := b.Client.SubscribeRequests(b.Topic(topic), qos, callback)
+		if err != nil && i == 0 {
+			mainErr = err
+		} else if err != nil {
+			log.Printf("Cannot subscribe to %s on MQTT %s yet: %s\n", b.Topic(topic), b.Client.Server(), err)
+		}
+	}
+	return mainErr
+}
+
+// Unsubscribe cancels subscriptions in all brokers that are not read-only and returns the
+// first error, if any
+func (f *FanOut) Unsubscribe(topics ...string) error {
+	var firstErr error
+	for _, b := range f.Brokers {
+		if b.ReadOnly {
+			continue
+		}
+		brokerTopics := make([]string, len(topics))
+		for i, topic := range topics {
+			brokerTopics[i] = b.Topic(topic)
+		}
+		err := b.Client.Unsubscribe(brokerTopics...)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Retained returns the topics that have a retained message in any of the brokers and
+// match any of the given filters. Brokers are queried at the same time, and the topics
+// of the brokers that answered are returned along with the first error, if any.
+func (f *FanOut) Retained(filters []string) ([]string, error) {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	topics := make(map[string]bool)
+	for _, b := range f.Brokers {
+		wg.Add(1)
+		go func(b *Broker) {
+			defer wg.Done()
+			brokerFilters := make([]string, len(filters))
+			for i, filter := range filters {
+				brokerFilters[i] = b.Topic(filter)
+			}
+			list, err := b.Client.Retained(brokerFilters)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			for _, topic := range list {
+				topics[b.clientTopic(topic)] = true
+			}
+		}(b)
+	}
+	wg.Wait()
+
+	list := make([]string, 0, len(topics))
+	for topic := range topics {
+		list = append(list, topic)
+	}
+	sort.Strings(list)
+	return list, firstErr
+}
+
+// republish publishes the retained messages again to a broker that started a new session,
+// since it may have lost them
+func (f *FanOut) republish(b *Broker) {
+	f.lock.Lock()
+	topics := make([]string, 0, len(f.retained))
+	for topic, msg := range f.retained {
+		if b.Carries(msg.class) {
+			topics = append(topics, topic)
+		}
+	}
+	f.lock.Unlock()
+	if len(topics) == 0 {
+		return
+	}
+
+	log.Printf("Republishing %d retained topics to MQTT %s\n", len(topics), b.Client.Server())
+	sort.Strings(topics)
+	for _, topic := range topics {
+		// the message may have been replaced or cleared in the meantime
+		f.lock.Lock()
+		msg, ok := f.retained[topic]
+		f.lock.Unlock()
+		if ok {
+			b.Client.PublishWithProperties(b.Topic(topic), msg.qos, true, b.Payload(msg.class, msg.payload), msg.properties)
+		}
+	}
+}
+
+// Close closes the clients of all brokers
+func (f *FanOut) Close() error {
+	for _, b := range f.Brokers {
+		b.Client.Close()
+	}
+	return nil
+}
@@ -2,102 +2,509 @@ package mqtt
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"koolnova2mqtt/metrics"
 	"log"
+	"os"
+	"sort"
+	"sync"
 	"time"
-
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
 type Config struct {
-	Server   string
-	ClientID string
-	Username string
-	Password string
+	Server         string
+	ClientID       string
+	Username       string
+	Password       string
+	StatusTopic    string        // If set, "online" is published here on connect and "offline" as last will
+	StatusQoS      byte          // QoS of the status messages and the last will
+	StatusRetained bool          // Retain flag of the status messages and the last will
+	CACert         string        // PEM file with the CAs that sign the server certificate. Defaults to the system CAs
+	ClientCert     string        // PEM file with the client certificate, for mutual TLS
+	ClientKey      string        // PEM file with the key of ClientCert
+	ServerName     string        // Name expected in the server certificate. Defaults to the host of Server
+	Insecure       bool          // Do not verify the server certificate
+	Version        int           // MQTT protocol version: VERSION_311 (default) or VERSION_5
+	SessionExpiry  time.Duration // How long the broker keeps an MQTT 5 session after the connection is lost
+	OutboxSize     int           // Messages kept while disconnected and published on reconnection. Disabled if zero
+	OutboxFile     string        // If set, the outbox is saved to this file so it survives restarts
+	OutboxHistory  []string      // Topic filters that keep every message in the outbox, not only the latest one
 }
 
 type Client struct {
-	client MQTT.Client
-	ID     int
-	closed bool
+	conn          connection // nil until connected
+	dial          dialer
+	server        string
+	statusTopic   string
+	statusQoS     byte
+	statusRetain  bool
+	connections   int                      // successful connections
+	subscriptions map[string]*subscription // every topic subscribed, restored on reconnection
+	outbox        *outbox                  // messages published while disconnected, nil if disabled
+	flushes       chan struct{}            // asks the reconnection goroutine to publish the outbox
+	lock          sync.Mutex               // protects subscriptions
+	dispatcher    dispatcher               // runs the callbacks of subscriptions
+	session       int                      // MQTT session, see Session
+	onNewSession  func()                   // called after connecting to a new session, see OnNewSession
+	closed        bool                     // whether Close was called
+	connLock      sync.Mutex               // protects conn, session, onNewSession and closed, which change while reconnecting
+	Stats         Stats
+}
+
+// Stats counts MQTT connection and publishing problems
+type Stats struct {
+	Reconnects      metrics.Counter // successful connections after the first one
+	PublishFailures metrics.Counter // messages that could not be published
+	OutboxDropped   metrics.Counter // messages dropped from the outbox because it was full
+	OutboxReplayed  metrics.Counter // messages published from the outbox after reconnecting
 }
 
+const STATUS_ONLINE = "online"
+const STATUS_OFFLINE = "offline"
+
+// MQTT protocol versions
+const VERSION_311 = 3
+const VERSION_5 = 5
+
+const DEFAULT_SESSION_EXPIRY = time.Hour
+
+// RETAINED_WAIT is how long Retained waits for more retained messages before returning
+const RETAINED_WAIT = 500 * time.Millisecond
+
+// TIMEOUT is how long to wait for the broker to acknowledge a connection or an operation
+const TIMEOUT = 10 * time.Second
+
 var ErrNotConnected = errors.New("MQTT client not connected")
 
-func New(config *Config) *Client {
-	m := &Client{}
+// connection is a connection to the broker, with MQTT 3.1.1 or MQTT 5
+type connection interface {
+	publish(topic string, qos byte, retained bool, payload string, properties map[string]string) error
+	subscribe(filters map[string]byte, callback func(*message)) error
+	unsubscribe(filters ...string) error
+	isOpen() bool
+	disconnect()
+}
+
+// subscription is a topic subscribed by the client
+type subscription struct {
+	qos        byte
+	callback   func(*message)
+	subscribed bool // whether the broker accepted the subscription in the current session
+}
+
+// message is a message received from the broker
+type message struct {
+	topic    string
+	payload  string
+	retained bool
+	respond  func(payload string) error // publishes a response, nil unless the sender asked for one
+}
 
-	connOpts := MQTT.NewClientOptions().
-		AddBroker(config.Server).
-		SetClientID(config.ClientID).
-		SetCleanSession(true).
-		SetAutoReconnect(false)
+// dialer connects to the broker. clean discards the session of previous connections.
+// resumed is true if the broker kept the session, along with its subscriptions.
+type dialer func(clean bool) (conn connection, resumed bool, err error)
 
-	if config.Username != "" {
-		connOpts.SetUsername(config.Username)
-		if config.Password != "" {
-			connOpts.SetPassword(config.Password)
+// newTLSConfig returns the TLS configuration used to connect to ssl://, tls:// and wss:// servers
+func newTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.Insecure,
+	}
+	if config.CACert != "" {
+		pem, err := os.ReadFile(config.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA certificates: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CACert)
 		}
 	}
+	if config.ClientCert != "" || config.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
 
-	tlsConfig := &tls.Config{InsecureSkipVerify: true, ClientAuth: tls.NoClientCert}
-	connOpts.SetTLSConfig(tlsConfig)
+// New returns a client that connects to the server and keeps reconnecting until
+// closed. It fails if the TLS certificates or the outbox file cannot be loaded.
+func New(config *Config) (*Client, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Insecure {
+		log.Printf("Not verifying the certificate of MQTT server %s\n", config.Server)
+	}
 
-	connOpts.OnConnectionLost = func(c MQTT.Client, err error) {
-		log.Printf("MQTT disconnected: %s\n", err)
+	var dial dialer
+	switch config.Version {
+	case 0, VERSION_311:
+		dial = newDialer311(config, tlsConfig)
+	case VERSION_5:
+		dial = newDialer5(config, tlsConfig)
+	default:
+		return nil, fmt.Errorf("unsupported MQTT version %d", config.Version)
 	}
 
-	connect := func() {
-		log.Printf("Trying to connect to MQTT %s ...\n", config.Server)
-		newClient := MQTT.NewClient(connOpts)
-		token := newClient.Connect()
-		token.Wait()
-		if token.Error() == nil {
-			m.client = newClient
-			m.ID++
-			log.Printf("Connected to MQTT. Session ID %d\n", m.ID)
+	m := &Client{
+		dial:          dial,
+		server:        config.Server,
+		statusTopic:   config.StatusTopic,
+		statusQoS:     config.StatusQoS,
+		statusRetain:  config.StatusRetained,
+		subscriptions: make(map[string]*subscription),
+		flushes:       make(chan struct{}, 1),
+	}
+	if config.OutboxSize > 0 {
+		m.outbox, err = newOutbox(config.OutboxSize, config.OutboxFile, config.OutboxHistory, &m.Stats)
+		if err != nil {
+			return nil, err
 		}
 	}
-
-	connect()
+	m.connect()
 	go func() {
 		ticker := time.NewTicker(5 * time.Second)
-		for range ticker.C {
-			if m.closed {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-m.flushes:
+				if m.Connected() {
+					m.flush()
+				}
+				continue
+			}
+			conn, closed := m.getConn()
+			if closed {
 				return
 			}
-			if m.client == nil || !m.client.IsConnectionOpen() {
-				connect()
+			if conn == nil || !conn.isOpen() {
+				m.connect()
+			} else {
+				// retry messages and subscriptions that failed on reconnection
+				m.flush()
+				m.resubscribe(conn, false)
 			}
 		}
-		if m.client != nil {
-			m.client.Disconnect(100)
-		}
 	}()
-	return m
+	return m, nil
+}
+
+// getConn returns the current connection, nil until connected, and whether Close was called
+func (m *Client) getConn() (connection, bool) {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	return m.conn, m.closed
+}
+
+// connect connects to the broker. Unless the broker resumed the previous session,
+// subscriptions are restored and the session changes, since retained messages may have
+// been lost too.
+func (m *Client) connect() {
+	log.Printf("Trying to connect to MQTT %s ...\n", m.server)
+	conn, resumed, err := m.dial(m.connections == 0)
+	if err != nil {
+		log.Printf("Cannot connect to MQTT %s: %s\n", m.server, err)
+		return
+	}
+	m.connLock.Lock()
+	if m.closed {
+		m.connLock.Unlock()
+		conn.disconnect()
+		return
+	}
+	m.conn = conn
+	m.connLock.Unlock()
+	m.connections++
+	if m.connections > 1 {
+		m.Stats.Reconnects.Inc()
+	}
+	if resumed {
+		log.Printf("Connected to MQTT %s. Resumed session ID %d\n", m.server, m.Session())
+	}
+	m.resubscribe(conn, !resumed)
+	m.flush()
+	var onNewSession func()
+	if !resumed {
+		m.connLock.Lock()
+		m.session++
+		session := m.session
+		onNewSession = m.onNewSession
+		m.connLock.Unlock()
+		log.Printf("Connected to MQTT %s. Session ID %d\n", m.server, session)
+	}
+	if m.statusTopic != "" {
+		m.Publish(m.statusTopic, m.statusQoS, m.statusRetain, STATUS_ONLINE)
+	}
+	if onNewSession != nil {
+		onNewSession()
+	}
+}
+
+// resubscribe subscribes to the topics that the broker does not have yet, such as those
+// subscribed while disconnected, or to all of them on a new session, which lost them
+func (m *Client) resubscribe(conn connection, newSession bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var topics []string
+	for topic, sub := range m.subscriptions {
+		if newSession || !sub.subscribed {
+			topics = append(topics, topic)
+		}
+	}
+	if len(topics) == 0 {
+		return
+	}
+	sort.Strings(topics)
+	restored := 0
+	for _, topic := range topics {
+		sub := m.subscriptions[topic]
+		err := conn.subscribe(map[string]byte{topic: sub.qos}, sub.callback)
+		sub.subscribed = err == nil
+		if err != nil {
+			log.Printf("Cannot restore subscription to %s: %s\n", topic, err)
+			continue
+		}
+		restored++
+	}
+	log.Printf("Restored %d of %d MQTT subscriptions on %s\n", restored, len(topics), m.server)
 }
 
 func (m *Client) Publish(topic string, qos byte, retained bool, payload string) error {
-	if m.client == nil {
+	return m.PublishWithProperties(topic, qos, retained, payload, nil)
+}
+
+// PublishWithProperties publishes a message with user properties, such as the module
+// it is about. Properties are only sent with MQTT 5. If the outbox is enabled, messages
+// published while disconnected are kept in it, and published in order on reconnection.
+func (m *Client) PublishWithProperties(topic string, qos byte, retained bool, payload string, properties map[string]string) error {
+	// while the outbox is not empty, messages are queued behind it to keep their order
+	if m.outbox != nil {
+		connected := m.Connected()
+		if !connected || m.outbox.len() > 0 {
+			m.queue(topic, qos, retained, payload, properties)
+			if connected {
+				m.requestFlush()
+			}
+			return nil
+		}
+	}
+	conn, _ := m.getConn()
+	if conn == nil {
+		m.Stats.PublishFailures.Inc()
 		return ErrNotConnected
 	}
-	token := m.client.Publish(topic, qos, retained, payload)
-	token.Wait()
-	return token.Error()
+	err := conn.publish(topic, qos, retained, payload, properties)
+	if err != nil && m.outbox != nil && !conn.isOpen() {
+		m.queue(topic, qos, retained, payload, properties)
+		return nil
+	}
+	if err != nil {
+		m.Stats.PublishFailures.Inc()
+	}
+	return err
+}
+
+// queue adds a message to the outbox
+func (m *Client) queue(topic string, qos byte, retained bool, payload string, properties map[string]string) {
+	m.outbox.add(&outboxMessage{
+		Topic:      topic,
+		QoS:        qos,
+		Retained:   retained,
+		Payload:    payload,
+		Properties: properties,
+		Time:       time.Now(),
+	})
+}
+
+// flush publishes the messages of the outbox, if any, in the order they were published
+func (m *Client) flush() {
+	if m.outbox == nil {
+		return
+	}
+	n := m.outbox.len()
+	if n == 0 {
+		return
+	}
+	conn, _ := m.getConn()
+	err := m.outbox.flush(func(msg *outboxMessage) error {
+		return conn.publish(msg.Topic, msg.QoS, msg.Retained, msg.Payload, msg.properties())
+	})
+	if err != nil {
+		log.Printf("Cannot publish the MQTT outbox, %d messages waiting: %s\n", m.outbox.len(), err)
+		return
+	}
+	log.Printf("Published %d messages from the MQTT outbox\n", n)
+}
+
+// requestFlush publishes the outbox soon, without waiting for the next retry
+func (m *Client) requestFlush() {
+	select {
+	case m.flushes <- struct{}{}:
+	default:
+	}
+}
+
+// Queued returns the number of messages waiting in the outbox
+func (m *Client) Queued() int {
+	if m.outbox == nil {
+		return 0
+	}
+	return m.outbox.len()
+}
+
+// Server returns the URL of the broker
+func (m *Client) Server() string {
+	return m.server
+}
+
+// Connected returns whether the client is currently connected to the broker
+func (m *Client) Connected() bool {
+	conn, _ := m.getConn()
+	return conn != nil && conn.isOpen()
+}
+
+// OnNewSession sets a function that is called after connecting to a new session, which may
+// have lost the retained messages. It is not called when an MQTT 5 session is resumed.
+func (m *Client) OnNewSession(callback func()) {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	m.onNewSession = callback
+}
+
+// Session returns the MQTT session. It changes on reconnection, unless an MQTT 5 session
+// is resumed, since the broker may have lost the retained messages.
+func (m *Client) Session() int {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	return m.session
 }
 
 func (m *Client) Subscribe(topic string, callback func(message string)) error {
-	if m.client == nil {
+	return m.SubscribeRequests(topic, 0, func(message string, respond func(payload string) error) {
+		callback(message)
+	})
+}
+
+// SubscribeRequests subscribes with a QoS to a topic where requests are received. With MQTT 5, respond
+// publishes a response to the response topic of the request, along with its correlation data.
+// respond is nil if the sender did not ask for a response. Requests to the same topic are handled
+// in order, and requests to different topics concurrently. The subscription is kept even if
+// it fails, such as while disconnected, and made again when the client (re)connects.
+func (m *Client) SubscribeRequests(topic string, qos byte, callback func(message string, respond func(payload string) error)) error {
+	sub := &subscription{
+		qos: qos,
+		callback: func(msg *message) {
+			m.dispatcher.dispatch(msg.topic, func() {
+				callback(msg.payload, msg.respond)
+			})
+		},
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.subscriptions[topic] = sub
+	conn, _ := m.getConn()
+	if conn == nil {
 		return ErrNotConnected
 	}
-	token := m.client.Subscribe(topic, 0, func(c MQTT.Client, m MQTT.Message) {
-		callback(string(m.Payload()))
+	err := conn.subscribe(map[string]byte{topic: qos}, sub.callback)
+	sub.subscribed = err == nil
+	return err
+}
+
+// Unsubscribe cancels subscriptions, so they are not made again on reconnection either
+func (m *Client) Unsubscribe(topics ...string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, topic := range topics {
+		delete(m.subscriptions, topic)
+	}
+	conn, _ := m.getConn()
+	if conn == nil || !conn.isOpen() {
+		return nil
+	}
+	return conn.unsubscribe(topics...)
+}
+
+// Retained returns the topics that have a retained message and match any of the
+// given filters. The broker sends retained messages right after subscribing, so
+// topics are collected until no more messages arrive for RETAINED_WAIT.
+func (m *Client) Retained(filters []string) ([]string, error) {
+	conn, _ := m.getConn()
+	if conn == nil {
+		return nil, ErrNotConnected
+	}
+	var lock sync.Mutex
+	topics := make(map[string]bool)
+	received := make(chan struct{}, 1)
+	subscriptions := make(map[string]byte)
+	for _, filter := range filters {
+		subscriptions[filter] = 0
+	}
+	err := conn.subscribe(subscriptions, func(msg *message) {
+		if !msg.retained || len(msg.payload) == 0 {
+			return
+		}
+		lock.Lock()
+		topics[msg.topic] = true
+		lock.Unlock()
+		select {
+		case received <- struct{}{}:
+		default:
+		}
 	})
-	token.Wait()
-	return token.Error()
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(RETAINED_WAIT)
+	for waiting := true; waiting; {
+		select {
+		case <-received:
+			timer.Reset(RETAINED_WAIT)
+		case <-timer.C:
+			waiting = false
+		}
+	}
+	err = conn.unsubscribe(filters...)
+
+	lock.Lock()
+	defer lock.Unlock()
+	list := make([]string, 0, len(topics))
+	for topic := range topics {
+		list = append(list, topic)
+	}
+	sort.Strings(list)
+	return list, err
 }
 
+// Close stops reconnecting and disconnects from the broker. The broker does not
+// send the last will on a clean disconnect, so the offline status is published first,
+// after any messages waiting in the outbox. Messages that cannot be published are saved
+// to the outbox file, if any, and the offline status is published without them.
 func (m *Client) Close() error {
+	m.connLock.Lock()
 	m.closed = true
+	conn := m.conn
+	m.connLock.Unlock()
+	if m.outbox != nil {
+		defer m.outbox.sync()
+	}
+	if conn == nil {
+		return nil
+	}
+	if conn.isOpen() {
+		m.flush()
+	}
+	if m.statusTopic != "" && conn.isOpen() {
+		conn.publish(m.statusTopic, m.statusQoS, m.statusRetain, STATUS_OFFLINE, nil)
+	}
+	conn.disconnect()
 	return nil
 }
@@ -0,0 +1,367 @@
+package mqtt
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestTLSConfig(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	file := func(name string) string {
+		return filepath.Join(t.TestdataDir, name)
+	}
+	mustFail := func(config *Config, message string) {
+		_, err := New(config)
+		t.MustFail(err, "expected New to fail")
+		t.Assert(strings.Contains(err.Error(), message), "unexpected error %s", err)
+	}
+
+	// the server certificate is verified against the system CAs by default
+	tlsConfig, err := newTLSConfig(&Config{})
+	t.Ok(err)
+	t.Equals(false, tlsConfig.InsecureSkipVerify)
+	t.Assert(tlsConfig.RootCAs == nil, "expected the system CAs")
+
+	tlsConfig, err = newTLSConfig(&Config{
+		CACert:     file("ca.pem"),
+		ClientCert: file("client.pem"),
+		ClientKey:  file("client-key.pem"),
+		ServerName: "broker",
+	})
+	t.Ok(err)
+	t.Assert(tlsConfig.RootCAs != nil, "expected the CA certificates to be loaded")
+	t.Equals(1, len(tlsConfig.Certificates))
+	t.Equals("broker", tlsConfig.ServerName)
+
+	// certificates that cannot be loaded fail before connecting
+	mustFail(&Config{CACert: file("missing.pem")}, "cannot read CA certificates")
+	mustFail(&Config{CACert: file("client-key.pem")}, "no certificates found")
+	mustFail(&Config{ClientCert: file("client.pem"), ClientKey: file("ca.pem")}, "cannot load client certificate")
+}
+
+// fakeConnection records the messages published and the topics subscribed through it.
+// Subscriptions receive the retained messages that match them.
+type fakeConnection struct {
+	published  []string
+	properties []map[string]string
+	subscribed []string
+	callbacks  map[string]func(*message)
+	retained   map[string]string
+	lost       bool
+	rejected   string // topic whose messages fail without losing the connection
+}
+
+func (c *fakeConnection) publish(topic string, qos byte, retained bool, payload string, properties map[string]string) error {
+	if c.lost {
+		return errors.New("connection lost")
+	}
+	if topic == c.rejected {
+		return errors.New("message rejected")
+	}
+	c.published = append(c.published, topic+"="+payload)
+	c.properties = append(c.properties, properties)
+	return nil
+}
+
+func (c *fakeConnection) subscribe(filters map[string]byte, callback func(*message)) error {
+	for filter := range filters {
+		c.subscribed = append(c.subscribed, filter)
+		c.callbacks[filter] = callback
+		for topic, payload := range c.retained {
+			if matchTopic(filter, topic) {
+				callback(&message{topic: topic, payload: payload, retained: true})
+			}
+		}
+	}
+	return nil
+}
+
+func (c *fakeConnection) unsubscribe(filters ...string) error { return nil }
+func (c *fakeConnection) isOpen() bool                        { return !c.lost }
+func (c *fakeConnection) disconnect()                         {}
+
+func TestResubscribe(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var conn *fakeConnection
+	var resumed bool
+	var dialErr error
+	m := &Client{
+		dial: func(clean bool) (connection, bool, error) {
+			if dialErr != nil {
+				return nil, false, dialErr
+			}
+			conn = &fakeConnection{callbacks: make(map[string]func(*message))}
+			return conn, resumed, nil
+		},
+		subscriptions: make(map[string]*subscription),
+	}
+	m.connect()
+	t.Equals(1, m.Session())
+
+	received := make(chan string, 1)
+	t.Ok(m.Subscribe("b/set", func(message string) {
+		received <- message
+	}))
+	t.Ok(m.Subscribe("a/set", func(message string) {
+		received <- message
+	}))
+
+	// subscriptions are restored on a new session, which changes the ID
+	m.connect()
+	t.Equals(2, m.Session())
+	t.Equals([]string{"a/set", "b/set"}, conn.subscribed)
+	conn.callbacks["b/set"](&message{topic: "b/set", payload: "21"})
+	t.Equals("21", <-received)
+
+	// a resumed session keeps its subscriptions and its ID
+	resumed = true
+	m.connect()
+	t.Equals(2, m.Session())
+	t.Equals(0, len(conn.subscribed))
+
+	// failed connections keep the previous session
+	dialErr = errors.New("connection refused")
+	m.connect()
+	t.Equals(2, m.Session())
+	t.Equals(uint64(2), m.Stats.Reconnects.Value())
+
+	// subscriptions made while disconnected are kept and made on connection, even if resumed
+	m = &Client{dial: m.dial, subscriptions: make(map[string]*subscription)}
+	t.Equals(ErrNotConnected, m.Subscribe("c/set", func(message string) {}))
+	dialErr = nil
+	m.connect()
+	t.Equals([]string{"c/set"}, conn.subscribed)
+
+	// cancelled subscriptions are not made again
+	t.Ok(m.Subscribe("d/set", func(message string) {}))
+	t.Ok(m.Unsubscribe("c/set"))
+	resumed = false
+	m.connect()
+	t.Equals([]string{"d/set"}, conn.subscribed)
+}
+
+func TestDispatcher(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var d dispatcher
+	var lock sync.Mutex
+	var handled []string
+	handle := func(value string) func() {
+		return func() {
+			lock.Lock()
+			handled = append(handled, value)
+			lock.Unlock()
+		}
+	}
+
+	// a slow callback holds up the messages of its topic, not those of other topics
+	release := make(chan struct{})
+	done := make(chan struct{})
+	d.dispatch("a/set", func() {
+		<-release
+		handle("a1")()
+	})
+	for _, value := range []string{"a2", "a3", "a4"} {
+		d.dispatch("a/set", handle(value))
+	}
+	d.dispatch("b/set", func() {
+		handle("b1")()
+		close(release)
+	})
+	d.dispatch("a/set", func() {
+		close(done)
+	})
+	<-done
+	t.Equals([]string{"b1", "a1", "a2", "a3", "a4"}, handled)
+}
+
+func TestOutbox(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var conn *fakeConnection
+	file := filepath.Join(tx.TempDir(), "outbox.json")
+	m := &Client{
+		dial: func(clean bool) (connection, bool, error) {
+			conn = &fakeConnection{callbacks: make(map[string]func(*message))}
+			return conn, false, nil
+		},
+		subscriptions: make(map[string]*subscription),
+	}
+	var err error
+	m.outbox, err = newOutbox(3, file, []string{"a/+/temp"}, &m.Stats)
+	t.Ok(err)
+
+	// while disconnected, only the latest message of a topic is kept, unless it keeps its history
+	t.Ok(m.Publish("x", 0, true, "1"))
+	t.Ok(m.Publish("x", 0, true, "2"))
+	t.Ok(m.Publish("a/1/temp", 0, true, "20"))
+	t.Ok(m.Publish("a/1/temp", 0, true, "21"))
+	t.Equals(3, m.Queued())
+	// the oldest message is dropped when the outbox is full
+	t.Ok(m.Publish("y", 0, false, "1"))
+	t.Equals(3, m.Queued())
+	t.Equals(uint64(1), m.Stats.OutboxDropped.Value())
+
+	// the outbox is saved after OUTBOX_SAVE_DELAY, or right away on sync, and survives a restart
+	saved, err := newOutbox(3, file, nil, &Stats{})
+	t.Ok(err)
+	t.Equals(0, saved.len())
+	m.outbox.sync()
+	saved, err = newOutbox(3, file, nil, &Stats{})
+	t.Ok(err)
+	t.Equals(3, saved.len())
+
+	// messages are published in order on reconnection
+	m.connect()
+	t.Equals([]string{"a/1/temp=20", "a/1/temp=21", "y=1"}, conn.published)
+	// replayed messages carry the time they were published
+	_, err = time.Parse(time.RFC3339, conn.properties[0][TIMESTAMP_PROPERTY])
+	t.Ok(err)
+	t.Equals(0, m.Queued())
+	t.Equals(uint64(3), m.Stats.OutboxReplayed.Value())
+	saved, err = newOutbox(3, file, nil, &Stats{})
+	t.Ok(err)
+	t.Equals(0, saved.len())
+
+	// messages that fail because the connection was lost are kept too
+	conn.lost = true
+	t.Ok(m.Publish("z", 0, true, "1"))
+	t.Equals(1, m.Queued())
+	t.Equals(uint64(0), m.Stats.PublishFailures.Value())
+
+	// messages queued behind the outbox while connected publish it without waiting for a retry
+	m.flushes = make(chan struct{}, 1)
+	conn.lost = false
+	conn.rejected = "z"
+	t.Ok(m.Publish("w", 0, true, "1"))
+	t.Equals(2, m.Queued())
+	select {
+	case <-m.flushes:
+	default:
+		t.Fatalf("expected a flush request")
+	}
+
+	// the offline status is published on close even if the outbox cannot be published
+	m.statusTopic = "status"
+	conn.published = nil
+	t.Ok(m.Close())
+	t.Equals([]string{"status=offline"}, conn.published)
+	t.Equals(2, m.Queued())
+
+	t.Equals(true, matchTopic("a/#", "a/b/c"))
+	t.Equals(true, matchTopic("+/b/+", "a/b/c"))
+	t.Equals(false, matchTopic("a/+", "a/b/c"))
+	t.Equals(false, matchTopic("a/b/c/d", "a/b/c"))
+}
+
+// newFakeClient returns a client connected through a fakeConnection
+func newFakeClient() (*Client, *fakeConnection) {
+	conn := &fakeConnection{callbacks: make(map[string]func(*message)), retained: make(map[string]string)}
+	m := &Client{
+		dial: func(clean bool) (connection, bool, error) {
+			return conn, false, nil
+		},
+		subscriptions: make(map[string]*subscription),
+	}
+	m.connect()
+	return m, conn
+}
+
+func TestFanOut(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	local, localConn := newFakeClient()
+	cloud, cloudConn := newFakeClient()
+	f := NewFanOut(&Broker{Client: local}, &Broker{
+		Client:   cloud,
+		Prefixes: map[string]string{"k2m": "site1/k2m"},
+		Classes:  []string{"telemetry"},
+		ReadOnly: true,
+	})
+
+	// messages go to the brokers that carry their class, with their own prefixes
+	t.Ok(f.PublishClass("telemetry", "k2m/m/zone1/currentTemp", 0, true, "21", nil))
+	t.Ok(f.PublishClass("state", "k2m/m/zone1/targetTemp", 0, true, "22", nil))
+	t.Ok(f.Publish("k2m/m/zone2/targetTemp", 0, true, ""))
+	t.Ok(f.Publish("k2mx/m", 0, true, "1"))
+	t.Equals([]string{"k2m/m/zone1/currentTemp=21", "k2m/m/zone1/targetTemp=22", "k2m/m/zone2/targetTemp=", "k2mx/m=1"}, localConn.published)
+	t.Equals([]string{"site1/k2m/m/zone1/currentTemp=21", "site1/k2m/m/zone2/targetTemp=", "k2mx/m=1"}, cloudConn.published)
+
+	// the discovery configuration refers to the topics of the broker it is published to
+	discovery, discoveryConn := newFakeClient()
+	f.Brokers = append(f.Brokers, &Broker{
+		Client:   discovery,
+		Prefixes: map[string]string{"k2m": "site1/k2m", "ha": "site1/ha"},
+		Embedded: []string{"discovery"},
+	})
+	t.Ok(f.PublishClass("discovery", "ha/climate/m/zone1/config", 0, true, `{"availability":[{"topic":"k2m/status"}],"name":"k2m","precision":0.1,"state_topic":"k2m/m/zone1/currentTemp"}`, nil))
+	t.Equals(`ha/climate/m/zone1/config={"availability":[{"topic":"k2m/status"}],"name":"k2m","precision":0.1,"state_topic":"k2m/m/zone1/currentTemp"}`, localConn.published[len(localConn.published)-1])
+	t.Equals([]string{`site1/ha/climate/m/zone1/config={"availability":[{"topic":"site1/k2m/status"}],"name":"k2m","precision":0.1,"state_topic":"site1/k2m/m/zone1/currentTemp"}`}, discoveryConn.published)
+	// other payloads are left alone
+	t.Ok(f.PublishClass("discovery", "homie/m/$homie", 0, true, "4.0", nil))
+	t.Equals("homie/m/$homie=4.0", discoveryConn.published[1])
+	// topics of modules with a prefix of their own under the replaced prefix are replaced too
+	t.Ok(f.PublishClass("discovery", "ha/climate/g/zone1/config", 0, true, `{"state_topic":"k2m/garage/g/zone1/currentTemp"}`, nil))
+	t.Equals(`site1/ha/climate/g/zone1/config={"state_topic":"site1/k2m/garage/g/zone1/currentTemp"}`, discoveryConn.published[2])
+	f.Brokers = f.Brokers[:2]
+
+	// commands are only accepted from brokers that are not read-only
+	t.Ok(f.Subscribe("k2m/m/zone1/targetTemp/set", func(message string) {}))
+	t.Equals([]string{"k2m/m/zone1/targetTemp/set"}, localConn.subscribed)
+	t.Equals(0, len(cloudConn.subscribed))
+
+	// a broker that is down subscribes when it connects, only the main broker makes subscribing fail
+	var remoteConn *fakeConnection
+	remote := &Client{
+		dial: func(clean bool) (connection, bool, error) {
+			if remoteConn == nil {
+				return nil, false, errors.New("connection refused")
+			}
+			return remoteConn, false, nil
+		},
+		subscriptions: make(map[string]*subscription),
+	}
+	remote.connect()
+	t.Ok(NewFanOut(&Broker{Client: local}, &Broker{Client: remote}).Subscribe("k2m/m/zone2/targetTemp/set", func(message string) {}))
+	t.Equals(ErrNotConnected, NewFanOut(&Broker{Client: remote}, &Broker{Client: local}).Subscribe("k2m/m/zone3/targetTemp/set", func(message string) {}))
+	remoteConn = &fakeConnection{callbacks: make(map[string]func(*message))}
+	remote.connect()
+	t.Equals([]string{"k2m/m/zone2/targetTemp/set", "k2m/m/zone3/targetTemp/set"}, remoteConn.subscribed)
+
+	// retained topics of all brokers are listed with the prefixes of the client
+	localConn.retained["k2m/m/zone1/targetTemp"] = "22"
+	cloudConn.retained["site1/k2m/m/zone1/currentTemp"] = "21"
+	cloudConn.retained["site1/k2m/m/zone3/currentTemp"] = "20"
+	topics, err := f.Retained([]string{"k2m/m/#"})
+	t.Ok(err)
+	t.Equals([]string{"k2m/m/zone1/currentTemp", "k2m/m/zone1/targetTemp", "k2m/m/zone3/currentTemp"}, topics)
+
+	// a broker that is down does not make publishing fail, unless all of them are
+	cloudConn.lost = true
+	t.Ok(f.PublishClass("telemetry", "k2m/m/zone1/currentTemp", 0, true, "21", nil))
+	t.Equals(uint64(1), cloud.Stats.PublishFailures.Value())
+	localConn.lost = true
+	t.MustFail(f.PublishClass("telemetry", "k2m/m/zone1/currentTemp", 0, true, "21", nil), "expected publishing to fail")
+
+	// a broker that starts a new session gets the retained messages of its classes again
+	cloudConn.lost = false
+	localConn.lost = false
+	localConn.published = nil
+	cloudConn.published = nil
+	cloud.connect()
+	t.Equals([]string{"site1/k2m/m/zone1/currentTemp=21", "k2mx/m=1"}, cloudConn.published)
+	t.Equals(0, len(localConn.published))
+}
@@ -0,0 +1,213 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outboxMessage is a message published while disconnected, waiting to be sent
+type outboxMessage struct {
+	Topic      string            `json:"topic"`
+	QoS        byte              `json:"qos"`
+	Retained   bool              `json:"retained"`
+	Payload    string            `json:"payload"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Time       time.Time         `json:"timestamp"`
+}
+
+// TIMESTAMP_PROPERTY is the user property with the time a message of the outbox was
+// published, sent when it is replayed so subscribers can tell it from current messages
+const TIMESTAMP_PROPERTY = "timestamp"
+
+// OUTBOX_SAVE_DELAY is how long new messages wait before the outbox file is written, so
+// the messages published by a poll are saved together instead of rewriting the file for each
+const OUTBOX_SAVE_DELAY = 10 * time.Second
+
+// outbox keeps the messages published while disconnected, in the order they were published.
+// Only the latest message of every topic is kept, unless the topic matches one of the history
+// filters. Once size messages are waiting, the oldest one is dropped. If file is set, the
+// messages are saved to it, so they survive a restart.
+type outbox struct {
+	size      int
+	file      string
+	history   []string // topic filters, such as "koolnova2mqtt/+/+/currentTemp"
+	messages  []*outboxMessage
+	saveTimer *time.Timer // saves the messages after OUTBOX_SAVE_DELAY, nil if they were saved
+	lock      sync.Mutex  // protects messages, saveTimer and file
+	stats     *Stats
+}
+
+// properties returns the user properties of the message, along with the time it was published
+func (msg *outboxMessage) properties() map[string]string {
+	if msg.Time.IsZero() {
+		return msg.Properties
+	}
+	properties := make(map[string]string, len(msg.Properties)+1)
+	for key, value := range msg.Properties {
+		properties[key] = value
+	}
+	properties[TIMESTAMP_PROPERTY] = msg.Time.Format(time.RFC3339)
+	return properties
+}
+
+// newOutbox returns an outbox with the messages saved to file, if any
+func newOutbox(size int, file string, history []string, stats *Stats) (*outbox, error) {
+	o := &outbox{
+		size:    size,
+		file:    file,
+		history: history,
+		stats:   stats,
+	}
+	if file == "" {
+		return o, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read outbox: %w", err)
+	}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &o.messages)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read outbox %s: %w", file, err)
+		}
+	}
+	for len(o.messages) > o.size {
+		o.drop(0)
+	}
+	return o, nil
+}
+
+// matchTopic returns whether a topic matches a filter with + and # wildcards
+func matchTopic(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i == len(topicLevels) || level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// keepsHistory returns whether every message published to a topic is kept
+func (o *outbox) keepsHistory(topic string) bool {
+	for _, filter := range o.history {
+		if matchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds a message at the end of the outbox, replacing the previous message of its topic
+// unless the topic keeps its history
+func (o *outbox) add(msg *outboxMessage) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if !o.keepsHistory(msg.Topic) {
+		for i, m := range o.messages {
+			if m.Topic == msg.Topic {
+				o.messages = append(o.messages[:i], o.messages[i+1:]...)
+				break
+			}
+		}
+	}
+	o.messages = append(o.messages, msg)
+	if len(o.messages) > o.size {
+		o.drop(0)
+	}
+	if o.file != "" && o.saveTimer == nil {
+		o.saveTimer = time.AfterFunc(OUTBOX_SAVE_DELAY, o.sync)
+	}
+}
+
+// drop removes the i-th message because the outbox is full. o.lock must be held.
+func (o *outbox) drop(i int) {
+	o.messages = append(o.messages[:i], o.messages[i+1:]...)
+	o.stats.OutboxDropped.Inc()
+}
+
+// len returns the number of messages waiting
+func (o *outbox) len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.messages)
+}
+
+// flush sends the messages in order until the outbox is empty or send fails.
+// Messages added in the meantime are also sent. The file is saved once at the end.
+func (o *outbox) flush(send func(*outboxMessage) error) error {
+	sent := 0
+	defer func() {
+		if sent > 0 {
+			o.lock.Lock()
+			o.save()
+			o.lock.Unlock()
+		}
+	}()
+	for {
+		o.lock.Lock()
+		if len(o.messages) == 0 {
+			o.lock.Unlock()
+			return nil
+		}
+		msg := o.messages[0]
+		o.lock.Unlock()
+
+		err := send(msg)
+		if err != nil {
+			return err
+		}
+		o.stats.OutboxReplayed.Inc()
+		sent++
+
+		o.lock.Lock()
+		// the message may have been dropped or replaced while it was being sent
+		if len(o.messages) > 0 && o.messages[0] == msg {
+			o.messages = o.messages[1:]
+		}
+		o.lock.Unlock()
+	}
+}
+
+// sync writes the messages that are waiting to be saved right away
+func (o *outbox) sync() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.saveTimer != nil {
+		o.save()
+	}
+}
+
+// save writes the messages to the outbox file, if any. It is replaced atomically,
+// so a crash does not leave a partial file. o.lock must be held.
+func (o *outbox) save() {
+	if o.saveTimer != nil {
+		o.saveTimer.Stop()
+		o.saveTimer = nil
+	}
+	if o.file == "" {
+		return
+	}
+	data, _ := json.Marshal(o.messages)
+	tmp := o.file + ".tmp"
+	err := os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, o.file)
+	}
+	if err != nil {
+		log.Printf("Cannot save MQTT outbox: %s\n", err)
+	}
+}
@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"log"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// connection311 is an MQTT 3.1.1 connection. Sessions are clean, so subscriptions
+// are lost when the connection is.
+type connection311 struct {
+	client MQTT.Client
+}
+
+// newDialer311 returns a dialer of MQTT 3.1.1 connections
+func newDialer311(config *Config, tlsConfig *tls.Config) dialer {
+	connOpts := MQTT.NewClientOptions().
+		AddBroker(config.Server).
+		SetClientID(config.ClientID).
+		SetCleanSession(true).
+		SetAutoReconnect(false)
+
+	if config.Username != "" {
+		connOpts.SetUsername(config.Username)
+		if config.Password != "" {
+			connOpts.SetPassword(config.Password)
+		}
+	}
+
+	if config.StatusTopic != "" {
+		connOpts.SetWill(config.StatusTopic, STATUS_OFFLINE, config.StatusQoS, config.StatusRetained)
+	}
+
+	connOpts.SetTLSConfig(tlsConfig)
+
+	connOpts.OnConnectionLost = func(c MQTT.Client, err error) {
+		log.Printf("MQTT disconnected: %s\n", err)
+	}
+
+	return func(clean bool) (connection, bool, error) {
+		client := MQTT.NewClient(connOpts)
+		token := client.Connect()
+		token.Wait()
+		if token.Error() != nil {
+			return nil, false, token.Error()
+		}
+		return &connection311{client: client}, false, nil
+	}
+}
+
+// publish publishes a message. MQTT 3.1.1 has no user properties, so they are ignored.
+func (c *connection311) publish(topic string, qos byte, retained bool, payload string, properties map[string]string) error {
+	token := c.client.Publish(topic, qos, retained, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func (c *connection311) subscribe(filters map[string]byte, callback func(*message)) error {
+	token := c.client.SubscribeMultiple(filters, func(_ MQTT.Client, msg MQTT.Message) {
+		callback(&message{
+			topic:    msg.Topic(),
+			payload:  string(msg.Payload()),
+			retained: msg.Retained(),
+		})
+	})
+	token.Wait()
+	return token.Error()
+}
+
+func (c *connection311) unsubscribe(filters ...string) error {
+	token := c.client.Unsubscribe(filters...)
+	token.Wait()
+	return token.Error()
+}
+
+func (c *connection311) isOpen() bool {
+	return c.client.IsConnectionOpen()
+}
+
+func (c *connection311) disconnect() {
+	c.client.Disconnect(250)
+}
@@ -0,0 +1,223 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// connection5 is an MQTT 5 connection. Sessions persist for SessionExpiry after the
+// connection is lost, so the broker keeps the subscriptions if the client reconnects in time.
+type connection5 struct {
+	client  *paho.Client
+	session *session5
+	open    int32 // 1 until the connection is lost
+}
+
+// session5 is shared by all connections of a client. Message handlers are registered
+// in its router, so they survive reconnections along with the broker session.
+type session5 struct {
+	router  *paho.StandardRouter
+	lock    sync.Mutex
+	current *connection5 // latest connection, used to respond to requests
+}
+
+// respond publishes a response through the latest connection, since the request
+// may have been received through a previous one that is now closed
+func (s *session5) respond(topic string, correlationData []byte, payload string) error {
+	s.lock.Lock()
+	c := s.current
+	s.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+	_, err := c.client.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		Payload: []byte(payload),
+		Properties: &paho.PublishProperties{
+			CorrelationData: correlationData,
+		},
+	})
+	return err
+}
+
+// newDialer5 returns a dialer of MQTT 5 connections
+func newDialer5(config *Config, tlsConfig *tls.Config) dialer {
+	session := &session5{router: paho.NewStandardRouter()}
+	sessionExpiry := uint32(DEFAULT_SESSION_EXPIRY / time.Second)
+	if config.SessionExpiry != 0 {
+		sessionExpiry = uint32(config.SessionExpiry / time.Second)
+	}
+
+	return func(clean bool) (connection, bool, error) {
+		conn, err := dial(config.Server, tlsConfig)
+		if err != nil {
+			return nil, false, err
+		}
+		c := &connection5{session: session, open: 1}
+		c.client = paho.NewClient(paho.ClientConfig{
+			ClientID: config.ClientID,
+			Conn:     packets.NewThreadSafeConn(conn),
+			Router:   session.router,
+			OnClientError: func(err error) {
+				log.Printf("MQTT disconnected: %s\n", err)
+				atomic.StoreInt32(&c.open, 0)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				log.Printf("MQTT disconnected by the server, reason code %d\n", d.ReasonCode)
+				atomic.StoreInt32(&c.open, 0)
+			},
+		})
+
+		connect := &paho.Connect{
+			ClientID:   config.ClientID,
+			KeepAlive:  30,
+			CleanStart: clean,
+			Properties: &paho.ConnectProperties{
+				SessionExpiryInterval: &sessionExpiry,
+			},
+		}
+		if config.Username != "" {
+			connect.Username = config.Username
+			connect.UsernameFlag = true
+			if config.Password != "" {
+				connect.Password = []byte(config.Password)
+				connect.PasswordFlag = true
+			}
+		}
+		if config.StatusTopic != "" {
+			connect.WillMessage = &paho.WillMessage{
+				Topic:   config.StatusTopic,
+				Payload: []byte(STATUS_OFFLINE),
+				QoS:     config.StatusQoS,
+				Retain:  config.StatusRetained,
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+		defer cancel()
+		connack, err := c.client.Connect(ctx, connect)
+		if err != nil {
+			return nil, false, err
+		}
+		session.lock.Lock()
+		session.current = c
+		session.lock.Unlock()
+		return c, connack.SessionPresent, nil
+	}
+}
+
+// dial opens a network connection to a server such as tcp://host:1883 or ssl://host:8883
+func dial(server string, tlsConfig *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: TIMEOUT}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return dialer.Dial("tcp", u.Host)
+	case "ssl", "tls", "tcps", "mqtts":
+		return tls.DialWithDialer(dialer, "tcp", u.Host, tlsConfig)
+	}
+	return nil, fmt.Errorf("unsupported MQTT 5 server %s", server)
+}
+
+// userProperties converts properties to MQTT 5 user properties, sorted by key
+func userProperties(properties map[string]string) paho.UserProperties {
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var user paho.UserProperties
+	for _, key := range keys {
+		user = append(user, paho.UserProperty{Key: key, Value: properties[key]})
+	}
+	return user
+}
+
+func (c *connection5) publish(topic string, qos byte, retained bool, payload string, properties map[string]string) error {
+	p := &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retained,
+		Payload: []byte(payload),
+	}
+	if len(properties) > 0 {
+		p.Properties = &paho.PublishProperties{User: userProperties(properties)}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+	_, err := c.client.Publish(ctx, p)
+	return err
+}
+
+func (c *connection5) subscribe(filters map[string]byte, callback func(*message)) error {
+	subscribe := &paho.Subscribe{
+		Subscriptions: make(map[string]paho.SubscribeOptions),
+	}
+	for filter, qos := range filters {
+		subscribe.Subscriptions[filter] = paho.SubscribeOptions{QoS: qos}
+		// replace the handler of a previous subscription to the same filter
+		c.session.router.UnregisterHandler(filter)
+		c.session.router.RegisterHandler(filter, func(p *paho.Publish) {
+			callback(c.session.message(p))
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+	_, err := c.client.Subscribe(ctx, subscribe)
+	return err
+}
+
+// message converts a received publish to a message. If the sender asked for a response,
+// the message can respond to its response topic with its correlation data.
+func (s *session5) message(p *paho.Publish) *message {
+	msg := &message{
+		topic:    p.Topic,
+		payload:  string(p.Payload),
+		retained: p.Retain,
+	}
+	if p.Properties != nil && p.Properties.ResponseTopic != "" {
+		responseTopic := p.Properties.ResponseTopic
+		correlationData := p.Properties.CorrelationData
+		msg.respond = func(payload string) error {
+			return s.respond(responseTopic, correlationData, payload)
+		}
+	}
+	return msg
+}
+
+func (c *connection5) unsubscribe(filters ...string) error {
+	for _, filter := range filters {
+		c.session.router.UnregisterHandler(filter)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+	_, err := c.client.Unsubscribe(ctx, &paho.Unsubscribe{Topics: filters})
+	return err
+}
+
+func (c *connection5) isOpen() bool {
+	return atomic.LoadInt32(&c.open) == 1
+}
+
+// disconnect disconnects from the broker and ends the session, since the client
+// is not coming back
+func (c *connection5) disconnect() {
+	atomic.StoreInt32(&c.open, 0)
+	var sessionExpiry uint32
+	c.client.Disconnect(&paho.Disconnect{
+		Properties: &paho.DisconnectProperties{SessionExpiryInterval: &sessionExpiry},
+	})
+}
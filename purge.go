@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"koolnova2mqtt/kn"
+	"koolnova2mqtt/mqtt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// runPurge implements the "purge" command, which clears all retained topics of a
+// module, including its Home Assistant discovery configuration and its Homie device
+func runPurge(args []string) {
+	hostname, _ := os.Hostname()
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	server := flags.String("server", "tcp://127.0.0.1:1883", "The full url of the MQTT server to connect to ex: tcp://127.0.0.1:1883")
+	clientid := flags.String("clientid", hostname+strconv.Itoa(time.Now().Second()), "A clientid for the connection")
+	username := flags.String("username", "", "A username to authenticate to the MQTT server")
+	password := flags.String("password", "", "Password to match username")
+	caCert := flags.String("caCert", "", "PEM file with the CA certificates that sign the MQTT server certificate. Defaults to the system CAs")
+	clientCert := flags.String("clientCert", "", "PEM file with a client certificate, to authenticate to the MQTT server with mutual TLS")
+	clientKey := flags.String("clientKey", "", "PEM file with the private key of clientCert")
+	tlsServerName := flags.String("tlsServerName", "", "Name expected in the MQTT server certificate. Defaults to the host of server")
+	tlsInsecure := flags.Bool("tlsInsecure", false, "Do not verify the MQTT server certificate. Insecure, for testing only")
+	mqttVersion := flags.Int("mqttVersion", mqtt.VERSION_311, "MQTT protocol version: 3 (MQTT 3.1.1) or 5 (MQTT 5)")
+	prefix := flags.String("prefix", "koolnova2mqtt", "MQTT topic root where the module publishes its topics")
+	hassPrefix := flags.String("hassPrefix", "homeassistant", "Home assistant discovery prefix")
+	homiePrefix := flags.String("homiePrefix", kn.DEFAULT_HOMIE_PREFIX, "Homie base topic")
+	qos := flags.String("mqttQoS", "", "QoS of the topic classes, as a comma-separated list such as discovery=1. Topics are cleared with the QoS of their class. Defaults to 0")
+	module := flags.String("module", "", "Name of the module to purge")
+	flags.Parse(args)
+
+	if *module == "" {
+		log.Fatalf("--module is required")
+	}
+	policies, err := parsePolicies(*qos, "")
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+
+	mqttClient, err := mqtt.New(&mqtt.Config{
+		Server:     *server,
+		ClientID:   *clientid,
+		Username:   *username,
+		Password:   *password,
+		CACert:     *caCert,
+		ClientCert: *clientCert,
+		ClientKey:  *clientKey,
+		ServerName: *tlsServerName,
+		Insecure:   *tlsInsecure,
+		Version:    *mqttVersion,
+	})
+	if err != nil {
+		log.Fatalf("Error initializing MQTT: %s", err)
+	}
+	defer mqttClient.Close()
+
+	n, err := kn.Purge(mqttClient, policies, *prefix, *hassPrefix, *homiePrefix, *module)
+	if err != nil {
+		log.Fatalf("Cannot purge %s: %s", *module, err)
+	}
+	log.Printf("Cleared %d retained topics of %s\n", n, *module)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package sim
+
+import (
+	"errors"
+	"os"
+)
+
+var ErrPtyUnsupported = errors.New("Pseudo terminals are only supported on Linux")
+
+// OpenPty is not supported on this platform
+func OpenPty() (*os.File, string, error) {
+	return nil, "", ErrPtyUnsupported
+}
@@ -0,0 +1,363 @@
+// Package sim simulates Koolnova 100-CPND00 controllers. It exposes the zone and
+// system register map through the modbus.Registers interface so it can be served
+// over the bus with a modbus.Server, and models how zone temperatures evolve
+// depending on the system mode, the zone state and its fan mode.
+package sim
+
+import (
+	"koolnova2mqtt/kn"
+	"koolnova2mqtt/modbus"
+	"math"
+	"sync"
+	"time"
+)
+
+// NUM_REGISTERS is the size of the register map of a controller
+const NUM_REGISTERS = kn.FIRST_SYS_REGISTER + kn.TOTAL_SYS_REGISTERS - 1
+
+const MIN_TARGET_TEMP = 15
+const MAX_TARGET_TEMP = 35
+
+// Heating or cooling rates, in degrees per simulated minute
+const AMBIENT_RATE = 0.05
+const UNDERFLOOR_RATE = 0.1
+
+var fanRates = map[kn.FanMode]float64{
+	kn.FAN_OFF:  0,
+	kn.FAN_LOW:  0.2,
+	kn.FAN_MED:  0.3,
+	kn.FAN_HIGH: 0.4,
+}
+
+// Config contains the configuration parameters for a new Simulator
+type Config struct {
+	SlaveIDs []byte  // slave IDs of the simulated controllers
+	Zones    int     // number of present zones in each controller
+	Machines int     // number of AC machines the zones are spread across
+	Ambient  float64 // temperature zones drift to when not conditioned
+	Speed    float64 // simulated seconds per real second
+}
+
+// Simulator simulates one or more controllers sharing a bus
+type Simulator struct {
+	Config
+	devices map[byte]*device
+	lock    sync.Mutex
+	closed  chan struct{}
+}
+
+// device is the state of a single simulated controller
+type device struct {
+	registers []uint16
+	temps     []float64 // precise current temperature of each zone
+}
+
+// New returns a new Simulator with all zones on, heating and set to 21 degrees
+func New(config *Config) *Simulator {
+	s := &Simulator{
+		Config:  *config,
+		devices: make(map[byte]*device),
+		closed:  make(chan struct{}),
+	}
+	if s.Zones > kn.NUM_ZONES {
+		s.Zones = kn.NUM_ZONES
+	}
+	if s.Machines < 1 {
+		s.Machines = 1
+	}
+	if s.Machines > kn.ACMachines {
+		s.Machines = kn.ACMachines
+	}
+	if s.Speed <= 0 {
+		s.Speed = 1
+	}
+	for _, slaveID := range s.SlaveIDs {
+		d := &device{
+			registers: make([]uint16, NUM_REGISTERS),
+			temps:     make([]float64, kn.NUM_ZONES),
+		}
+		sysMode := kn.MODE_AIR_HEATING
+		for n := 0; n < s.Zones; n++ {
+			d.temps[n] = s.Ambient
+			d.setZoneRegister(n, kn.REG_ENABLED, 0x3)
+			d.setZoneRegister(n, kn.REG_MODE, uint16(kn.FAN_AUTO)<<4|uint16(sysMode))
+			d.setZoneRegister(n, kn.REG_TARGET_TEMP, temp2reg(21))
+			d.setZoneRegister(n, kn.REG_CURRENT_TEMP, temp2reg(s.Ambient))
+		}
+		d.setRegister(kn.REG_SERIAL_CONFIG, 2) // 9600 bps, even parity
+		d.setRegister(kn.REG_SLAVE_ID, uint16(slaveID))
+		d.setRegister(kn.REG_EFFICIENCY, 3)
+		d.setRegister(kn.REG_SYSTEM_ENABLED, 1)
+		d.setRegister(kn.REG_SYS_KN_MODE, uint16(sysMode))
+		s.devices[slaveID] = d
+		s.updateMachines(d)
+	}
+	return s
+}
+
+// Start advances the simulation every interval until Close is called
+func (s *Simulator) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Step(interval)
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the simulation
+func (s *Simulator) Close() error {
+	close(s.closed)
+	return nil
+}
+
+// ReadRegister reads quantity registers starting at address of the given slave
+func (s *Simulator) ReadRegister(slaveID byte, address uint16, quantity uint16) (results []uint16, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	d, ok := s.devices[slaveID]
+	if !ok {
+		return nil, modbus.ErrUnknownSlave
+	}
+	if address == 0 || int(address)+int(quantity)-1 > NUM_REGISTERS {
+		return nil, modbus.ErrIllegalDataAddress
+	}
+	return append([]uint16(nil), d.registers[address-1:address-1+quantity]...), nil
+}
+
+// WriteRegister writes a register like the real controller would: values
+// are clamped to their valid range, read-only registers keep their value and
+// the actual resulting value is returned
+func (s *Simulator) WriteRegister(slaveID byte, address uint16, value uint16) (results []uint16, err error) {
+	return s.WriteRegisters(slaveID, address, []uint16{value})
+}
+
+// WriteRegisters writes consecutive registers, each one like WriteRegister does
+func (s *Simulator) WriteRegisters(slaveID byte, address uint16, values []uint16) (results []uint16, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	d, ok := s.devices[slaveID]
+	if !ok {
+		return nil, modbus.ErrUnknownSlave
+	}
+	if address == 0 || int(address)+len(values)-1 > NUM_REGISTERS {
+		return nil, modbus.ErrIllegalDataAddress
+	}
+
+	for n, value := range values {
+		a := address + uint16(n)
+		if a < kn.FIRST_SYS_REGISTER {
+			zone := int(a-1) / kn.REG_PER_ZONE
+			d.writeZoneRegister(zone, int(a-1)%kn.REG_PER_ZONE+1, value)
+		} else {
+			d.writeSysRegister(int(a), value)
+		}
+		results = append(results, d.registers[a-1])
+	}
+	s.updateMachines(d)
+	return results, nil
+}
+
+func (d *device) register(address int) uint16 {
+	return d.registers[address-1]
+}
+
+func (d *device) setRegister(address int, value uint16) {
+	d.registers[address-1] = value
+}
+
+func (d *device) zoneRegister(zone int, num int) uint16 {
+	return d.register(zone*kn.REG_PER_ZONE + num)
+}
+
+func (d *device) setZoneRegister(zone int, num int, value uint16) {
+	d.setRegister(zone*kn.REG_PER_ZONE+num, value)
+}
+
+func (d *device) isPresent(zone int) bool {
+	return d.zoneRegister(zone, kn.REG_ENABLED)&0x2 != 0
+}
+
+func (d *device) isOn(zone int) bool {
+	return d.zoneRegister(zone, kn.REG_ENABLED)&0x1 != 0
+}
+
+func (d *device) fanMode(zone int) kn.FanMode {
+	return kn.FanMode(d.zoneRegister(zone, kn.REG_MODE)&0x00F0) >> 4
+}
+
+func (d *device) knMode() kn.KnMode {
+	return kn.KnMode(d.register(kn.REG_SYS_KN_MODE))
+}
+
+func (d *device) writeZoneRegister(zone int, num int, value uint16) {
+	if !d.isPresent(zone) {
+		return
+	}
+	switch num {
+	case kn.REG_ENABLED:
+		// the presence bit cannot be changed
+		d.setZoneRegister(zone, num, value&0x1|0x2)
+	case kn.REG_MODE:
+		// only the fan mode can be set per zone, the mode follows the system
+		fanMode := kn.FanMode(value&0x00F0) >> 4
+		if fanMode < kn.FAN_LOW || fanMode > kn.FAN_AUTO {
+			return
+		}
+		d.setZoneRegister(zone, num, uint16(fanMode)<<4|uint16(d.knMode()))
+	case kn.REG_TARGET_TEMP:
+		t := reg2temp(value)
+		t = math.Max(MIN_TARGET_TEMP, math.Min(MAX_TARGET_TEMP, t))
+		d.setZoneRegister(zone, num, temp2reg(t))
+	}
+	// REG_CURRENT_TEMP is read-only
+}
+
+func (d *device) writeSysRegister(address int, value uint16) {
+	switch address {
+	case kn.REG_SYSTEM_ENABLED:
+		if value != 0 {
+			value = 1
+		}
+		d.setRegister(address, value)
+	case kn.REG_EFFICIENCY:
+		if value >= 1 && value <= 5 {
+			d.setRegister(address, value)
+		}
+	case kn.REG_SYS_KN_MODE:
+		switch kn.KnMode(value) {
+		case kn.MODE_AIR_COOLING, kn.MODE_AIR_HEATING, kn.MODE_UNDERFLOOR_HEATING,
+			kn.MODE_UNDERFLOOR_AIR_COOLING, kn.MODE_UNDERFLOOR_AIR_HEATING:
+		default:
+			return
+		}
+		d.setRegister(address, value)
+		for zone := 0; zone < kn.NUM_ZONES; zone++ {
+			if d.isPresent(zone) {
+				r := d.zoneRegister(zone, kn.REG_MODE)&0x00F0 | value
+				d.setZoneRegister(zone, kn.REG_MODE, r)
+			}
+		}
+	}
+	// The remaining system registers are read-only or not modelled
+}
+
+// machine returns the AC machine index (0-based) a zone is served by
+func (s *Simulator) machine(zone int) int {
+	return zone % s.Machines
+}
+
+// updateMachines recalculates the AC machine registers from the state of
+// the zones they serve
+func (s *Simulator) updateMachines(d *device) {
+	enabled := d.register(kn.REG_SYSTEM_ENABLED) != 0
+	air := d.knMode() != kn.MODE_UNDERFLOOR_HEATING
+	for ac := 0; ac < kn.ACMachines; ac++ {
+		var fanMode kn.FanMode
+		var targetSum float64
+		var count int
+		for zone := 0; zone < kn.NUM_ZONES; zone++ {
+			if !d.isPresent(zone) || !d.isOn(zone) || s.machine(zone) != ac {
+				continue
+			}
+			targetSum += reg2temp(d.zoneRegister(zone, kn.REG_TARGET_TEMP))
+			count++
+			if fm := d.fanMode(zone); fm > fanMode {
+				fanMode = fm
+			}
+		}
+		var target, airflow uint16
+		if enabled && air && count > 0 {
+			target = temp2reg(targetSum / float64(count))
+			airflow = uint16(fanMode)
+			if fanMode == kn.FAN_AUTO {
+				airflow = uint16(kn.FAN_HIGH)
+			}
+		} else {
+			fanMode = kn.FAN_OFF
+		}
+		d.setRegister(kn.REG_AIRFLOW+ac, airflow)
+		d.setRegister(kn.REG_AC_TARGET_TEMP+ac, target)
+		d.setRegister(kn.REG_AC_TARGET_FAN_MODE+ac, uint16(fanMode))
+	}
+}
+
+// Step advances the simulation by the given amount of real time
+func (s *Simulator) Step(elapsed time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	minutes := elapsed.Minutes() * s.Speed
+	for _, d := range s.devices {
+		for zone := 0; zone < kn.NUM_ZONES; zone++ {
+			if !d.isPresent(zone) {
+				continue
+			}
+			current := d.temps[zone]
+			target := reg2temp(d.zoneRegister(zone, kn.REG_TARGET_TEMP))
+			goal, rate := s.goal(d, zone, current, target)
+			if current < goal {
+				current = math.Min(goal, current+rate*minutes)
+			} else {
+				current = math.Max(goal, current-rate*minutes)
+			}
+			d.temps[zone] = current
+			d.setZoneRegister(zone, kn.REG_CURRENT_TEMP, temp2reg(current))
+		}
+	}
+}
+
+// goal returns the temperature a zone is heading to and how fast
+func (s *Simulator) goal(d *device, zone int, current, target float64) (float64, float64) {
+	if d.register(kn.REG_SYSTEM_ENABLED) == 0 || !d.isOn(zone) {
+		return s.Ambient, AMBIENT_RATE
+	}
+
+	var heating, underfloor, air bool
+	switch d.knMode() {
+	case kn.MODE_AIR_COOLING:
+		air = true
+	case kn.MODE_AIR_HEATING:
+		heating, air = true, true
+	case kn.MODE_UNDERFLOOR_HEATING:
+		heating, underfloor = true, true
+	case kn.MODE_UNDERFLOOR_AIR_COOLING:
+		underfloor, air = true, true
+	case kn.MODE_UNDERFLOOR_AIR_HEATING:
+		heating, underfloor, air = true, true, true
+	}
+
+	// the zone only conditions the air in the direction of the mode
+	if heating && current >= target || !heating && current <= target {
+		return s.Ambient, AMBIENT_RATE
+	}
+
+	var rate float64
+	if underfloor {
+		rate += UNDERFLOOR_RATE
+	}
+	if air {
+		fanMode := d.fanMode(zone)
+		if fanMode == kn.FAN_AUTO {
+			fanMode = kn.FAN_LOW
+			if math.Abs(target-current) > 2 {
+				fanMode = kn.FAN_HIGH
+			}
+		}
+		rate += fanRates[fanMode]
+	}
+	return target, rate
+}
+
+func reg2temp(r uint16) float64 {
+	return float64(0x00FF&r) / 2.0
+}
+
+func temp2reg(t float64) uint16 {
+	return uint16(math.Round(t * 2))
+}
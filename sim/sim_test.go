@@ -0,0 +1,176 @@
+package sim_test
+
+import (
+	"koolnova2mqtt/kn"
+	"koolnova2mqtt/modbus"
+	"koolnova2mqtt/sim"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+const ZONE2_BASE = kn.REG_PER_ZONE
+
+func newSimulator() *sim.Simulator {
+	return sim.New(&sim.Config{
+		SlaveIDs: []byte{49},
+		Zones:    3,
+		Machines: 2,
+		Ambient:  18,
+	})
+}
+
+func read(t *ut.DefaultTestTools, s *sim.Simulator, address int) uint16 {
+	results, err := s.ReadRegister(49, uint16(address), 1)
+	t.Ok(err)
+	return results[0]
+}
+
+func TestWrites(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	s := newSimulator()
+
+	_, err := s.ReadRegister(50, 1, 1)
+	t.MustFailWith(err, modbus.ErrUnknownSlave)
+	_, err = s.ReadRegister(49, 80, 10)
+	t.MustFailWith(err, modbus.ErrIllegalDataAddress)
+
+	// target temperature is clamped
+	results, err := s.WriteRegister(49, ZONE2_BASE+kn.REG_TARGET_TEMP, 80)
+	t.Ok(err)
+	t.Equals([]uint16{2 * sim.MAX_TARGET_TEMP}, results)
+
+	// zones cannot be made absent, and absent zones cannot be turned on
+	results, err = s.WriteRegister(49, ZONE2_BASE+kn.REG_ENABLED, 0)
+	t.Ok(err)
+	t.Equals([]uint16{0x2}, results)
+	results, err = s.WriteRegister(49, 3*kn.REG_PER_ZONE+kn.REG_ENABLED, 3)
+	t.Ok(err)
+	t.Equals([]uint16{0}, results)
+
+	// only the fan mode can be changed per zone
+	results, err = s.WriteRegister(49, ZONE2_BASE+kn.REG_MODE, uint16(kn.FAN_LOW)<<4|uint16(kn.MODE_AIR_COOLING))
+	t.Ok(err)
+	t.Equals([]uint16{uint16(kn.FAN_LOW)<<4 | uint16(kn.MODE_AIR_HEATING)}, results)
+
+	// system mode changes are reflected in all zones
+	_, err = s.WriteRegister(49, kn.REG_SYS_KN_MODE, uint16(kn.MODE_UNDERFLOOR_AIR_COOLING))
+	t.Ok(err)
+	t.Equals(uint16(kn.FAN_AUTO)<<4|uint16(kn.MODE_UNDERFLOOR_AIR_COOLING), read(t, s, kn.REG_MODE))
+	t.Equals(uint16(kn.FAN_LOW)<<4|uint16(kn.MODE_UNDERFLOOR_AIR_COOLING), read(t, s, ZONE2_BASE+kn.REG_MODE))
+
+	results, err = s.WriteRegister(49, kn.REG_SYS_KN_MODE, 0x09)
+	t.Ok(err)
+	t.Equals([]uint16{uint16(kn.MODE_UNDERFLOOR_AIR_COOLING)}, results)
+
+	// zone 2 is off, so the second AC machine is idle
+	t.Equals(uint16(kn.FAN_HIGH), read(t, s, kn.REG_AIRFLOW))
+	t.Equals(uint16(kn.FAN_AUTO), read(t, s, kn.REG_AC_TARGET_FAN_MODE))
+	t.Equals(uint16(42), read(t, s, kn.REG_AC_TARGET_TEMP))
+	t.Equals(uint16(0), read(t, s, kn.REG_AIRFLOW+1))
+}
+
+func TestDrift(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	s := newSimulator()
+	_, err := s.WriteRegister(49, ZONE2_BASE+kn.REG_MODE, uint16(kn.FAN_LOW)<<4)
+	t.Ok(err)
+	_, err = s.WriteRegister(49, 2*kn.REG_PER_ZONE+kn.REG_ENABLED, 0)
+	t.Ok(err)
+
+	// 18 degrees, heating to 21
+	t.Equals(uint16(36), read(t, s, kn.REG_CURRENT_TEMP))
+	s.Step(5 * time.Minute)
+	t.Equals(uint16(40), read(t, s, kn.REG_CURRENT_TEMP))            // auto fan, 0.4 degrees per minute
+	t.Equals(uint16(38), read(t, s, ZONE2_BASE+kn.REG_CURRENT_TEMP)) // low fan, 0.2 degrees per minute
+	t.Equals(uint16(36), read(t, s, 2*kn.REG_PER_ZONE+kn.REG_CURRENT_TEMP))
+
+	s.Step(time.Hour)
+	t.Equals(uint16(42), read(t, s, kn.REG_CURRENT_TEMP))
+
+	// cooling a zone colder than its target leaves it to drift to ambient
+	_, err = s.WriteRegister(49, kn.REG_SYS_KN_MODE, uint16(kn.MODE_AIR_COOLING))
+	t.Ok(err)
+	s.Step(10 * time.Minute)
+	t.Equals(uint16(41), read(t, s, kn.REG_CURRENT_TEMP))
+}
+
+type mqttMock struct {
+	subscriptions map[string]func(message string)
+	retained      map[string]string
+}
+
+func (m *mqttMock) Publish(topic string, qos byte, retained bool, payload string) error {
+	m.retained[topic] = payload
+	return nil
+}
+
+func (m *mqttMock) Subscribe(topic string, callback func(message string)) error {
+	m.subscriptions[topic] = callback
+	return nil
+}
+
+func TestBridge(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	s := newSimulator()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Ok(err)
+	server := modbus.NewServer(s, modbus.FRAMING_TCP)
+	defer server.Close()
+	go server.Serve(l)
+
+	mb, err := modbus.New(&modbus.Config{
+		Endpoint: "tcp://" + l.Addr().String(),
+		Timeout:  time.Second,
+	})
+	t.Ok(err)
+	defer mb.Close()
+
+	mqttClient := &mqttMock{
+		subscriptions: make(map[string]func(string)),
+		retained:      make(map[string]string),
+	}
+	b := kn.NewBridge(&kn.Config{
+		ModuleName:  "sim",
+		SlaveID:     49,
+		TopicPrefix: "koolnova2mqtt",
+		HassPrefix:  "homeassistant",
+		MaxTemp:     40, // let the controller clamp it
+		Mqtt:        mqttClient,
+		Modbus:      mb,
+	})
+	t.Ok(b.Start())
+	t.Equals("21", mqttClient.retained["koolnova2mqtt/sim/zone1/targetTemp"])
+	t.Equals("heat", mqttClient.retained["koolnova2mqtt/sim/zone3/hvacMode"])
+	_, ok := mqttClient.retained["koolnova2mqtt/sim/zone4/targetTemp"]
+	t.Assert(!ok, "zone 4 must not be present")
+
+	// the controller clamps the target temperature, which is noticed
+	// when the register is read back
+	mqttClient.subscriptions["koolnova2mqtt/sim/zone1/targetTemp/set"]("40")
+	t.Equals("35", mqttClient.retained["koolnova2mqtt/sim/zone1/targetTemp"])
+	t.Equals(`{"result":"clamped","requested":"40","value":"35"}`, mqttClient.retained["koolnova2mqtt/sim/zone1/targetTemp/set/result"])
+	t.Ok(b.Tick())
+	t.Equals("35", mqttClient.retained["koolnova2mqtt/sim/zone1/targetTemp"])
+
+	mqttClient.subscriptions["koolnova2mqtt/sim/zone1/targetTemp/set"]("22.5")
+	t.Equals(`{"result":"accepted","requested":"22.5","value":"22.5"}`, mqttClient.retained["koolnova2mqtt/sim/zone1/targetTemp/set/result"])
+
+	mqttClient.subscriptions["koolnova2mqtt/sim/zone2/hvacMode/set"]("cool")
+	t.Equals("cool", mqttClient.retained["koolnova2mqtt/sim/zone2/hvacMode"])
+
+	// zone 2 is cooled from 18 to 15 degrees. The published temperature
+	// is the average of the samples taken on each tick
+	mqttClient.subscriptions["koolnova2mqtt/sim/zone2/targetTemp/set"]("15")
+	s.Step(10 * time.Minute)
+	t.Ok(b.Tick())
+	t.Equals("16.5", mqttClient.retained["koolnova2mqtt/sim/zone2/currentTemp"])
+}
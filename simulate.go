@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"koolnova2mqtt/modbus"
+	"koolnova2mqtt/sim"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runSimulator implements the "simulate" command, which serves one or more
+// simulated controllers over Modbus TCP, RTU over TCP or a pseudo terminal
+func runSimulator(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	listen := flags.String("listen", "tcp://0.0.0.0:5020", "Where to serve the simulated bus, as tcp://host:port (Modbus TCP) or rtuovertcp://host:port (RTU over TCP)")
+	pty := flags.Bool("pty", false, "Serve Modbus RTU on a pseudo terminal instead of a TCP port. Its path is printed on startup")
+	slaveIDs := flags.String("modbusSlaveIDs", "49", "Comma-separated list of modbus slave IDs to simulate")
+	zones := flags.Int("zones", 4, "Number of present zones in each controller")
+	machines := flags.Int("machines", 1, "Number of AC machines zones are spread across")
+	ambient := flags.Float64("ambient", 18, "Temperature zones drift to when they are not conditioned")
+	speed := flags.Float64("speed", 1, "Simulation speed. 60 simulates a minute every second")
+	flags.Parse(args)
+
+	var slaves []byte
+	for _, slaveIDStr := range strings.Split(*slaveIDs, ",") {
+		slaveID, err := strconv.Atoi(slaveIDStr)
+		if err != nil || slaveID < 1 || slaveID > 247 {
+			log.Fatalf("Invalid slave ID %q", slaveIDStr)
+		}
+		slaves = append(slaves, byte(slaveID))
+	}
+
+	simulator := sim.New(&sim.Config{
+		SlaveIDs: slaves,
+		Zones:    *zones,
+		Machines: *machines,
+		Ambient:  *ambient,
+		Speed:    *speed,
+	})
+	simulator.Start(time.Second)
+	defer simulator.Close()
+
+	if *pty {
+		master, slavePath, err := sim.OpenPty()
+		if err != nil {
+			log.Fatalf("Cannot open pseudo terminal: %s", err)
+		}
+		// keep the slave end open so the master does not fail when clients disconnect
+		slave, err := os.OpenFile(slavePath, os.O_RDWR, 0)
+		if err != nil {
+			log.Fatalf("Cannot open pseudo terminal %s: %s", slavePath, err)
+		}
+		defer slave.Close()
+		server := modbus.NewServer(simulator, modbus.FRAMING_RTU)
+		defer server.Close()
+		go server.ServeConn(master)
+		log.Printf("Simulating slaves %s on %s\n", *slaveIDs, slavePath)
+	} else {
+		u, err := url.Parse(*listen)
+		if err != nil {
+			log.Fatalf("Invalid listen address %q: %s", *listen, err)
+		}
+		var framing modbus.Framing
+		switch u.Scheme {
+		case modbus.SCHEME_TCP:
+			framing = modbus.FRAMING_TCP
+		case modbus.SCHEME_RTU_OVER_TCP:
+			framing = modbus.FRAMING_RTU
+		default:
+			log.Fatalf("Unsupported listen scheme %q", u.Scheme)
+		}
+		l, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			log.Fatalf("Cannot listen on %s: %s", u.Host, err)
+		}
+		server := modbus.NewServer(simulator, framing)
+		defer server.Close()
+		go server.Serve(l)
+		log.Printf("Simulating slaves %s on %s\n", *slaveIDs, *listen)
+	}
+
+	ctrlC := make(chan os.Signal, 1)
+	signal.Notify(ctrlC, os.Interrupt, syscall.SIGTERM)
+	<-ctrlC
+}
@@ -10,6 +10,7 @@ import (
 type Modbus interface {
 	ReadRegister(slaveID byte, address uint16, quantity uint16) (results []uint16, err error)
 	WriteRegister(slaveID byte, address uint16, value uint16) (results []uint16, err error)
+	WriteRegisters(slaveID byte, address uint16, values []uint16) (results []uint16, err error)
 	Close() error
 }
 
@@ -26,6 +27,7 @@ type Watcher struct {
 	Config
 	state     []uint16                        // current view of the modbus register states
 	callbacks map[uint16]func(address uint16) // set of callbacks
+	version   uint64                          // incremented whenever the cache is updated outside Poll
 	lock      *sync.RWMutex
 }
 
@@ -47,15 +49,24 @@ func (w *Watcher) RegisterCallback(address uint16, callback func(address uint16)
 	w.callbacks[address] = callback
 }
 
-// Poll refreshes the cache by reading the watched register range from the slave device
+// Poll refreshes the cache by reading the watched register range from the slave device.
+// The lock is not held while reading, so writes do not wait for polls. If a register is
+// written in the meantime, the poll results may be stale and are discarded.
 func (w *Watcher) Poll() error {
 	w.lock.Lock()
-	newState, err := w.Modbus.ReadRegister(w.SlaveID, w.Address, w.Quantity)
+	version := w.version
+	quantity := w.Quantity
+	w.lock.Unlock()
+	newState, err := w.Modbus.ReadRegister(w.SlaveID, w.Address, quantity)
 	if err != nil {
-		w.lock.Unlock()
 		return err
 	}
 
+	w.lock.Lock()
+	if w.version != version {
+		w.lock.Unlock()
+		return nil
+	}
 	oldState := w.state
 	w.state = newState
 	var callbackAddresses []uint16
@@ -95,12 +106,12 @@ func (w *Watcher) ReadRegister(address uint16) (value uint16) {
 
 // WriteRegister writes the value to the slave device and updates the cache if successful
 func (w *Watcher) WriteRegister(address uint16, value uint16) error {
-	w.lock.Lock()
 	results, err := w.Modbus.WriteRegister(w.SlaveID, address, value)
 	if err != nil {
-		w.lock.Unlock()
 		return err
 	}
+	w.lock.Lock()
+	w.version++
 	w.state[int(address-w.Address)] = results[0]
 	callback := w.callbacks[address]
 	w.lock.Unlock()
@@ -110,6 +121,49 @@ func (w *Watcher) WriteRegister(address uint16, value uint16) error {
 	return nil
 }
 
+// WriteRegisters writes consecutive registers to the slave device at once and updates the cache if successful
+func (w *Watcher) WriteRegisters(address uint16, values []uint16) error {
+	results, err := w.Modbus.WriteRegisters(w.SlaveID, address, values)
+	if err != nil {
+		return err
+	}
+	w.lock.Lock()
+	w.version++
+	copy(w.state[int(address-w.Address):], results)
+	// copy the callbacks while locked, they are called once the lock is released
+	callbacks := make([]func(address uint16), len(results))
+	for n := range results {
+		callbacks[n] = w.callbacks[address+uint16(n)]
+	}
+	w.lock.Unlock()
+	for n, callback := range callbacks {
+		if callback != nil {
+			callback(address + uint16(n))
+		}
+	}
+	return nil
+}
+
+// Refresh reads one register from the slave device, bypassing the cache, and fires
+// its callback if the value changed
+func (w *Watcher) Refresh(address uint16) error {
+	results, err := w.Modbus.ReadRegister(w.SlaveID, address, 1)
+	if err != nil {
+		return err
+	}
+	w.lock.Lock()
+	w.version++
+	n := int(address - w.Address)
+	changed := w.state[n] != results[0]
+	w.state[n] = results[0]
+	callback := w.callbacks[address]
+	w.lock.Unlock()
+	if changed && callback != nil {
+		callback(address)
+	}
+	return nil
+}
+
 // TriggerCallbacks calls all callbacks
 func (w *Watcher) TriggerCallbacks() {
 	for address, callback := range w.callbacks {
@@ -121,6 +175,7 @@ func (w *Watcher) TriggerCallbacks() {
 func (w *Watcher) Resize(newQuantity int) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
+	w.version++
 	if newQuantity <= int(w.Quantity) {
 		w.state = w.state[:newQuantity]
 		for address := range w.callbacks {
@@ -22,18 +22,39 @@ func (ms *BuggyModbus) WriteRegister(slaveID byte, address uint16, value uint16)
 	return nil, modbusError
 }
 
+func (ms *BuggyModbus) WriteRegisters(slaveID byte, address uint16, values []uint16) (results []uint16, err error) {
+	return nil, modbusError
+}
+
 func (ms *BuggyModbus) Close() error { return nil }
 
+// writingModbus calls write after reading the registers, like a write that completes during a poll
+type writingModbus struct {
+	watcher.Modbus
+	write func()
+}
+
+func (m *writingModbus) ReadRegister(slaveID byte, address uint16, quantity uint16) ([]uint16, error) {
+	results, err := m.Modbus.ReadRegister(slaveID, address, quantity)
+	if m.write != nil {
+		write := m.write
+		m.write = nil
+		write()
+	}
+	return results, err
+}
+
 func TestWatcher(tx *testing.T) {
 	t := ut.BeginTest(tx, false)
 	defer t.FinishTest()
 	var err error
 
+	mock := modbus.NewMock()
 	w := watcher.New(&watcher.Config{
 		Address:  1,
 		Quantity: 5,
 		SlaveID:  49,
-		Modbus:   modbus.NewMock(),
+		Modbus:   mock,
 	})
 
 	var cbAddress uint16
@@ -81,6 +102,14 @@ func TestWatcher(tx *testing.T) {
 	cbNewValue := w.ReadRegister(3)
 	t.Equals(uint16(0x1234), cbNewValue)
 
+	// block writes fire the callbacks of every register written
+	callbackCount = 0
+	t.Ok(w.WriteRegisters(2, []uint16{0x0102, 0x0304, 0x0506}))
+	t.Equals(2, callbackCount)
+	t.Equals(uint16(0x0506), w.ReadRegister(4))
+	t.Equals([]uint16{0x0102, 0x0304, 0x0506}, mock.State[49][1:4])
+	t.Ok(w.WriteRegister(3, 0x1234))
+
 	callbackCount = 0
 	err = w.Poll()
 	t.Ok(err)
@@ -89,6 +118,26 @@ func TestWatcher(tx *testing.T) {
 	w.TriggerCallbacks()
 	t.Equals(2, callbackCount)
 
+	// Refresh reads a register from the device and fires its callback if it changed
+	mock.State[49][2] = 0x4321
+	callbackCount = 0
+	t.Ok(w.Refresh(3))
+	t.Equals(1, callbackCount)
+	t.Equals(uint16(0x4321), w.ReadRegister(3))
+	t.Ok(w.Refresh(3))
+	t.Equals(1, callbackCount)
+
+	// a poll that overlaps a write is discarded, since its results may predate the write
+	stale := &writingModbus{Modbus: mock}
+	w.Modbus = stale
+	stale.write = func() {
+		t.Ok(w.WriteRegister(3, 0x2222))
+	}
+	callbackCount = 0
+	t.Ok(w.Poll())
+	t.Equals(1, callbackCount)
+	t.Equals(uint16(0x2222), w.ReadRegister(3))
+
 	w = watcher.New(&watcher.Config{
 		Address:  1,
 		Quantity: 5,
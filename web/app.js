@@ -0,0 +1,158 @@
+"use strict";
+
+// Dashboard of all modules. The state is read from /modules, changes are sent
+// to the same API and updates arrive through the /events change stream.
+
+const TEMP_STEP = 0.5;
+const REFRESH_INTERVAL = 30000; // refresh everything in case an event was lost
+
+const modulesElement = document.getElementById("modules");
+const errorElement = document.getElementById("error");
+const connectionElement = document.getElementById("connection");
+const pending = {}; // module refreshes scheduled after a change
+
+function showError(message) {
+	errorElement.textContent = message;
+	errorElement.hidden = !message;
+}
+
+async function request(method, path, body) {
+	const res = await fetch(path, {
+		method: method,
+		headers: { "Content-Type": "application/json" },
+		body: body === undefined ? undefined : JSON.stringify(body),
+	});
+	const result = await res.json();
+	if (!res.ok) {
+		throw new Error(result.error || res.statusText);
+	}
+	return result;
+}
+
+async function update(path, body) {
+	try {
+		await request("PATCH", path, body);
+		showError("");
+	} catch (err) {
+		showError(err.message);
+	}
+}
+
+function modulePath(module) {
+	return "/modules/" + encodeURIComponent(module.name);
+}
+
+function formatTemp(temp) {
+	return temp.toFixed(1) + " °C";
+}
+
+function renderZone(module, zone) {
+	const element = document.getElementById("zone-template").content.firstElementChild.cloneNode(true);
+	const path = modulePath(module) + "/zones/" + zone.zone;
+
+	element.classList.toggle("off", !zone.on);
+	element.querySelector(".zone-name").textContent = zone.name;
+	element.querySelector(".current-temp").textContent = formatTemp(zone.currentTemp);
+	element.querySelector(".target-temp").textContent = formatTemp(zone.targetTemp);
+
+	const setTarget = (temp) => {
+		temp = Math.min(module.maxTemp, Math.max(module.minTemp, temp));
+		update(path, { targetTemp: temp });
+	};
+	element.querySelector(".target-down").onclick = () => setTarget(zone.targetTemp - TEMP_STEP);
+	element.querySelector(".target-up").onclick = () => setTarget(zone.targetTemp + TEMP_STEP);
+
+	const hvacMode = element.querySelector(".hvac-mode");
+	hvacMode.value = zone.hvacMode;
+	hvacMode.onchange = () => update(path, { hvacMode: hvacMode.value });
+
+	const fanMode = element.querySelector(".fan-mode");
+	fanMode.value = zone.fanMode;
+	fanMode.onchange = () => update(path, { fanMode: fanMode.value });
+	return element;
+}
+
+function renderModule(module) {
+	const element = document.getElementById("module-template").content.firstElementChild.cloneNode(true);
+	element.dataset.module = module.name;
+	element.querySelector(".module-name").textContent = module.name;
+
+	const sys = module.sys;
+	if (sys) {
+		const holdMode = element.querySelector(".hold-mode");
+		holdMode.value = sys.holdMode;
+		holdMode.onchange = () => update(modulePath(module) + "/sys", { holdMode: holdMode.value });
+		element.querySelector(".sys-enabled").textContent = sys.enabled ? "System on" : "System off";
+		element.querySelector(".sys-efficiency").textContent = "Efficiency " + sys.efficiency;
+
+		const machines = element.querySelector(".machines tbody");
+		for (const m of sys.machines) {
+			const row = machines.insertRow();
+			for (const value of [m.machine, m.airflow, formatTemp(m.targetTemp), m.fanMode]) {
+				row.insertCell().textContent = value;
+			}
+		}
+	} else {
+		element.querySelector(".sys").textContent = "Module not started";
+		element.querySelector(".machines").hidden = true;
+	}
+
+	const zones = element.querySelector(".zones");
+	for (const zone of module.zones) {
+		zones.appendChild(renderZone(module, zone));
+	}
+	return element;
+}
+
+async function refreshAll() {
+	try {
+		const modules = await request("GET", "/modules");
+		modulesElement.textContent = "";
+		for (const module of modules || []) {
+			modulesElement.appendChild(renderModule(module));
+		}
+	} catch (err) {
+		showError(err.message);
+	}
+}
+
+async function refreshModule(name) {
+	delete pending[name];
+	try {
+		const module = await request("GET", "/modules/" + encodeURIComponent(name));
+		const element = renderModule(module);
+		const old = [...modulesElement.children].find((e) => e.dataset.module === name);
+		if (old) {
+			old.replaceWith(element);
+		} else {
+			modulesElement.appendChild(element);
+		}
+	} catch (err) {
+		showError(err.message);
+	}
+}
+
+// a write changes several values at once, so refresh the module once they have arrived
+function scheduleRefresh(name) {
+	if (!pending[name]) {
+		pending[name] = setTimeout(() => refreshModule(name), 200);
+	}
+}
+
+function connect() {
+	const events = new EventSource("/events");
+	events.onopen = () => {
+		connectionElement.textContent = "live";
+		connectionElement.className = "";
+		refreshAll();
+	};
+	events.onerror = () => {
+		connectionElement.textContent = "reconnecting";
+		connectionElement.className = "offline";
+	};
+	events.addEventListener("change", (e) => scheduleRefresh(JSON.parse(e.data).module));
+}
+
+refreshAll();
+connect();
+setInterval(refreshAll, REFRESH_INTERVAL);